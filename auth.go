@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/melinysh/dropboxfs/oauth"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/term"
+)
+
+// Account used unless -t says otherwise.
+const defaultAccount = "default"
+
+// Where older versions saved the token, read when the store has none.
+const legacyTokenFile = "./dropbox_token"
+
+// Environment variable the token store passphrase can be given in, for
+// mounts started without a terminal.
+const passphraseEnv = "DROPBOXFS_PASSPHRASE"
+
+// Passphrase the token store was opened with, handed on to background mounts
+// on their stdin.
+var storePassphrase []byte
+
+// readPassphrase gets the passphrase of the token store at path, asking
+// for it twice when the store is yet to be made.
+func readPassphrase(path string) ([]byte, error) {
+	if p, found := os.LookupEnv(passphraseEnv); found {
+		// Not passed on to the processes we start
+		os.Unsetenv(passphraseEnv)
+		return []byte(p), nil
+	}
+	if isDaemon() {
+		// Sent by the process that started this background mount, out of
+		// sight of /proc/<pid>/environ
+		p, err := ioutil.ReadAll(os.Stdin)
+		if err == nil && len(p) == 0 {
+			err = errors.New("no token store passphrase from the process that started the mount")
+		}
+		return p, err
+	}
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return nil, fmt.Errorf("no terminal to ask for the token store passphrase, set $%v", passphraseEnv)
+	}
+	fmt.Fprintf(os.Stderr, "Passphrase for %v: ", path)
+	p, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err != nil || oauth.StoreExists(path) {
+		return p, err
+	}
+	fmt.Fprint(os.Stderr, "Again, to confirm: ")
+	again, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	if string(again) != string(p) {
+		return nil, errors.New("passphrases don't match")
+	}
+	return p, nil
+}
+
+// openStore opens the token store in the user config directory.
+func openStore() (*oauth.Store, error) {
+	path, err := oauth.DefaultStorePath()
+	if err != nil {
+		return nil, err
+	}
+	passphrase, err := readPassphrase(path)
+	if err != nil {
+		return nil, err
+	}
+	store, err := oauth.OpenStore(path, passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open token store %v: %v", path, err)
+	}
+	storePassphrase = passphrase
+	return store, nil
+}
+
+// loadToken finds the token of account, and how to save it once refreshed.
+// account is either the name of an account in the token store or a token
+// file saved by older versions, which keep working but are plaintext.
+func loadToken(account string) (*oauth.Token, func(*oauth.Token), error) {
+	if strings.ContainsRune(account, filepath.Separator) || isFile(account) {
+		return loadTokenFile(account)
+	}
+	path, err := oauth.DefaultStorePath()
+	if err != nil {
+		return nil, nil, err
+	}
+	// Older versions saved the token to ./dropbox_token
+	legacy := account == defaultAccount && isFile(legacyTokenFile)
+	if legacy && !oauth.StoreExists(path) {
+		return loadTokenFile(legacyTokenFile)
+	}
+	store, err := openStore()
+	if err != nil {
+		return nil, nil, err
+	}
+	token, err := store.Get(account)
+	if err == oauth.ErrNoAccount && legacy {
+		return loadTokenFile(legacyTokenFile)
+	} else if err == oauth.ErrNoAccount {
+		return nil, nil, fmt.Errorf("no Dropbox token for account %v, run `dropboxfs auth -t %v` first", account, account)
+	} else if err != nil {
+		return nil, nil, err
+	}
+	return token, func(t *oauth.Token) {
+		if err := store.Put(account, t); err != nil {
+			log.Errorln("Unable to save refreshed token of", account, err)
+		}
+	}, nil
+}
+
+// loadTokenFile reads a plaintext token file saved by older versions.
+func loadTokenFile(file string) (*oauth.Token, func(*oauth.Token), error) {
+	log.Warnln("Reading the token from", file, "in plaintext, run `dropboxfs auth` to move it to the encrypted token store")
+	token, err := oauth.Load(file)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to open token file %v: %v", file, err)
+	}
+	return token, func(t *oauth.Token) {
+		if err := oauth.Save(file, t); err != nil {
+			log.Errorln("Unable to save refreshed token to", file, err)
+		}
+	}, nil
+}
+
+func isFile(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.Mode().IsRegular()
+}
+
+// runAuth authorizes dropboxfs with a Dropbox account and saves the token it
+// gets, for mounts to use.
+func runAuth(args []string) {
+	flags := flag.NewFlagSet("auth", flag.ExitOnError)
+	appKeyPtr := flags.String("app-key", os.Getenv("DROPBOXFS_APP_KEY"), "Key of your Dropbox app (default $DROPBOXFS_APP_KEY)")
+	accountPtr := flags.String("t", defaultAccount, "Name to save the token under in the token store, to mount with -t")
+	noRedirectPtr := flags.Bool("no-redirect", false, "Paste the code Dropbox shows instead of receiving it on localhost, for machines without a browser")
+	portPtr := flags.Int("port", 53682, "Port on localhost to receive the redirect from Dropbox on, registered with the app as http://localhost:PORT/callback")
+	flags.Parse(args)
+
+	if *appKeyPtr == "" {
+		log.Infoln("You must provide the key of your Dropbox app with -app-key")
+		flags.PrintDefaults()
+		os.Exit(1)
+	}
+
+	// Before authorizing, so a wrong passphrase doesn't waste the code
+	store, err := openStore()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	ctx := context.Background()
+	var token *oauth.Token
+	if *noRedirectPtr {
+		flow, err := oauth.NewFlow(*appKeyPtr, oauth.Endpoint, "")
+		if err != nil {
+			log.Fatalln("Unable to start authorization:", err)
+		}
+		fmt.Println("Open this page, allow dropboxfs access and paste the code it shows:")
+		fmt.Println(flow.URL())
+		fmt.Print("Code: ")
+		code, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil {
+			log.Fatalln("Unable to read code:", err)
+		}
+		if token, err = flow.Exchange(ctx, strings.TrimSpace(code)); err != nil {
+			log.Fatalln("Unable to authorize:", err)
+		}
+	} else {
+		l, err := net.Listen("tcp", fmt.Sprintf("localhost:%d", *portPtr))
+		if err != nil {
+			log.Fatalln("Unable to listen for the redirect from Dropbox:", err)
+		}
+		flow, err := oauth.NewFlow(*appKeyPtr, oauth.Endpoint, oauth.LocalRedirect(l))
+		if err != nil {
+			log.Fatalln("Unable to start authorization:", err)
+		}
+		fmt.Println("Open this page and allow dropboxfs access:")
+		fmt.Println(flow.URL())
+		if token, err = flow.Receive(ctx, l); err != nil {
+			log.Fatalln("Unable to authorize:", err)
+		}
+	}
+	if err := store.Put(*accountPtr, token); err != nil {
+		log.Fatalln("Unable to save token:", err)
+	}
+	fmt.Printf("Saved your token as account %v\ndropboxfs can use it later by providing the flag `-t %v`\n", *accountPtr, *accountPtr)
+}
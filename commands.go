@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	bazil "bazil.org/fuse"
+	"github.com/melinysh/dropboxfs/fuse"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// runUnmount unmounts a mount, such as one left behind by a crash.
+func runUnmount(args []string) {
+	flags := newMountFlags("unmount")
+	flags.Parse(args)
+	m, err := flags.mount(flags.Arg(0))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if err := bazil.Unmount(m.Mountpoint); err != nil {
+		log.Fatalln("Unable to unmount", m.Mountpoint, err)
+	}
+}
+
+// runStatus lists what a mount still has to upload, and the conflicted
+// copies it saved. Works whether or not it is mounted.
+func runStatus(args []string) {
+	flags := newMountFlags("status")
+	flags.Parse(args)
+	m, err := flags.mount(flags.Arg(0))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	cacheDir := m.cacheDir()
+	if err := printStatus(os.Stdout, cacheDir); err != nil {
+		log.Fatalln("Unable to read upload queue in", cacheDir, err)
+	}
+	fmt.Println()
+	if err := printConflicts(os.Stdout, cacheDir); err != nil {
+		log.Fatalln("Unable to read conflicts in", cacheDir, err)
+	}
+}
+
+// runCache reports how much of a mount's cache is in use, or empties it.
+func runCache(args []string) {
+	flags := newMountFlags("cache")
+	clearPtr := flags.Bool("clear", false, "Drop the cached file contents, the mount must not be mounted")
+	flags.Parse(args)
+	m, err := flags.mount(flags.Arg(0))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	cacheDir := m.cacheDir()
+	if *clearPtr {
+		// Held by the mount while it is mounted
+		store, err := fuse.OpenStore(cacheDir)
+		if err != nil {
+			log.Fatalln("Unable to open cache in", cacheDir, "is it still mounted?", err)
+		}
+		defer store.Close()
+		if err := fuse.ClearCache(cacheDir); err != nil {
+			log.Fatalln("Unable to clear cache in", cacheDir, err)
+		}
+		return
+	}
+	size, err := fuse.CacheUsage(cacheDir)
+	if err != nil {
+		log.Fatalln("Unable to read cache in", cacheDir, err)
+	}
+	pins, err := fuse.Pins(cacheDir)
+	if err != nil {
+		log.Fatalln("Unable to read pinned files in", cacheDir, err)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "Directory\t%s\n", cacheDir)
+	fmt.Fprintf(w, "Cached contents\t%.1f MiB\n", float64(size)/(1024*1024))
+	fmt.Fprintf(w, "Pinned files\t%d\n", len(pins))
+	w.Flush()
+}
+
+// runPin pins files on a mount, so their contents are always cached, or
+// lists the pinned ones.
+func runPin(args []string) {
+	flags := newMountFlags("pin")
+	removePtr := flags.Bool("rm", false, "Unpin the files instead")
+	flags.Parse(args)
+	var m *mountConfig
+	var err error
+	if flags.given.Mountpoint == "" && flags.NArg() > 0 {
+		// The files say which mount
+		c, err := loadConfig(flags.config, false)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if m = c.containing(flags.Arg(0)); m == nil {
+			log.Fatalf("%v is not on a mount in %v, give one with -m\n", flags.Arg(0), flags.config)
+		}
+		m.override(&flags.given, flags.FlagSet)
+	} else if m, err = flags.mount(""); err != nil {
+		log.Fatalln(err)
+	}
+	cacheDir := m.cacheDir()
+	if flags.NArg() == 0 {
+		pins, err := fuse.Pins(cacheDir)
+		if err != nil {
+			log.Fatalln("Unable to read pinned files in", cacheDir, err)
+		}
+		for _, p := range pins {
+			fmt.Println(p)
+		}
+		return
+	}
+	for _, p := range flags.Args() {
+		rel, inside := relativeTo(m.Mountpoint, p)
+		if !inside {
+			log.Fatalln(p, "is not on the mount at", m.Mountpoint)
+		}
+		if err := fuse.SetPinned(cacheDir, rel, !*removePtr); err != nil {
+			log.Fatalln("Unable to pin", p, err)
+		}
+	}
+}
+
+// printStatus lists the uploads queued in cacheDir, whether or not it is
+// mounted at the moment.
+func printStatus(out io.Writer, cacheDir string) error {
+	pending, err := fuse.PendingUploads(cacheDir)
+	if err != nil {
+		return err
+	}
+	if len(pending) == 0 {
+		fmt.Fprintln(out, "Nothing waiting to be uploaded")
+		return nil
+	}
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "PATH\tSIZE\tQUEUED\tATTEMPTS\tLAST ERROR")
+	for _, p := range pending {
+		fmt.Fprintf(w, "%s\t%d\t%s\t%d\t%s\n", p.Path, p.Size, p.Queued.Format(time.RFC3339), p.Attempts, p.LastError)
+	}
+	return w.Flush()
+}
+
+// printConflicts lists the conflicted copies saved by mounts of cacheDir.
+func printConflicts(out io.Writer, cacheDir string) error {
+	conflicts, err := fuse.Conflicts(cacheDir)
+	if err != nil {
+		return err
+	}
+	if len(conflicts) == 0 {
+		fmt.Fprintln(out, "No conflicted copies")
+		return nil
+	}
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "PATH\tCONFLICTED COPY\tTIME")
+	for _, c := range conflicts {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", c.Path, c.Copy, c.Time.Format(time.RFC3339))
+	}
+	return w.Flush()
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// mountConfig describes a mount, as a [[mount]] table in the config file.
+// Flags given on the command line override it.
+type mountConfig struct {
+	Name       string `toml:"name"`
+	Mountpoint string `toml:"mountpoint"`
+	Account    string `toml:"account"`
+	Root       string `toml:"root"`
+	CacheDir   string `toml:"cache_dir"`
+	CacheSize  int64  `toml:"cache_size"` // MiB
+	Sync       string `toml:"sync"`
+	ReadOnly   bool   `toml:"read_only"`
+	AllowOther bool   `toml:"allow_other"`
+	Umask      string `toml:"umask"` // octal
+	UID        *int   `toml:"uid"`
+	GID        *int   `toml:"gid"`
+	Background bool   `toml:"background"`
+	PidFile    string `toml:"pid_file"`
+	LogFile    string `toml:"log_file"`
+}
+
+// configFile is what the config file holds.
+type configFile struct {
+	Mounts []*mountConfig `toml:"mount"`
+}
+
+// defaultConfigPath is where the config file is read from unless -config
+// says otherwise, under the user config directory.
+func defaultConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "dropboxfs", "config.toml")
+}
+
+// loadConfig reads the config file at path. A missing file is an empty
+// config, unless it was asked for with -config.
+func loadConfig(path string, explicit bool) (*configFile, error) {
+	c := &configFile{}
+	if path == "" {
+		return c, nil
+	}
+	md, err := toml.DecodeFile(path, c)
+	if err != nil {
+		if os.IsNotExist(err) && !explicit {
+			return c, nil
+		}
+		return nil, fmt.Errorf("unable to read config file %v: %v", path, err)
+	}
+	if unknown := md.Undecoded(); len(unknown) > 0 {
+		return nil, fmt.Errorf("unknown setting %v in config file %v", unknown[0], path)
+	}
+	for i, m := range c.Mounts {
+		if m.Mountpoint == "" {
+			return nil, fmt.Errorf("mount %d in %v has no mountpoint", i+1, path)
+		}
+		m.Mountpoint = expandHome(m.Mountpoint)
+		m.CacheDir = expandHome(m.CacheDir)
+		m.PidFile = expandHome(m.PidFile)
+		m.LogFile = expandHome(m.LogFile)
+	}
+	return c, nil
+}
+
+func expandHome(p string) string {
+	if !strings.HasPrefix(p, "~/") {
+		return p
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return p
+	}
+	return filepath.Join(home, p[2:])
+}
+
+func samePath(a string, b string) bool {
+	a, errA := filepath.Abs(a)
+	b, errB := filepath.Abs(b)
+	return errA == nil && errB == nil && a == b
+}
+
+// find returns the mount named target, or mounted on it.
+func (c *configFile) find(target string) *mountConfig {
+	for _, m := range c.Mounts {
+		if m.Name == target && m.Name != "" {
+			return m
+		}
+	}
+	for _, m := range c.Mounts {
+		if samePath(m.Mountpoint, target) {
+			return m
+		}
+	}
+	return nil
+}
+
+// containing returns the mount that p is on, nil when it isn't on one.
+func (c *configFile) containing(p string) *mountConfig {
+	for _, m := range c.Mounts {
+		if _, inside := relativeTo(m.Mountpoint, p); inside {
+			return m
+		}
+	}
+	return nil
+}
+
+// relativeTo returns the path of p on the mount at mountpoint, as Dropbox
+// paths are given, reporting whether p is on it at all.
+func relativeTo(mountpoint string, p string) (string, bool) {
+	mountpoint, err := filepath.Abs(mountpoint)
+	if err != nil {
+		return "", false
+	}
+	if p, err = filepath.Abs(p); err != nil {
+		return "", false
+	}
+	rel, err := filepath.Rel(mountpoint, p)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", false
+	}
+	if rel == "." {
+		return "/", true
+	}
+	return "/" + filepath.ToSlash(rel), true
+}
+
+// mountFlags are the flags of the commands working on a mount, bound to a
+// mountConfig that overrides the one picked from the config file.
+type mountFlags struct {
+	*flag.FlagSet
+	config string
+	given  mountConfig
+}
+
+func newMountFlags(name string) *mountFlags {
+	f := &mountFlags{FlagSet: flag.NewFlagSet(name, flag.ExitOnError)}
+	f.StringVar(&f.config, "config", defaultConfigPath(), "Config file describing the mounts")
+	f.StringVar(&f.given.Mountpoint, "m", "", "Path to FUSE mountpoint, or the name of a mount in the config file")
+	f.StringVar(&f.given.Root, "root", "", "Dropbox folder to mount, such as /Team/Projects (default the whole account)")
+	f.StringVar(&f.given.CacheDir, "cache", "", "Directory to keep the metadata and file cache in (default per mountpoint and account under the user cache directory)")
+	// The account picks the cache too
+	f.StringVar(&f.given.Account, "t", defaultAccount, "Account in the token store to use, or path to a token file saved by older versions")
+	return f
+}
+
+// addSettings adds the flags only mounting needs.
+func (f *mountFlags) addSettings() {
+	f.Int64Var(&f.given.CacheSize, "cache-size", 1024, "Maximum size of cached file contents in MiB")
+	f.StringVar(&f.given.Sync, "sync", "fsync", "When to wait for changes to be uploaded: fsync, close (fsync and close) or async (never)")
+	f.given.UID = f.Int("uid", os.Getuid(), "User reported as the owner of every file and folder")
+	f.given.GID = f.Int("gid", os.Getgid(), "Group reported as the owner of every file and folder")
+	f.BoolVar(&f.given.ReadOnly, "ro", false, "Mount read-only, refusing every change and uploading nothing")
+	f.BoolVar(&f.given.AllowOther, "allow-other", false, "Let other users access the mount, subject to the modes reported (needs user_allow_other in /etc/fuse.conf unless root)")
+	f.StringVar(&f.given.Umask, "umask", "", "Octal bits to take from every mode, items without a saved mode get the rest (default only the owner has access)")
+	f.BoolVar(&f.given.Background, "background", false, "Return once mounted, serving it in the background")
+	f.StringVar(&f.given.PidFile, "pidfile", "", "File to write the pid of the mount to (default dropboxfs.pid in the cache directory)")
+	f.StringVar(&f.given.LogFile, "log", "", "File a background mount logs to (default dropboxfs.log in the cache directory)")
+}
+
+// mount works out the mount a command is about: the one in the config file
+// named or mounted on target, or -m when target is empty, or the only one
+// there is. Flags given override its settings, -m its mountpoint when target
+// isn't empty, and settings neither gives take their flag defaults.
+func (f *mountFlags) mount(target string) (*mountConfig, error) {
+	explicit := false
+	f.Visit(func(fl *flag.Flag) {
+		explicit = explicit || fl.Name == "config"
+	})
+	c, err := loadConfig(f.config, explicit)
+	if err != nil {
+		return nil, err
+	}
+	mountpoint := ""
+	if target == "" {
+		target = f.given.Mountpoint
+	} else {
+		// Mounting the one named on another mountpoint
+		mountpoint = f.given.Mountpoint
+	}
+	var m *mountConfig
+	switch {
+	case target != "":
+		if m = c.find(target); m == nil {
+			m = &mountConfig{Mountpoint: target}
+		}
+	case len(c.Mounts) == 1:
+		m = c.Mounts[0]
+	default:
+		return nil, fmt.Errorf("no mount given, use -m or name one from %v", f.config)
+	}
+	if mountpoint != "" {
+		m.Mountpoint = mountpoint
+	}
+	m.override(&f.given, f.FlagSet)
+	return m, nil
+}
+
+// override takes the settings of flags given on the command line from
+// given, and the defaults of flags for settings m has none of.
+func (m *mountConfig) override(given *mountConfig, flags *flag.FlagSet) {
+	set := map[string]bool{}
+	flags.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	pick := func(name string, empty bool) bool {
+		return set[name] || empty && flags.Lookup(name) != nil
+	}
+	if pick("root", false) {
+		m.Root = given.Root
+	}
+	if pick("cache", false) {
+		m.CacheDir = given.CacheDir
+	}
+	if pick("t", m.Account == "") {
+		m.Account = given.Account
+	}
+	if pick("cache-size", m.CacheSize == 0) {
+		m.CacheSize = given.CacheSize
+	}
+	if pick("sync", m.Sync == "") {
+		m.Sync = given.Sync
+	}
+	if pick("uid", m.UID == nil) {
+		m.UID = given.UID
+	}
+	if pick("gid", m.GID == nil) {
+		m.GID = given.GID
+	}
+	if pick("ro", false) {
+		m.ReadOnly = given.ReadOnly
+	}
+	if pick("allow-other", false) {
+		m.AllowOther = given.AllowOther
+	}
+	if pick("umask", false) {
+		m.Umask = given.Umask
+	}
+	if pick("background", false) {
+		m.Background = given.Background
+	}
+	if pick("pidfile", false) {
+		m.PidFile = given.PidFile
+	}
+	if pick("log", false) {
+		m.LogFile = given.LogFile
+	}
+}
+
+// cacheDir is the directory the mount keeps its cache in.
+func (m *mountConfig) cacheDir() string {
+	if m.CacheDir != "" {
+		return m.CacheDir
+	}
+	return defaultCacheDir(m.Mountpoint, m.Account, m.Root)
+}
+
+func (m *mountConfig) pidFile() string {
+	if m.PidFile != "" {
+		return m.PidFile
+	}
+	return filepath.Join(m.cacheDir(), "dropboxfs.pid")
+}
+
+func (m *mountConfig) logFile() string {
+	if m.LogFile != "" {
+		return m.LogFile
+	}
+	return filepath.Join(m.cacheDir(), "dropboxfs.log")
+}
+
+// defaultCacheDir keeps the cache of each mountpoint, account and folder
+// apart, so mounting another account or folder on the same mountpoint
+// doesn't pick up the wrong metadata or queued uploads. The default account
+// is left out of the name, as it was before accounts had names.
+func defaultCacheDir(mountpoint string, account string, root string) string {
+	base, err := os.UserCacheDir()
+	if err != nil {
+		base = os.TempDir()
+	}
+	if abs, err := filepath.Abs(mountpoint); err == nil {
+		mountpoint = abs
+	}
+	name := mountpoint
+	if account != "" && account != defaultAccount {
+		name += "@" + account
+	}
+	if root = strings.Trim(root, "/"); root != "" {
+		name += "#" + strings.ToLower(root)
+	}
+	return filepath.Join(base, "dropboxfs", url.PathEscape(name))
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestCacheDirPerAccount(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	dirs := map[string]string{}
+	for _, args := range [][]string{
+		{"-m", "/mnt/db"},
+		{"-m", "/mnt/db", "-t", "work"},
+		{"-m", "/mnt/db", "-t", "work", "-root", "/Team"},
+		{"-m", "/mnt/db", "-root", "/Team"},
+	} {
+		// As the commands other than mount find it
+		flags := newMountFlags("status")
+		if err := flags.Parse(append(args, "-config", "")); err != nil {
+			t.Fatal(err)
+		}
+		m, err := flags.mount("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		dir := m.cacheDir()
+		for other, otherDir := range dirs {
+			if otherDir == dir {
+				t.Error(args, "shares its cache with", other)
+			}
+		}
+		dirs[fmt.Sprint(args)] = dir
+	}
+	// Caches of the default account stay where they were
+	if defaultCacheDir("/mnt/db", defaultAccount, "") != defaultCacheDir("/mnt/db", "", "") {
+		t.Error("Default account cache moved")
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Set in the environment of a background mount, which reports to the
+// process that started it on file descriptor 3.
+const daemonEnv = "DROPBOXFS_DAEMON"
+
+// Sent by a background mount once it is ready.
+const readyMessage = "ready"
+
+// isDaemon reports whether this is a background mount.
+func isDaemon() bool {
+	return os.Getenv(daemonEnv) != ""
+}
+
+// background runs dropboxfs again with the same arguments, detached from
+// the terminal and logging to logFile, and exits once it is mounted. When
+// mounting fails, exits with its status after printing why.
+func background(logFile string) {
+	exe, err := os.Executable()
+	if err != nil {
+		log.Fatalln("Unable to find dropboxfs to run in the background:", err)
+	}
+	out, err := os.OpenFile(logFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		log.Fatalln("Unable to open log file", logFile, err)
+	}
+	defer out.Close()
+	r, w, err := os.Pipe()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	// Nobody left to ask for the passphrase, it is sent on stdin rather than
+	// in the environment, which other users can read in /proc
+	passphrase, send, err := os.Pipe()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(withoutEnv(os.Environ(), passphraseEnv), daemonEnv+"=1")
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = passphrase, out, out
+	cmd.ExtraFiles = []*os.File{w}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		log.Fatalln("Unable to start dropboxfs in the background:", err)
+	}
+	w.Close()
+	passphrase.Close()
+	send.Write(storePassphrase)
+	send.Close()
+	report, _ := ioutil.ReadAll(r)
+	if string(report) == readyMessage {
+		fmt.Printf("Mounted in the background, pid %d, logging to %v\n", cmd.Process.Pid, logFile)
+		os.Exit(0)
+	}
+	err = cmd.Wait()
+	if len(report) > 0 {
+		fmt.Fprintln(os.Stderr, string(report))
+	} else {
+		fmt.Fprintln(os.Stderr, "Unable to mount, see", logFile)
+	}
+	if exit, ok := err.(*exec.ExitError); ok && exit.ExitCode() > 0 {
+		os.Exit(exit.ExitCode())
+	}
+	os.Exit(1)
+}
+
+// withoutEnv returns env without the variable name.
+func withoutEnv(env []string, name string) []string {
+	kept := env[:0:0]
+	for _, v := range env {
+		if !strings.HasPrefix(v, name+"=") {
+			kept = append(kept, v)
+		}
+	}
+	return kept
+}
+
+// parentReport tells the process that started a background mount how
+// mounting went: the message of the first fatal error logged, or that it is
+// ready.
+type parentReport struct {
+	w *os.File // nil once reported
+}
+
+// reportToParent hooks up reporting to the process that started this
+// background mount. Returns nil in the foreground.
+func reportToParent() *parentReport {
+	if !isDaemon() {
+		return nil
+	}
+	r := &parentReport{w: os.NewFile(3, "report")}
+	log.AddHook(r)
+	return r
+}
+
+func (r *parentReport) Levels() []log.Level {
+	return []log.Level{log.PanicLevel, log.FatalLevel}
+}
+
+func (r *parentReport) Fire(e *log.Entry) error {
+	r.send(strings.TrimSpace(e.Message))
+	return nil
+}
+
+func (r *parentReport) send(message string) {
+	if r == nil || r.w == nil {
+		return
+	}
+	r.w.WriteString(message)
+	r.w.Close()
+	r.w = nil
+}
+
+// ready tells the parent the mount is up.
+func (r *parentReport) ready() {
+	r.send(readyMessage)
+}
+
+// writePidFile saves our pid to path, refusing when a process whose pid is
+// in it already is still running.
+func writePidFile(path string) error {
+	if data, err := ioutil.ReadFile(path); err == nil {
+		pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+		if err == nil && pid != os.Getpid() && syscall.Kill(pid, 0) == nil {
+			return fmt.Errorf("already mounted by pid %d, see %v", pid, path)
+		}
+	}
+	return ioutil.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0600)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestWithoutEnv(t *testing.T) {
+	env := []string{"HOME=/root", passphraseEnv + "=secret", passphraseEnv + "_OTHER=kept"}
+	got := withoutEnv(env, passphraseEnv)
+	if len(got) != 2 || got[0] != "HOME=/root" || got[1] != passphraseEnv+"_OTHER=kept" {
+		t.Fatal("Unexpected environment", got)
+	}
+	if env[1] != passphraseEnv+"=secret" {
+		t.Fatal("Changed the environment passed in", env)
+	}
+}
+
+func TestDaemonReadsPassphraseFromStdin(t *testing.T) {
+	t.Setenv(daemonEnv, "1")
+	t.Setenv(passphraseEnv, "")
+	os.Unsetenv(passphraseEnv)
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	stdin := os.Stdin
+	os.Stdin = r
+	defer func() { os.Stdin = stdin }()
+	w.WriteString("secret")
+	w.Close()
+	p, err := readPassphrase("tokens")
+	if err != nil || string(p) != "secret" {
+		t.Fatalf("Read %q, %v", p, err)
+	}
+}
+
+func TestPassphraseEnvNotPassedOn(t *testing.T) {
+	t.Setenv(passphraseEnv, "secret")
+	p, err := readPassphrase("tokens")
+	if err != nil || string(p) != "secret" {
+		t.Fatalf("Read %q, %v", p, err)
+	}
+	if _, found := os.LookupEnv(passphraseEnv); found {
+		t.Fatal("Passphrase left in the environment")
+	}
+}
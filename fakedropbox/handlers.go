@@ -0,0 +1,951 @@
+package fakedropbox
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox/file_properties"
+	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox/files"
+)
+
+var (
+	errNotFound = errors.New("not_found")
+	errConflict = errors.New("conflict")
+)
+
+// Page size used when a listing does not ask for one.
+const defaultLimit = 2000
+
+type cursor struct {
+	Path      string `json:"path"`
+	Recursive bool   `json:"recursive"`
+	Seq       uint64 `json:"seq"`
+	Offset    int    `json:"offset,omitempty"`
+	Epoch     uint64 `json:"epoch,omitempty"` // cursors from before ResetCursors are refused
+	// property templates whose groups entries carry
+	Templates []string `json:"templates,omitempty"`
+}
+
+// templateFilter is include_property_groups as sent. The SDK can't decode its
+// own TemplateFilterBase, so arguments carrying one read it as this instead.
+type templateFilter struct {
+	Tag        string   `json:".tag"`
+	FilterSome []string `json:"filter_some"`
+}
+
+// templateIDs returns the templates a filter asks property groups of.
+func templateIDs(filter *templateFilter) []string {
+	if filter == nil || filter.Tag != file_properties.TemplateFilterBaseFilterSome {
+		return nil
+	}
+	return filter.FilterSome
+}
+
+type listFolderArg struct {
+	files.ListFolderArg
+	IncludePropertyGroups *templateFilter `json:"include_property_groups,omitempty"`
+}
+
+// writeMode is a WriteMode as sent, which the SDK can't decode when it
+// carries a rev.
+type writeMode struct {
+	Tag    string `json:".tag"`
+	Update string `json:"update"`
+}
+
+type commitInfo struct {
+	files.CommitInfo
+	Mode *writeMode `json:"mode,omitempty"`
+}
+
+type uploadSessionFinishArg struct {
+	Cursor *files.UploadSessionCursor `json:"cursor"`
+	Commit *commitInfo                `json:"commit"`
+}
+
+type getMetadataArg struct {
+	files.GetMetadataArg
+	IncludePropertyGroups *templateFilter `json:"include_property_groups,omitempty"`
+}
+
+func encodeCursor(c cursor) string {
+	data, _ := json.Marshal(c)
+	return base64.URLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(s string) (cursor, error) {
+	var c cursor
+	data, err := base64.URLEncoding.DecodeString(s)
+	if err != nil {
+		return c, err
+	}
+	err = json.Unmarshal(data, &c)
+	return c, err
+}
+
+// apiError is an error response in the shape the SDK expects for a route.
+type apiError struct {
+	status     int
+	summary    string
+	body       interface{}
+	retryAfter int
+}
+
+func endpointError(summary string, body interface{}) *apiError {
+	return &apiError{status: http.StatusConflict, summary: summary, body: body}
+}
+
+func union(tag string, value interface{}) map[string]interface{} {
+	u := map[string]interface{}{".tag": tag}
+	if value != nil {
+		u[tag] = value
+	}
+	return u
+}
+
+func lookupNotFound(tag string) *apiError {
+	return endpointError(tag+"/not_found/", union(tag, union("not_found", nil)))
+}
+
+func writeConflict(tag string, kind string) *apiError {
+	return endpointError(tag+"/conflict/"+kind+"/", union(tag, union("conflict", union(kind, nil))))
+}
+
+func uploadConflict(kind string) *apiError {
+	return endpointError("path/conflict/"+kind+"/", map[string]interface{}{
+		".tag":              "path",
+		"reason":            union("conflict", union(kind, nil)),
+		"upload_session_id": "",
+	})
+}
+
+func tagged(m files.IsMetadata) interface{} {
+	switch v := m.(type) {
+	case *files.FileMetadata:
+		return struct {
+			Tag string `json:".tag"`
+			*files.FileMetadata
+		}{"file", v}
+	case *files.FolderMetadata:
+		return struct {
+			Tag string `json:".tag"`
+			*files.FolderMetadata
+		}{"folder", v}
+	case *files.DeletedMetadata:
+		return struct {
+			Tag string `json:".tag"`
+			*files.DeletedMetadata
+		}{"deleted", v}
+	}
+	return nil
+}
+
+func taggedAll(entries []files.IsMetadata) []interface{} {
+	out := []interface{}{}
+	for _, m := range entries {
+		out = append(out, tagged(m))
+	}
+	return out
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, "/oauth2/") {
+		s.serveOAuth(w, r)
+		return
+	}
+	route := strings.TrimPrefix(r.URL.Path, "/2/")
+
+	s.Lock()
+	s.calls[route]++
+	delay, found := s.latency[route]
+	if !found {
+		delay = s.latency[""]
+	}
+	injected := s.takeFault(route, false)
+	var unauthorized *apiError
+	if route != "files/list_folder/longpoll" {
+		unauthorized = s.checkToken(r.Header.Get("Authorization"))
+	}
+	s.Unlock()
+
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-s.closed:
+		}
+	}
+	if injected != nil {
+		writeError(w, injected)
+		return
+	}
+	if unauthorized != nil {
+		writeError(w, unauthorized)
+		return
+	}
+
+	var result interface{}
+	var err *apiError
+	switch route {
+	case "files/list_folder":
+		result, err = s.listFolder(r)
+	case "files/list_folder/continue":
+		result, err = s.listFolderContinue(r)
+	case "files/list_folder/get_latest_cursor":
+		result, err = s.getLatestCursor(r)
+	case "files/list_folder/longpoll":
+		result, err = s.longpoll(r)
+	case "files/get_metadata":
+		result, err = s.getMetadata(r)
+	case "files/upload":
+		result, err = s.upload(r)
+	case "files/download":
+		s.download(w, r)
+		return
+	case "files/move_v2":
+		result, err = s.moveV2(r)
+	case "files/delete_v2":
+		result, err = s.deleteV2(r)
+	case "files/create_folder_v2":
+		result, err = s.createFolderV2(r)
+	case "files/upload_session/start":
+		result, err = s.uploadSessionStart(r)
+	case "files/upload_session/append_v2":
+		result, err = s.uploadSessionAppend(r)
+	case "files/upload_session/finish":
+		result, err = s.uploadSessionFinish(r)
+	case "users/get_space_usage":
+		result, err = s.getSpaceUsage(r)
+	case "users/get_current_account":
+		result, err = s.getCurrentAccount(r)
+	case "file_properties/templates/list_for_user":
+		result, err = s.listTemplates(r)
+	case "file_properties/templates/get_for_user":
+		result, err = s.getTemplate(r)
+	case "file_properties/templates/add_for_user":
+		result, err = s.addTemplate(r)
+	case "file_properties/templates/update_for_user":
+		result, err = s.updateTemplate(r)
+	case "file_properties/properties/overwrite":
+		result, err = s.overwriteProperties(r)
+	case "file_properties/properties/add":
+		result, err = s.addProperties(r)
+	case "file_properties/properties/update":
+		result, err = s.updateProperties(r)
+	case "file_properties/properties/remove":
+		result, err = s.removeProperties(r)
+	default:
+		http.Error(w, "Unknown route "+route, http.StatusBadRequest)
+		return
+	}
+	if err == nil {
+		s.Lock()
+		err = s.takeFault(route, true)
+		s.Unlock()
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, result)
+}
+
+// lock assumed
+func (s *Server) takeFault(route string, after bool) *apiError {
+	for _, f := range s.faults[route] {
+		if f.remaining <= 0 || f.after != after {
+			continue
+		}
+		f.remaining--
+		return &apiError{
+			status:     f.status,
+			summary:    f.summary,
+			body:       union("other", nil),
+			retryAfter: f.retryAfter,
+		}
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, e *apiError) {
+	switch e.status {
+	case http.StatusBadRequest, http.StatusInternalServerError:
+		// The SDK takes these bodies verbatim as the error summary.
+		writeText(w, e.status, e.summary)
+		return
+	case http.StatusTooManyRequests:
+		// Plain text works for both RPC and content routes, the SDK then
+		// reads the delay from the header.
+		w.Header().Set("Retry-After", strconv.Itoa(e.retryAfter))
+		writeText(w, e.status, e.summary)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(e.status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error_summary": e.summary,
+		"error":         e.body,
+	})
+}
+
+func writeText(w http.ResponseWriter, status int, text string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	io.WriteString(w, text)
+}
+
+func decodeArg(r *http.Request, v interface{}) *apiError {
+	var data []byte
+	if arg := r.Header.Get("Dropbox-API-Arg"); arg != "" {
+		data = []byte(arg)
+	} else {
+		var err error
+		if data, err = ioutil.ReadAll(r.Body); err != nil {
+			return &apiError{status: http.StatusBadRequest, summary: err.Error()}
+		}
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return &apiError{status: http.StatusBadRequest, summary: "Error in call: " + err.Error()}
+	}
+	return nil
+}
+
+func normalize(p string) string {
+	if p == "/" {
+		return ""
+	}
+	return p
+}
+
+func (s *Server) listFolder(r *http.Request) (interface{}, *apiError) {
+	var arg listFolderArg
+	if err := decodeArg(r, &arg); err != nil {
+		return nil, err
+	}
+	p := normalize(arg.Path)
+	s.Lock()
+	defer s.Unlock()
+	if p != "" {
+		if n, found := s.nodes[strings.ToLower(p)]; !found || n.folder == nil {
+			return nil, lookupNotFound("path")
+		}
+	}
+	c := cursor{Path: strings.ToLower(p), Recursive: arg.Recursive, Seq: s.seq, Epoch: s.epoch, Templates: templateIDs(arg.IncludePropertyGroups)}
+	return s.page(c, limitOf(arg.Limit)), nil
+}
+
+func limitOf(limit uint32) int {
+	if limit == 0 {
+		return defaultLimit
+	}
+	return int(limit)
+}
+
+// lock assumed
+func (s *Server) page(c cursor, limit int) interface{} {
+	children := s.children(c.Path, c.Recursive)
+	end := c.Offset + limit
+	hasMore := end < len(children)
+	if !hasMore {
+		end = len(children)
+	}
+	entries := []files.IsMetadata{}
+	for _, n := range children[c.Offset:end] {
+		entries = append(entries, s.withProperties(n.metadata(), c.Templates))
+	}
+	next := c
+	next.Offset = 0
+	if hasMore {
+		next.Offset = end
+	}
+	return map[string]interface{}{
+		"entries":  taggedAll(entries),
+		"cursor":   encodeCursor(next),
+		"has_more": hasMore,
+	}
+}
+
+// lock assumed
+func (s *Server) changesSince(c cursor, limit int) ([]files.IsMetadata, uint64, bool) {
+	entries := []files.IsMetadata{}
+	seq := c.Seq
+	for _, ch := range s.changes {
+		if ch.seq <= c.Seq || !isUnder(ch.lower, c.Path, c.Recursive) {
+			continue
+		}
+		if len(entries) == limit {
+			return entries, seq, true
+		}
+		entries = append(entries, s.withProperties(ch.metadata, c.Templates))
+		seq = ch.seq
+	}
+	return entries, s.seq, false
+}
+
+// current reports whether c was handed out since the last ResetCursors.
+func (s *Server) current(c cursor) bool {
+	s.Lock()
+	defer s.Unlock()
+	return c.Epoch == s.epoch
+}
+
+func (s *Server) listFolderContinue(r *http.Request) (interface{}, *apiError) {
+	var arg files.ListFolderContinueArg
+	if err := decodeArg(r, &arg); err != nil {
+		return nil, err
+	}
+	c, err := decodeCursor(arg.Cursor)
+	if err != nil || !s.current(c) {
+		return nil, endpointError("reset/", union("reset", nil))
+	}
+	s.Lock()
+	defer s.Unlock()
+	if c.Offset > 0 {
+		return s.page(c, defaultLimit), nil
+	}
+	entries, seq, hasMore := s.changesSince(c, defaultLimit)
+	c.Seq = seq
+	return map[string]interface{}{
+		"entries":  taggedAll(entries),
+		"cursor":   encodeCursor(c),
+		"has_more": hasMore,
+	}, nil
+}
+
+func (s *Server) getLatestCursor(r *http.Request) (interface{}, *apiError) {
+	var arg listFolderArg
+	if err := decodeArg(r, &arg); err != nil {
+		return nil, err
+	}
+	s.Lock()
+	defer s.Unlock()
+	c := cursor{Path: strings.ToLower(normalize(arg.Path)), Recursive: arg.Recursive, Seq: s.seq, Epoch: s.epoch, Templates: templateIDs(arg.IncludePropertyGroups)}
+	return map[string]interface{}{"cursor": encodeCursor(c)}, nil
+}
+
+func (s *Server) longpoll(r *http.Request) (interface{}, *apiError) {
+	var arg files.ListFolderLongpollArg
+	if err := decodeArg(r, &arg); err != nil {
+		return nil, err
+	}
+	c, err := decodeCursor(arg.Cursor)
+	if err != nil || !s.current(c) {
+		return nil, endpointError("reset/", union("reset", nil))
+	}
+	timeout := time.After(time.Duration(arg.Timeout) * time.Second)
+	for {
+		s.Lock()
+		entries, _, _ := s.changesSince(c, 1)
+		changed := s.changed
+		s.Unlock()
+		if len(entries) > 0 {
+			return map[string]interface{}{"changes": true}, nil
+		}
+		select {
+		case <-changed:
+		case <-timeout:
+			return map[string]interface{}{"changes": false}, nil
+		case <-s.closed:
+			return map[string]interface{}{"changes": false}, nil
+		case <-r.Context().Done():
+			return map[string]interface{}{"changes": false}, nil
+		}
+	}
+}
+
+func (s *Server) getMetadata(r *http.Request) (interface{}, *apiError) {
+	var arg getMetadataArg
+	if err := decodeArg(r, &arg); err != nil {
+		return nil, err
+	}
+	s.Lock()
+	defer s.Unlock()
+	n, found := s.nodes[strings.ToLower(arg.Path)]
+	if !found {
+		return nil, lookupNotFound("path")
+	}
+	return tagged(s.withProperties(n.metadata(), templateIDs(arg.IncludePropertyGroups))), nil
+}
+
+func (s *Server) upload(r *http.Request) (interface{}, *apiError) {
+	var arg commitInfo
+	if err := decodeArg(r, &arg); err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, &apiError{status: http.StatusBadRequest, summary: err.Error()}
+	}
+	s.Lock()
+	defer s.Unlock()
+	return s.commit(&arg, data)
+}
+
+// lock assumed
+func (s *Server) commit(arg *commitInfo, data []byte) (interface{}, *apiError) {
+	if existing, found := s.nodes[strings.ToLower(arg.Path)]; found {
+		if existing.folder != nil {
+			return nil, uploadConflict("folder")
+		}
+		conflict := false
+		if arg.Mode != nil {
+			switch arg.Mode.Tag {
+			case files.WriteModeAdd:
+				conflict = true
+			case files.WriteModeUpdate:
+				conflict = arg.Mode.Update != existing.file.Rev
+			}
+		}
+		if conflict && !arg.Autorename {
+			return nil, uploadConflict("file")
+		}
+		if conflict {
+			arg.Path = s.freePath(arg.Path)
+		}
+	}
+	m, ok := s.putFile(arg.Path, data, arg.ClientModified)
+	if !ok {
+		return nil, uploadConflict("file")
+	}
+	return m, nil
+}
+
+// freePath numbers p like Dropbox's autorename does until nothing is there.
+// lock assumed
+func (s *Server) freePath(p string) string {
+	ext := path.Ext(p)
+	for i := 1; ; i++ {
+		candidate := fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(p, ext), i, ext)
+		if _, found := s.nodes[strings.ToLower(candidate)]; !found {
+			return candidate
+		}
+	}
+}
+
+func (s *Server) uploadSessionStart(r *http.Request) (interface{}, *apiError) {
+	var arg files.UploadSessionStartArg
+	if err := decodeArg(r, &arg); err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, &apiError{status: http.StatusBadRequest, summary: err.Error()}
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.nextID++
+	id := fmt.Sprintf("session:fake%06d", s.nextID)
+	s.sessions[id] = data
+	return map[string]interface{}{"session_id": id}, nil
+}
+
+// lock assumed
+func (s *Server) appendSession(c *files.UploadSessionCursor, r *http.Request) (map[string]interface{}, string) {
+	data, found := s.sessions[c.SessionId]
+	if !found {
+		return union("not_found", nil), "not_found/"
+	}
+	if c.Offset != uint64(len(data)) {
+		return map[string]interface{}{".tag": "incorrect_offset", "correct_offset": len(data)}, "incorrect_offset/"
+	}
+	more, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return union("other", nil), "other/"
+	}
+	s.sessions[c.SessionId] = append(data, more...)
+	return nil, ""
+}
+
+func (s *Server) uploadSessionAppend(r *http.Request) (interface{}, *apiError) {
+	var arg files.UploadSessionAppendArg
+	if err := decodeArg(r, &arg); err != nil {
+		return nil, err
+	}
+	s.Lock()
+	defer s.Unlock()
+	if lookup, summary := s.appendSession(arg.Cursor, r); lookup != nil {
+		return nil, endpointError(summary, lookup)
+	}
+	return nil, nil
+}
+
+func (s *Server) uploadSessionFinish(r *http.Request) (interface{}, *apiError) {
+	var arg uploadSessionFinishArg
+	if err := decodeArg(r, &arg); err != nil {
+		return nil, err
+	}
+	s.Lock()
+	defer s.Unlock()
+	if lookup, summary := s.appendSession(arg.Cursor, r); lookup != nil {
+		return nil, endpointError("lookup_failed/"+summary, union("lookup_failed", lookup))
+	}
+	data := s.sessions[arg.Cursor.SessionId]
+	delete(s.sessions, arg.Cursor.SessionId)
+	return s.commit(arg.Commit, data)
+}
+
+func (s *Server) download(w http.ResponseWriter, r *http.Request) {
+	var arg files.DownloadArg
+	if err := decodeArg(r, &arg); err != nil {
+		writeError(w, err)
+		return
+	}
+	s.Lock()
+	n, found := s.nodes[strings.ToLower(arg.Path)]
+	corrupt := found && s.corrupt > 0 && len(n.content) > 0
+	if corrupt {
+		s.corrupt--
+	}
+	s.Unlock()
+	if !found || n.file == nil {
+		writeError(w, lookupNotFound("path"))
+		return
+	}
+	content := n.content
+	if corrupt {
+		content = append([]byte{content[0] ^ 0xff}, content[1:]...)
+	}
+	result, _ := json.Marshal(n.file)
+	w.Header().Set("Dropbox-API-Result", string(result))
+	w.Header().Set("Content-Type", "application/octet-stream")
+	// Answers Range requests with 206 like Dropbox does
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	if sent, err := strconv.ParseInt(w.Header().Get("Content-Length"), 10, 64); err == nil {
+		s.Lock()
+		s.downloaded += sent
+		s.Unlock()
+	}
+}
+
+func (s *Server) moveV2(r *http.Request) (interface{}, *apiError) {
+	var arg files.RelocationArg
+	if err := decodeArg(r, &arg); err != nil {
+		return nil, err
+	}
+	s.Lock()
+	defer s.Unlock()
+	m, err := s.move(arg.FromPath, arg.ToPath)
+	switch err {
+	case errNotFound:
+		return nil, lookupNotFound("from_lookup")
+	case errConflict:
+		return nil, writeConflict("to", "file")
+	}
+	return map[string]interface{}{"metadata": tagged(m)}, nil
+}
+
+func (s *Server) deleteV2(r *http.Request) (interface{}, *apiError) {
+	var arg files.DeleteArg
+	if err := decodeArg(r, &arg); err != nil {
+		return nil, err
+	}
+	s.Lock()
+	defer s.Unlock()
+	m, found := s.remove(arg.Path)
+	if !found {
+		return nil, lookupNotFound("path_lookup")
+	}
+	return map[string]interface{}{"metadata": tagged(m)}, nil
+}
+
+func (s *Server) createFolderV2(r *http.Request) (interface{}, *apiError) {
+	var arg files.CreateFolderArg
+	if err := decodeArg(r, &arg); err != nil {
+		return nil, err
+	}
+	s.Lock()
+	defer s.Unlock()
+	if _, found := s.nodes[strings.ToLower(arg.Path)]; found {
+		return nil, writeConflict("path", "folder")
+	}
+	return map[string]interface{}{"metadata": tagged(s.mkdirAll(arg.Path))}, nil
+}
+
+func templateNotFound(id string) *apiError {
+	return endpointError("template_not_found/", map[string]interface{}{".tag": "template_not_found", "template_not_found": id})
+}
+
+func (s *Server) listTemplates(r *http.Request) (interface{}, *apiError) {
+	s.Lock()
+	defer s.Unlock()
+	ids := []string{}
+	for id := range s.templates {
+		ids = append(ids, id)
+	}
+	return map[string]interface{}{"template_ids": ids}, nil
+}
+
+func (s *Server) getTemplate(r *http.Request) (interface{}, *apiError) {
+	var arg file_properties.GetTemplateArg
+	if err := decodeArg(r, &arg); err != nil {
+		return nil, err
+	}
+	s.Lock()
+	defer s.Unlock()
+	t, found := s.templates[arg.TemplateId]
+	if !found {
+		return nil, templateNotFound(arg.TemplateId)
+	}
+	return t, nil
+}
+
+func (s *Server) addTemplate(r *http.Request) (interface{}, *apiError) {
+	var arg file_properties.AddTemplateArg
+	if err := decodeArg(r, &arg); err != nil {
+		return nil, err
+	}
+	if len(arg.Fields) > maxTemplateFields {
+		return nil, tooManyProperties()
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.nextID++
+	id := fmt.Sprintf("ptid:fake%06d", s.nextID)
+	s.templates[id] = &arg.PropertyGroupTemplate
+	return map[string]interface{}{"template_id": id}, nil
+}
+
+func tooManyProperties() *apiError {
+	return endpointError("too_many_properties/", union("too_many_properties", nil))
+}
+
+func (s *Server) updateTemplate(r *http.Request) (interface{}, *apiError) {
+	var arg file_properties.UpdateTemplateArg
+	if err := decodeArg(r, &arg); err != nil {
+		return nil, err
+	}
+	s.Lock()
+	defer s.Unlock()
+	t, found := s.templates[arg.TemplateId]
+	if !found {
+		return nil, templateNotFound(arg.TemplateId)
+	}
+	if len(t.Fields)+len(arg.AddFields) > maxTemplateFields {
+		return nil, tooManyProperties()
+	}
+	for _, f := range arg.AddFields {
+		for _, old := range t.Fields {
+			if old.Name == f.Name {
+				return nil, endpointError("conflicting_property_names/", union("conflicting_property_names", nil))
+			}
+		}
+	}
+	t.Fields = append(t.Fields, arg.AddFields...)
+	return map[string]interface{}{"template_id": arg.TemplateId}, nil
+}
+
+// lock assumed
+func (s *Server) checkFields(g *file_properties.PropertyGroup) *apiError {
+	t, found := s.templates[g.TemplateId]
+	if !found {
+		return templateNotFound(g.TemplateId)
+	}
+	for _, f := range g.Fields {
+		known := false
+		for _, ft := range t.Fields {
+			known = known || ft.Name == f.Name
+		}
+		if !known {
+			return endpointError("does_not_fit_template/", union("does_not_fit_template", nil))
+		}
+		if len(f.Value) > maxPropertyValue {
+			return endpointError("property_field_too_large/", union("property_field_too_large", nil))
+		}
+	}
+	return nil
+}
+
+// lock assumed
+func (s *Server) itemID(p string) (string, *apiError) {
+	n, found := s.nodes[strings.ToLower(p)]
+	if !found {
+		return "", endpointError("path/not_found/", union("path", union("not_found", nil)))
+	}
+	return idOf(n.metadata()), nil
+}
+
+// lock assumed
+func (s *Server) propertyGroup(id string, templateID string) *file_properties.PropertyGroup {
+	for _, g := range s.properties[id] {
+		if g.TemplateId == templateID {
+			return g
+		}
+	}
+	return nil
+}
+
+func propertyGroupNotFound() *apiError {
+	return endpointError("property_group_lookup/property_group_not_found/", union("property_group_lookup", union("property_group_not_found", nil)))
+}
+
+func (s *Server) addProperties(r *http.Request) (interface{}, *apiError) {
+	var arg file_properties.AddPropertiesArg
+	if err := decodeArg(r, &arg); err != nil {
+		return nil, err
+	}
+	s.Lock()
+	defer s.Unlock()
+	id, err := s.itemID(arg.Path)
+	if err != nil {
+		return nil, err
+	}
+	for _, g := range arg.PropertyGroups {
+		if err := s.checkFields(g); err != nil {
+			return nil, err
+		}
+		if s.propertyGroup(id, g.TemplateId) != nil {
+			return nil, endpointError("property_group_already_exists/", union("property_group_already_exists", nil))
+		}
+	}
+	s.properties[id] = append(s.properties[id], arg.PropertyGroups...)
+	return nil, nil
+}
+
+func (s *Server) updateProperties(r *http.Request) (interface{}, *apiError) {
+	var arg file_properties.UpdatePropertiesArg
+	if err := decodeArg(r, &arg); err != nil {
+		return nil, err
+	}
+	s.Lock()
+	defer s.Unlock()
+	id, err := s.itemID(arg.Path)
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range arg.UpdatePropertyGroups {
+		g := s.propertyGroup(id, u.TemplateId)
+		if g == nil {
+			return nil, propertyGroupNotFound()
+		}
+		if err := s.checkFields(file_properties.NewPropertyGroup(u.TemplateId, u.AddOrUpdateFields)); err != nil {
+			return nil, err
+		}
+		changed := map[string]bool{}
+		for _, name := range u.RemoveFields {
+			changed[name] = true
+		}
+		for _, f := range u.AddOrUpdateFields {
+			changed[f.Name] = true
+		}
+		kept := []*file_properties.PropertyField{}
+		for _, f := range g.Fields {
+			if !changed[f.Name] {
+				kept = append(kept, f)
+			}
+		}
+		g.Fields = append(kept, u.AddOrUpdateFields...)
+	}
+	return nil, nil
+}
+
+func (s *Server) removeProperties(r *http.Request) (interface{}, *apiError) {
+	var arg file_properties.RemovePropertiesArg
+	if err := decodeArg(r, &arg); err != nil {
+		return nil, err
+	}
+	s.Lock()
+	defer s.Unlock()
+	id, err := s.itemID(arg.Path)
+	if err != nil {
+		return nil, err
+	}
+	for _, templateID := range arg.PropertyTemplateIds {
+		if s.propertyGroup(id, templateID) == nil {
+			return nil, propertyGroupNotFound()
+		}
+		kept := []*file_properties.PropertyGroup{}
+		for _, g := range s.properties[id] {
+			if g.TemplateId != templateID {
+				kept = append(kept, g)
+			}
+		}
+		s.properties[id] = kept
+	}
+	return nil, nil
+}
+
+func (s *Server) overwriteProperties(r *http.Request) (interface{}, *apiError) {
+	var arg file_properties.OverwritePropertyGroupArg
+	if err := decodeArg(r, &arg); err != nil {
+		return nil, err
+	}
+	s.Lock()
+	defer s.Unlock()
+	id, err := s.itemID(arg.Path)
+	if err != nil {
+		return nil, err
+	}
+	for _, g := range arg.PropertyGroups {
+		if err := s.checkFields(g); err != nil {
+			return nil, err
+		}
+		kept := []*file_properties.PropertyGroup{}
+		for _, old := range s.properties[id] {
+			if old.TemplateId != g.TemplateId {
+				kept = append(kept, old)
+			}
+		}
+		s.properties[id] = append(kept, g)
+	}
+	return nil, nil
+}
+
+func (s *Server) getCurrentAccount(r *http.Request) (interface{}, *apiError) {
+	return map[string]interface{}{
+		"account_id": s.account,
+		"name": map[string]interface{}{
+			"given_name": "Fake", "surname": "User", "familiar_name": "Fake",
+			"display_name": "Fake User", "abbreviated_name": "FU",
+		},
+		"email":          "fake@example.com",
+		"email_verified": true,
+		"disabled":       false,
+		"locale":         "en",
+		"referral_link":  "https://db.tt/fake",
+		"is_paired":      false,
+		"account_type":   union("basic", nil),
+		"root_info": map[string]interface{}{
+			".tag":              "user",
+			"root_namespace_id": "1",
+			"home_namespace_id": "1",
+		},
+	}, nil
+}
+
+func (s *Server) getSpaceUsage(r *http.Request) (interface{}, *apiError) {
+	s.Lock()
+	defer s.Unlock()
+	var used uint64
+	for _, n := range s.nodes {
+		used += uint64(len(n.content))
+	}
+	allocation := map[string]interface{}{".tag": "individual", "allocated": s.allocated}
+	if s.team {
+		limitType := "off"
+		if s.memberLimit > 0 {
+			limitType = "stop_sync"
+		}
+		allocation = map[string]interface{}{
+			".tag":                              "team",
+			"used":                              used + s.othersUsed,
+			"allocated":                         s.allocated,
+			"user_within_team_space_allocated":  s.memberLimit,
+			"user_within_team_space_limit_type": union(limitType, nil),
+		}
+	}
+	return map[string]interface{}{"used": used, "allocation": allocation}, nil
+}
@@ -0,0 +1,174 @@
+package fakedropbox
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// How long access tokens handed out by the token endpoint last, unless
+// changed with SetTokenLifetime. Dropbox gives four hours.
+const defaultTokenLifetime = 4 * time.Hour
+
+// authCode is a code handed out by the authorize endpoint, waiting to be
+// exchanged for tokens.
+type authCode struct {
+	appKey      string
+	challenge   string
+	redirectURI string
+}
+
+// OAuthEndpoint returns the endpoint of the fake's OAuth2 authorization
+// code flow. Every app key is accepted and authorizing needs no consent:
+// the authorize page redirects straight back with a code, or shows just the
+// code as text when there is no redirect_uri.
+func (s *Server) OAuthEndpoint() oauth2.Endpoint {
+	return oauth2.Endpoint{
+		AuthURL:   s.URL + "/oauth2/authorize",
+		TokenURL:  s.URL + "/oauth2/token",
+		AuthStyle: oauth2.AuthStyleInParams,
+	}
+}
+
+// SetTokenLifetime changes how long access tokens handed out from now on
+// last. Requests with an expired one fail with expired_access_token.
+func (s *Server) SetTokenLifetime(d time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+	s.tokenLifetime = d
+}
+
+// checkToken reports what is wrong with the Authorization header of a
+// request, nil if it carries the static token or an unexpired issued one.
+// lock assumed
+func (s *Server) checkToken(header string) *apiError {
+	token := strings.TrimPrefix(header, "Bearer ")
+	if token == s.token && token != "" {
+		return nil
+	}
+	if expiry, found := s.accessTokens[token]; found {
+		if time.Now().Before(expiry) {
+			return nil
+		}
+		return &apiError{
+			status:  http.StatusUnauthorized,
+			summary: "expired_access_token/",
+			body:    union("expired_access_token", nil),
+		}
+	}
+	return &apiError{
+		status:  http.StatusUnauthorized,
+		summary: "invalid_access_token/",
+		body:    union("invalid_access_token", nil),
+	}
+}
+
+func (s *Server) serveOAuth(w http.ResponseWriter, r *http.Request) {
+	route := strings.TrimPrefix(r.URL.Path, "/")
+	s.Lock()
+	s.calls[route]++
+	s.Unlock()
+	switch route {
+	case "oauth2/authorize":
+		s.authorize(w, r)
+	case "oauth2/token":
+		s.issueToken(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("response_type") != "code" || q.Get("client_id") == "" {
+		http.Error(w, "Bad authorize request", http.StatusBadRequest)
+		return
+	}
+	if q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		http.Error(w, "Only PKCE with S256 is supported", http.StatusBadRequest)
+		return
+	}
+	s.Lock()
+	s.nextID++
+	code := fmt.Sprintf("code%06d", s.nextID)
+	s.codes[code] = &authCode{appKey: q.Get("client_id"), challenge: q.Get("code_challenge"), redirectURI: q.Get("redirect_uri")}
+	s.Unlock()
+	if redirect := q.Get("redirect_uri"); redirect != "" {
+		target, err := url.Parse(redirect)
+		if err != nil {
+			http.Error(w, "Bad redirect_uri", http.StatusBadRequest)
+			return
+		}
+		params := target.Query()
+		params.Set("code", code)
+		params.Set("state", q.Get("state"))
+		target.RawQuery = params.Encode()
+		http.Redirect(w, r, target.String(), http.StatusFound)
+		return
+	}
+	writeText(w, http.StatusOK, code)
+}
+
+func oauthError(w http.ResponseWriter, code string, description string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]string{"error": code, "error_description": description})
+}
+
+func (s *Server) issueToken(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		oauthError(w, "invalid_request", err.Error())
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	result := map[string]interface{}{"token_type": "bearer"}
+	switch r.PostForm.Get("grant_type") {
+	case "authorization_code":
+		code, found := s.codes[r.PostForm.Get("code")]
+		if !found {
+			oauthError(w, "invalid_grant", "code doesn't exist or has expired")
+			return
+		}
+		delete(s.codes, r.PostForm.Get("code"))
+		verifier := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		switch {
+		case code.appKey != r.PostForm.Get("client_id"):
+			oauthError(w, "invalid_grant", "code was issued to another app")
+			return
+		case code.challenge != base64.RawURLEncoding.EncodeToString(verifier[:]):
+			oauthError(w, "invalid_grant", "invalid code verifier")
+			return
+		case code.redirectURI != r.PostForm.Get("redirect_uri"):
+			oauthError(w, "invalid_grant", "redirect_uri mismatch")
+			return
+		}
+		s.nextID++
+		refresh := fmt.Sprintf("refresh%06d", s.nextID)
+		s.refreshTokens[refresh] = code.appKey
+		result["refresh_token"] = refresh
+	case "refresh_token":
+		appKey, found := s.refreshTokens[r.PostForm.Get("refresh_token")]
+		if !found || appKey != r.PostForm.Get("client_id") {
+			oauthError(w, "invalid_grant", "refresh token is malformed or revoked")
+			return
+		}
+	default:
+		oauthError(w, "unsupported_grant_type", r.PostForm.Get("grant_type"))
+		return
+	}
+	s.nextID++
+	access := fmt.Sprintf("access%06d", s.nextID)
+	s.accessTokens[access] = time.Now().Add(s.tokenLifetime)
+	result["access_token"] = access
+	result["expires_in"] = int(s.tokenLifetime / time.Second)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,578 @@
+// Package fakedropbox is an in-memory stand-in for the parts of the Dropbox
+// API v2 that dropboxfs uses. It serves over local HTTP so the real SDK client
+// can be pointed at it through Config, and it can inject errors, rate limits
+// and latency on any route.
+package fakedropbox
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox"
+	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox/file_properties"
+	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox/files"
+)
+
+// Token is the access token the server accepts unless changed with SetToken.
+const Token = "fake-dropbox-token"
+
+// Space an account gets unless changed with SetQuota or SetTeamQuota.
+const defaultAllocation = 2 * 1024 * 1024 * 1024
+
+// Limits Dropbox puts on property templates: fields per template, and the
+// length of a value.
+const (
+	maxTemplateFields = 32
+	maxPropertyValue  = 1024
+)
+
+// Dropbox hashes content in blocks of this size for content_hash.
+const hashBlockSize = 4 * 1024 * 1024
+
+// Servers started so far, so each serves an account of its own.
+var servers uint64
+
+type node struct {
+	file    *files.FileMetadata
+	folder  *files.FolderMetadata
+	content []byte
+}
+
+func (n *node) metadata() files.IsMetadata {
+	if n.file != nil {
+		return n.file
+	}
+	return n.folder
+}
+
+type change struct {
+	seq      uint64
+	lower    string
+	metadata files.IsMetadata
+}
+
+type fault struct {
+	after      bool // the call goes through, only its answer is lost
+	remaining  int
+	status     int
+	summary    string
+	retryAfter int
+}
+
+// Server is a fake Dropbox account served over HTTP.
+type Server struct {
+	URL string
+
+	http    *httptest.Server
+	account string           // ID of the account served
+	token   string           // static token, accepted alongside those issued
+	nodes   map[string]*node // keyed by lowercase path
+	changes []change
+	// upload sessions by ID, holding the content received so far
+	sessions map[string][]byte
+	// property templates by ID, and the property groups of items by their ID
+	templates  map[string]*file_properties.PropertyGroupTemplate
+	properties map[string][]*file_properties.PropertyGroup
+	// space the account may use; for a team, what the other members use
+	// and the limit on this one, 0 for none
+	allocated   uint64
+	team        bool
+	othersUsed  uint64
+	memberLimit uint64
+	seq         uint64
+	epoch       uint64
+	nextID      uint64
+	changed     chan struct{}
+	closed      chan struct{}
+
+	// OAuth2 codes waiting to be exchanged, refresh tokens by app key and
+	// the expiry of the access tokens issued
+	codes         map[string]*authCode
+	refreshTokens map[string]string
+	accessTokens  map[string]time.Time
+	tokenLifetime time.Duration
+
+	faults  map[string][]*fault
+	corrupt int // downloads left to corrupt
+	latency map[string]time.Duration
+	calls   map[string]int
+	// bytes of file content sent by downloads
+	downloaded int64
+	sync.Mutex
+}
+
+// New starts a fake Dropbox server with an empty account.
+func New() *Server {
+	s := &Server{
+		account:    fmt.Sprintf("dbid:fake%d", atomic.AddUint64(&servers, 1)),
+		token:      Token,
+		nodes:      map[string]*node{},
+		sessions:   map[string][]byte{},
+		templates:  map[string]*file_properties.PropertyGroupTemplate{},
+		properties: map[string][]*file_properties.PropertyGroup{},
+		allocated:  defaultAllocation,
+		changed:    make(chan struct{}),
+		closed:     make(chan struct{}),
+		faults:     map[string][]*fault{},
+		latency:    map[string]time.Duration{},
+		calls:      map[string]int{},
+
+		codes:         map[string]*authCode{},
+		refreshTokens: map[string]string{},
+		accessTokens:  map[string]time.Time{},
+		tokenLifetime: defaultTokenLifetime,
+	}
+	s.http = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	s.URL = s.http.URL
+	return s
+}
+
+// Close shuts the server down and releases any blocked longpolls.
+func (s *Server) Close() {
+	close(s.closed)
+	s.http.CloseClientConnections()
+	s.http.Close()
+}
+
+// Config returns an SDK configuration that sends every route to this server.
+func (s *Server) Config() dropbox.Config {
+	s.Lock()
+	token := s.token
+	s.Unlock()
+	return dropbox.Config{
+		Token: token,
+		URLGenerator: func(hostType string, style string, namespace string, route string) string {
+			return fmt.Sprintf("%s/2/%s/%s", s.URL, namespace, route)
+		},
+	}
+}
+
+// SetToken changes the access token the server accepts. Requests with any
+// other token fail with invalid_access_token.
+func (s *Server) SetToken(token string) {
+	s.Lock()
+	defer s.Unlock()
+	s.token = token
+}
+
+// FailNext makes the next n calls to route (e.g. "files/upload") fail with
+// the given HTTP status and error summary, such as "path/insufficient_space/".
+func (s *Server) FailNext(route string, n int, status int, summary string) {
+	s.Lock()
+	defer s.Unlock()
+	s.faults[route] = append(s.faults[route], &fault{remaining: n, status: status, summary: summary})
+}
+
+// LoseNextResponse makes the next n calls to route take effect but answer
+// with a 500, like a connection that drops before the response arrives.
+func (s *Server) LoseNextResponse(route string, n int) {
+	s.Lock()
+	defer s.Unlock()
+	s.faults[route] = append(s.faults[route], &fault{
+		after:     true,
+		remaining: n,
+		status:    http.StatusInternalServerError,
+		summary:   "connection lost",
+	})
+}
+
+// RateLimitNext makes the next n calls to route answer 429 asking the client
+// to retry after the given number of seconds.
+func (s *Server) RateLimitNext(route string, n int, retryAfter int) {
+	s.Lock()
+	defer s.Unlock()
+	s.faults[route] = append(s.faults[route], &fault{
+		remaining:  n,
+		status:     http.StatusTooManyRequests,
+		summary:    "too_many_requests/",
+		retryAfter: retryAfter,
+	})
+}
+
+// CorruptNextDownloads flips a byte in the content of the next n downloads
+// without changing the metadata sent along, so content_hash won't match.
+func (s *Server) CorruptNextDownloads(n int) {
+	s.Lock()
+	defer s.Unlock()
+	s.corrupt += n
+}
+
+// SetLatency delays every call to route by d. An empty route applies to all
+// routes that have no latency of their own.
+func (s *Server) SetLatency(route string, d time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+	s.latency[route] = d
+}
+
+// SetQuota gives the account allocated bytes of its own.
+func (s *Server) SetQuota(allocated uint64) {
+	s.Lock()
+	defer s.Unlock()
+	s.allocated, s.team, s.othersUsed, s.memberLimit = allocated, false, 0, 0
+}
+
+// AccountID returns the ID of the account served, different for each Server.
+func (s *Server) AccountID() string {
+	return s.account
+}
+
+// SetTeamQuota makes the account a member of a team sharing allocated bytes,
+// of which the other members use othersUsed. A non-zero memberLimit caps
+// what this member may use.
+func (s *Server) SetTeamQuota(allocated uint64, othersUsed uint64, memberLimit uint64) {
+	s.Lock()
+	defer s.Unlock()
+	s.allocated, s.team, s.othersUsed, s.memberLimit = allocated, true, othersUsed, memberLimit
+}
+
+// ResetCursors expires every cursor handed out so far, as Dropbox does now
+// and then. Clients using one are told to reset.
+func (s *Server) ResetCursors() {
+	s.Lock()
+	defer s.Unlock()
+	s.epoch++
+}
+
+// Calls reports how many requests were made to route, including failed ones.
+func (s *Server) Calls(route string) int {
+	s.Lock()
+	defer s.Unlock()
+	return s.calls[route]
+}
+
+// Downloaded reports how many bytes of file content downloads have sent.
+func (s *Server) Downloaded() int64 {
+	s.Lock()
+	defer s.Unlock()
+	return s.downloaded
+}
+
+// WriteFile stores data at p as if another client uploaded it, creating
+// missing parent folders.
+func (s *Server) WriteFile(p string, data []byte) *files.FileMetadata {
+	s.Lock()
+	defer s.Unlock()
+	m, _ := s.putFile(p, data, time.Time{})
+	return m
+}
+
+// ReadFile returns the contents of the file at p.
+func (s *Server) ReadFile(p string) ([]byte, bool) {
+	s.Lock()
+	defer s.Unlock()
+	n, found := s.nodes[strings.ToLower(p)]
+	if !found || n.file == nil {
+		return nil, false
+	}
+	return append([]byte{}, n.content...), true
+}
+
+// Mkdir creates a folder at p as if another client did, including parents.
+func (s *Server) Mkdir(p string) *files.FolderMetadata {
+	s.Lock()
+	defer s.Unlock()
+	return s.mkdirAll(p)
+}
+
+// Remove deletes the file or folder at p as if another client did.
+func (s *Server) Remove(p string) bool {
+	s.Lock()
+	defer s.Unlock()
+	_, found := s.remove(p)
+	return found
+}
+
+// Rename moves the file or folder at from to to as if another client did.
+func (s *Server) Rename(from string, to string) bool {
+	s.Lock()
+	defer s.Unlock()
+	_, err := s.move(from, to)
+	return err == nil
+}
+
+// Stat returns the metadata at p.
+func (s *Server) Stat(p string) (files.IsMetadata, bool) {
+	s.Lock()
+	defer s.Unlock()
+	n, found := s.nodes[strings.ToLower(p)]
+	if !found {
+		return nil, false
+	}
+	return n.metadata(), true
+}
+
+// Properties returns the property groups of the file or folder at p.
+func (s *Server) Properties(p string) []*file_properties.PropertyGroup {
+	s.Lock()
+	defer s.Unlock()
+	n, found := s.nodes[strings.ToLower(p)]
+	if !found {
+		return nil
+	}
+	return s.properties[idOf(n.metadata())]
+}
+
+// List returns the display paths of everything under p, sorted.
+func (s *Server) List(p string) []string {
+	s.Lock()
+	defer s.Unlock()
+	var out []string
+	for _, n := range s.children(strings.ToLower(p), true) {
+		out = append(out, displayPath(n.metadata()))
+	}
+	sort.Strings(out)
+	return out
+}
+
+// lock assumed for everything below
+
+func (s *Server) newID() string {
+	s.nextID++
+	return fmt.Sprintf("id:fake%06d", s.nextID)
+}
+
+func (s *Server) newRev() string {
+	return fmt.Sprintf("%09x", s.seq+1)
+}
+
+func (s *Server) record(lower string, m files.IsMetadata) {
+	s.seq++
+	s.changes = append(s.changes, change{seq: s.seq, lower: lower, metadata: m})
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+func (s *Server) parentOf(p string) (*node, string) {
+	parent := path.Dir(p)
+	if parent == "/" || parent == "." {
+		return nil, ""
+	}
+	return s.nodes[strings.ToLower(parent)], parent
+}
+
+func (s *Server) mkdirAll(p string) *files.FolderMetadata {
+	lower := strings.ToLower(p)
+	if lower == "" || lower == "/" {
+		return nil
+	}
+	if n, found := s.nodes[lower]; found {
+		return n.folder
+	}
+	if parent, parentPath := s.parentOf(p); parent == nil && parentPath != "" {
+		s.mkdirAll(parentPath)
+	}
+	m := files.NewFolderMetadata(path.Base(p), s.newID())
+	m.PathLower = lower
+	m.PathDisplay = p
+	s.nodes[lower] = &node{folder: m}
+	s.record(lower, m)
+	return m
+}
+
+func (s *Server) putFile(p string, data []byte, clientModified time.Time) (*files.FileMetadata, bool) {
+	lower := strings.ToLower(p)
+	if parent, parentPath := s.parentOf(p); parent == nil && parentPath != "" {
+		s.mkdirAll(parentPath)
+	} else if parent != nil && parent.folder == nil {
+		return nil, false
+	}
+	id := ""
+	if n, found := s.nodes[lower]; found {
+		if n.file == nil {
+			return nil, false
+		}
+		id = n.file.Id
+		p = n.file.PathDisplay
+	} else {
+		id = s.newID()
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	if clientModified.IsZero() {
+		clientModified = now
+	}
+	m := files.NewFileMetadata(path.Base(p), id, clientModified.UTC().Truncate(time.Second), now, s.newRev(), uint64(len(data)))
+	m.PathLower = lower
+	m.PathDisplay = p
+	m.ContentHash = ContentHash(data)
+	s.nodes[lower] = &node{file: m, content: append([]byte{}, data...)}
+	s.record(lower, m)
+	return m, true
+}
+
+func (s *Server) remove(p string) (files.IsMetadata, bool) {
+	lower := strings.ToLower(p)
+	n, found := s.nodes[lower]
+	if !found {
+		return nil, false
+	}
+	for _, child := range s.children(lower, true) {
+		delete(s.nodes, lowerPath(child.metadata()))
+	}
+	delete(s.nodes, lower)
+	deleted := files.NewDeletedMetadata(path.Base(displayPath(n.metadata())))
+	deleted.PathLower = lower
+	deleted.PathDisplay = displayPath(n.metadata())
+	s.record(lower, deleted)
+	return n.metadata(), true
+}
+
+func (s *Server) move(from string, to string) (files.IsMetadata, error) {
+	fromLower := strings.ToLower(from)
+	toLower := strings.ToLower(to)
+	n, found := s.nodes[fromLower]
+	if !found {
+		return nil, errNotFound
+	}
+	if existing, found := s.nodes[toLower]; found && existing != n {
+		return nil, errConflict
+	}
+	if strings.HasPrefix(toLower, fromLower+"/") {
+		return nil, errConflict
+	}
+	if parent, parentPath := s.parentOf(to); parent == nil && parentPath != "" {
+		s.mkdirAll(parentPath)
+	}
+	moving := append([]*node{n}, s.children(fromLower, true)...)
+	fromDisplay := displayPath(n.metadata())
+	deleted := files.NewDeletedMetadata(path.Base(from))
+	deleted.PathLower = fromLower
+	deleted.PathDisplay = fromDisplay
+	for _, m := range moving {
+		delete(s.nodes, lowerPath(m.metadata()))
+	}
+	s.record(fromLower, deleted)
+	for _, m := range moving {
+		oldDisplay := displayPath(m.metadata())
+		newDisplay := to + oldDisplay[len(fromDisplay):]
+		rev := s.newRev()
+		if m.file != nil {
+			moved := *m.file
+			moved.Name = path.Base(newDisplay)
+			moved.PathDisplay = newDisplay
+			moved.PathLower = strings.ToLower(newDisplay)
+			moved.Rev = rev
+			m.file = &moved
+		} else {
+			moved := *m.folder
+			moved.Name = path.Base(newDisplay)
+			moved.PathDisplay = newDisplay
+			moved.PathLower = strings.ToLower(newDisplay)
+			m.folder = &moved
+		}
+		s.nodes[lowerPath(m.metadata())] = m
+		s.record(lowerPath(m.metadata()), m.metadata())
+	}
+	return n.metadata(), nil
+}
+
+// children returns the nodes directly inside (or, if recursive, anywhere
+// below) the folder with lowercase path lower, sorted by path.
+func (s *Server) children(lower string, recursive bool) []*node {
+	out := []*node{}
+	for p, n := range s.nodes {
+		if !isUnder(p, lower, recursive) {
+			continue
+		}
+		out = append(out, n)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return lowerPath(out[i].metadata()) < lowerPath(out[j].metadata())
+	})
+	return out
+}
+
+func isUnder(p string, dir string, recursive bool) bool {
+	if dir == "/" {
+		dir = ""
+	}
+	if !strings.HasPrefix(p, dir+"/") {
+		return false
+	}
+	return recursive || !strings.Contains(p[len(dir)+1:], "/")
+}
+
+func idOf(m files.IsMetadata) string {
+	switch v := m.(type) {
+	case *files.FileMetadata:
+		return v.Id
+	case *files.FolderMetadata:
+		return v.Id
+	}
+	return ""
+}
+
+// withProperties returns a copy of m carrying its property groups of the
+// given templates, or m itself when none are asked for.
+func (s *Server) withProperties(m files.IsMetadata, templates []string) files.IsMetadata {
+	if len(templates) == 0 {
+		return m
+	}
+	var groups []*file_properties.PropertyGroup
+	for _, g := range s.properties[idOf(m)] {
+		for _, id := range templates {
+			if g.TemplateId == id {
+				groups = append(groups, g)
+			}
+		}
+	}
+	switch v := m.(type) {
+	case *files.FileMetadata:
+		c := *v
+		c.PropertyGroups = groups
+		return &c
+	case *files.FolderMetadata:
+		c := *v
+		c.PropertyGroups = groups
+		return &c
+	}
+	return m
+}
+
+func lowerPath(m files.IsMetadata) string {
+	switch v := m.(type) {
+	case *files.FileMetadata:
+		return v.PathLower
+	case *files.FolderMetadata:
+		return v.PathLower
+	case *files.DeletedMetadata:
+		return v.PathLower
+	}
+	return ""
+}
+
+func displayPath(m files.IsMetadata) string {
+	switch v := m.(type) {
+	case *files.FileMetadata:
+		return v.PathDisplay
+	case *files.FolderMetadata:
+		return v.PathDisplay
+	case *files.DeletedMetadata:
+		return v.PathDisplay
+	}
+	return ""
+}
+
+// ContentHash computes the Dropbox content_hash of data.
+func ContentHash(data []byte) string {
+	blocks := []byte{}
+	for start := 0; start < len(data); start += hashBlockSize {
+		end := start + hashBlockSize
+		if end > len(data) {
+			end = len(data)
+		}
+		sum := sha256.Sum256(data[start:end])
+		blocks = append(blocks, sum[:]...)
+	}
+	sum := sha256.Sum256(blocks)
+	return hex.EncodeToString(sum[:])
+}
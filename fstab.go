@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Options of mount(8) that mean nothing to dropboxfs, or that mount.fuse
+// already took care of.
+var ignoredOptions = map[string]bool{
+	"defaults": true, "rw": true, "auto": true, "noauto": true,
+	"user": true, "nouser": true, "users": true, "_netdev": true, "nofail": true,
+	"dev": true, "nodev": true, "suid": true, "nosuid": true, "exec": true, "noexec": true,
+	"atime": true, "noatime": true, "relatime": true, "async": true,
+}
+
+// Options taking a value, by the flag they stand for.
+var valueOptions = map[string]string{
+	"uid":        "uid",
+	"gid":        "gid",
+	"umask":      "umask",
+	"root":       "root",
+	"cache_dir":  "cache",
+	"cache_size": "cache-size",
+	"account":    "t",
+	"sync":       "sync",
+	"config":     "config",
+}
+
+// isHelperCall reports whether dropboxfs was run by mount.fuse, as
+// `dropboxfs source mountpoint -o options`, rather than with a command.
+func isHelperCall(args []string) bool {
+	return len(args) >= 2 && !strings.HasPrefix(args[0], "-") && !strings.HasPrefix(args[1], "-")
+}
+
+// runHelper mounts the way mount.fuse asks for, for fstab lines such as
+//
+//	work  /mnt/work  fuse.dropboxfs  allow_other,uid=1000,root=/Team  0 0
+//
+// source names a mount in the config file, or else the account to mount
+// unless account= gives one. Returns once mounted, like mount(8) expects.
+func runHelper(args []string) {
+	flags, err := helperArgs(args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	runMount(flags)
+}
+
+// helperArgs translates the arguments mount.fuse runs dropboxfs with into
+// those of the mount command.
+func helperArgs(args []string) ([]string, error) {
+	var positional, options []string
+	for i := 0; i < len(args); i++ {
+		switch arg := args[i]; {
+		case arg == "-o" && i+1 < len(args):
+			i++
+			options = append(options, strings.Split(args[i], ",")...)
+		case strings.HasPrefix(arg, "-o"):
+			options = append(options, strings.Split(arg[2:], ",")...)
+		case strings.HasPrefix(arg, "-"):
+			// -n, -s, -v and the like from mount(8)
+		default:
+			positional = append(positional, arg)
+		}
+	}
+	if len(positional) != 2 {
+		return nil, errors.New("Usage: dropboxfs source mountpoint [-o options]")
+	}
+	flags, err := helperFlags(options)
+	if err != nil {
+		return nil, err
+	}
+	source, mountpoint := positional[0], positional[1]
+	flags = append(flags, "-m", mountpoint, "-background")
+	configPath, explicit := flagValue(flags, "-config")
+	if !explicit {
+		configPath = defaultConfigPath()
+	}
+	c, err := loadConfig(configPath, explicit)
+	if err != nil {
+		return nil, err
+	}
+	_, account := flagValue(flags, "-t")
+	switch {
+	case c.find(source) != nil:
+		flags = append(flags, source)
+	case !account && source != "dropboxfs" && source != "none":
+		flags = append([]string{"-t", source}, flags...)
+	}
+	return flags, nil
+}
+
+// helperFlags translates mount options into the flags of the mount command.
+func helperFlags(options []string) ([]string, error) {
+	var flags []string
+	for _, option := range options {
+		name, value := option, ""
+		if i := strings.IndexByte(option, '='); i >= 0 {
+			name, value = option[:i], option[i+1:]
+		}
+		switch {
+		case name == "":
+		case name == "ro":
+			flags = append(flags, "-ro")
+		case name == "allow_other":
+			flags = append(flags, "-allow-other")
+		case valueOptions[name] != "":
+			if value == "" {
+				return nil, fmt.Errorf("mount option %v needs a value", name)
+			}
+			flags = append(flags, "-"+valueOptions[name], value)
+		case ignoredOptions[name]:
+		default:
+			log.Warnln("Ignoring unknown mount option", option)
+		}
+	}
+	return flags, nil
+}
+
+// flagValue returns the value given for the flag name among flags.
+func flagValue(flags []string, name string) (string, bool) {
+	for i := 0; i+1 < len(flags); i++ {
+		if flags[i] == name {
+			return flags[i+1], true
+		}
+	}
+	return "", false
+}
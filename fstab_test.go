@@ -0,0 +1,187 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestIsHelperCall(t *testing.T) {
+	for _, test := range []struct {
+		args []string
+		want bool
+	}{
+		{[]string{"work", "/mnt/work", "-o", "ro"}, true},
+		{[]string{"work", "/mnt/work"}, true},
+		{[]string{"-t", "work"}, false},
+		{[]string{"-m", "/mnt/work"}, false},
+		{[]string{"/mnt/work"}, false},
+		{nil, false},
+	} {
+		if got := isHelperCall(test.args); got != test.want {
+			t.Error(test.args, "got", got)
+		}
+	}
+}
+
+func TestHelperFlags(t *testing.T) {
+	for _, test := range []struct {
+		options []string
+		want    []string
+	}{
+		{[]string{"ro"}, []string{"-ro"}},
+		{[]string{"allow_other"}, []string{"-allow-other"}},
+		{
+			[]string{"uid=1000", "gid=100", "umask=022"},
+			[]string{"-uid", "1000", "-gid", "100", "-umask", "022"},
+		},
+		{[]string{"root=/Team/Projects"}, []string{"-root", "/Team/Projects"}},
+		{[]string{"cache_dir=/var/cache/db"}, []string{"-cache", "/var/cache/db"}},
+		{[]string{"cache_size=512", "sync=close"}, []string{"-cache-size", "512", "-sync", "close"}},
+		{[]string{"account=work"}, []string{"-t", "work"}},
+		{[]string{"config=/etc/dropboxfs.toml"}, []string{"-config", "/etc/dropboxfs.toml"}},
+		// Meant for mount itself
+		{[]string{"defaults", "noauto", "user", "nofail", "_netdev", "noatime", ""}, nil},
+		{[]string{"unknown", "ro"}, []string{"-ro"}},
+	} {
+		got, err := helperFlags(test.options)
+		if err != nil {
+			t.Error(test.options, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Error(test.options, "got", got)
+		}
+	}
+	for _, option := range []string{"uid", "root=", "account="} {
+		if _, err := helperFlags([]string{option}); err == nil {
+			t.Error("Expected", option, "to need a value")
+		}
+	}
+}
+
+func TestFlagValue(t *testing.T) {
+	flags := []string{"-ro", "-t", "work", "-config", "/etc/dropboxfs.toml", "-m"}
+	for _, test := range []struct {
+		name  string
+		want  string
+		found bool
+	}{
+		{"-t", "work", true},
+		{"-config", "/etc/dropboxfs.toml", true},
+		{"-root", "", false},
+		// Last, without a value
+		{"-m", "", false},
+	} {
+		if got, found := flagValue(flags, test.name); got != test.want || found != test.found {
+			t.Error(test.name, "got", got, found)
+		}
+	}
+}
+
+func TestHelperArgs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dropboxfs-fstab")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// No config file of the user's own is read
+	t.Setenv("HOME", dir)
+	t.Setenv("XDG_CONFIG_HOME", dir)
+	config := filepath.Join(dir, "config.toml")
+	err = ioutil.WriteFile(config, []byte("[[mount]]\nname = \"personal\"\nmountpoint = \"/mnt/personal\"\naccount = \"me\"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		args []string
+		want []string
+	}{
+		// Source is the account
+		{
+			[]string{"work", "/mnt/work", "-o", "ro,allow_other"},
+			[]string{"-t", "work", "-ro", "-allow-other", "-m", "/mnt/work", "-background"},
+		},
+		{
+			[]string{"work", "/mnt/work", "-oro,uid=1000"},
+			[]string{"-t", "work", "-ro", "-uid", "1000", "-m", "/mnt/work", "-background"},
+		},
+		// account= picks the account instead
+		{
+			[]string{"work", "/mnt/work", "-o", "account=other"},
+			[]string{"-t", "other", "-m", "/mnt/work", "-background"},
+		},
+		// Placeholder sources mount the default account
+		{
+			[]string{"none", "/mnt/work", "-o", "rw"},
+			[]string{"-m", "/mnt/work", "-background"},
+		},
+		{
+			[]string{"dropboxfs", "/mnt/work"},
+			[]string{"-m", "/mnt/work", "-background"},
+		},
+		// Source names a mount in the config file
+		{
+			[]string{"personal", "/mnt/elsewhere", "-n", "-o", "config=" + config + ",nofail"},
+			[]string{"-config", config, "-m", "/mnt/elsewhere", "-background", "personal"},
+		},
+		// Not in the config file, so the account
+		{
+			[]string{"work", "/mnt/work", "-o", "config=" + config},
+			[]string{"-t", "work", "-config", config, "-m", "/mnt/work", "-background"},
+		},
+	} {
+		got, err := helperArgs(test.args)
+		if err != nil {
+			t.Error(test.args, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Error(strings.Join(test.args, " "), "got", got)
+		}
+	}
+
+	for _, args := range [][]string{
+		{"work"},
+		{"work", "/mnt/work", "extra"},
+		{"work", "/mnt/work", "-o", "uid"},
+		{"work", "/mnt/work", "-o", "config=" + filepath.Join(dir, "missing.toml")},
+	} {
+		if _, err := helperArgs(args); err == nil {
+			t.Error("Expected", args, "to fail")
+		}
+	}
+}
+
+func TestHelperArgsMount(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dropboxfs-fstab")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	t.Setenv("HOME", dir)
+	t.Setenv("XDG_CONFIG_HOME", dir)
+	args, err := helperArgs([]string{"work", "/mnt/work", "-o", "ro,allow_other,uid=1000,gid=100,umask=027,root=/Team,cache_dir=/var/cache/db"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// What the mount command makes of them
+	flags := newMountFlags("mount")
+	flags.addSettings()
+	if err := flags.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	m, err := flags.mount(flags.Arg(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Mountpoint != "/mnt/work" || m.Account != "work" || m.Root != "/Team" || m.CacheDir != "/var/cache/db" {
+		t.Errorf("Unexpected mount %+v", m)
+	}
+	if !m.ReadOnly || !m.AllowOther || !m.Background || m.Umask != "027" || *m.UID != 1000 || *m.GID != 100 {
+		t.Errorf("Unexpected settings %+v", m)
+	}
+}
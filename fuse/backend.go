@@ -0,0 +1,70 @@
+package fuse
+
+import (
+	"io"
+
+	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox/file_properties"
+	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox/files"
+	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox/users"
+)
+
+// Backend is the narrow set of storage calls the FUSE nodes depend on.
+// The Dropbox SDK is one implementation (see NewSDKBackend), anything that
+// speaks in Dropbox metadata can be plugged in instead.
+type Backend interface {
+	// ListFolder lists the entries of the folder at path.
+	ListFolder(path string, recursive bool) (*files.ListFolderResult, error)
+	// ListFolderContinue pages through a listing or the changes since cursor.
+	ListFolderContinue(cursor string) (*files.ListFolderResult, error)
+	// GetLatestCursor returns a cursor for the current state of path without listing it.
+	GetLatestCursor(path string, recursive bool) (string, error)
+	// Longpoll blocks for up to timeout seconds waiting for changes on cursor.
+	Longpoll(cursor string, timeout uint64) (*files.ListFolderLongpollResult, error)
+	// Download streams length bytes of the file at path starting at offset,
+	// or everything from offset on when length is 0.
+	Download(path string, offset int64, length int64) (*files.FileMetadata, io.ReadCloser, error)
+	// Upload writes content to the file described by commit.
+	Upload(commit *files.CommitInfo, content io.Reader) (*files.FileMetadata, error)
+	// UploadSessionStart begins an upload in parts with the first part.
+	UploadSessionStart(content io.Reader) (string, error)
+	// UploadSessionAppend adds content at offset to the upload session.
+	UploadSessionAppend(sessionID string, offset uint64, content io.Reader) error
+	// UploadSessionFinish adds the last content at offset and commits the session.
+	UploadSessionFinish(sessionID string, offset uint64, commit *files.CommitInfo, content io.Reader) (*files.FileMetadata, error)
+	// Move relocates the file or folder at fromPath to toPath.
+	Move(fromPath string, toPath string) (files.IsMetadata, error)
+	// Delete removes the file or folder at path.
+	Delete(path string) (files.IsMetadata, error)
+	// Mkdir creates a folder at path.
+	Mkdir(path string) (*files.FolderMetadata, error)
+	// GetMetadata returns the metadata of the file or folder at path.
+	GetMetadata(path string) (files.IsMetadata, error)
+	// IncludeProperties makes listings, cursors and metadata made from now on
+	// carry the property groups of the templates with the given IDs.
+	IncludeProperties(templateIDs []string)
+	// ListPropertyTemplates returns the IDs of the user's property templates.
+	ListPropertyTemplates() ([]string, error)
+	// GetPropertyTemplate describes the property template with the given ID.
+	GetPropertyTemplate(templateID string) (*file_properties.PropertyGroupTemplate, error)
+	// AddPropertyTemplate creates a property template, returning its ID.
+	AddPropertyTemplate(template *file_properties.PropertyGroupTemplate) (string, error)
+	// UpdatePropertyTemplate adds fields to the property template with the
+	// given ID.
+	UpdatePropertyTemplate(templateID string, fields []*file_properties.PropertyFieldTemplate) error
+	// SetProperties replaces the fields of a property group on the file or
+	// folder at path.
+	SetProperties(path string, group *file_properties.PropertyGroup) error
+	// AddProperties adds a property group the file or folder at path doesn't
+	// have yet.
+	AddProperties(path string, group *file_properties.PropertyGroup) error
+	// UpdateProperties changes fields of a property group of the file or
+	// folder at path.
+	UpdateProperties(path string, update *file_properties.PropertyGroupUpdate) error
+	// RemoveProperties removes the property group with the given template
+	// from the file or folder at path.
+	RemoveProperties(path string, templateID string) error
+	// SpaceUsage returns how much space the account uses and may use.
+	SpaceUsage() (*users.SpaceUsage, error)
+	// CurrentAccount returns the ID of the account served.
+	CurrentAccount() (string, error)
+}
@@ -0,0 +1,324 @@
+package fuse
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Dropbox hashes content in blocks of this size for content_hash, caching in
+// the same size lets a whole download be checked against it.
+const blockSize = 4 * 1024 * 1024
+
+var (
+	errContentHash = errors.New("downloaded content does not match content_hash")
+	errNotCached   = errors.New("block was evicted or not downloaded")
+)
+
+type cachedBlock struct {
+	name string
+	size int64
+}
+
+// BlockCache keeps file contents on disk in fixed-size blocks, keyed by the
+// content_hash of the file they belong to. Least recently used blocks are
+// evicted once the cache grows past its maximum size.
+type BlockCache struct {
+	dir     string
+	maxSize int64
+	size    int64
+	lru     *list.List               // of *cachedBlock, most recently used first
+	blocks  map[string]*list.Element // by name
+	// blocks being downloaded, closed when done
+	fetching map[string]chan struct{}
+	pinned   map[string]bool // keys never evicted
+	sync.Mutex
+}
+
+// OpenBlockCache opens the block cache in dir, picking up blocks cached by
+// earlier runs. maxSize is in bytes.
+func OpenBlockCache(dir string, maxSize int64) (*BlockCache, error) {
+	c := &BlockCache{
+		dir:      dir,
+		maxSize:  maxSize,
+		lru:      list.New(),
+		blocks:   map[string]*list.Element{},
+		fetching: map[string]chan struct{}{},
+		pinned:   map[string]bool{},
+	}
+	for _, d := range []string{c.blockDir(), c.localDir()} {
+		if err := os.MkdirAll(d, 0700); err != nil {
+			return nil, err
+		}
+	}
+	// Local copies outlive the mount that wrote them only while queued
+	pending, err := PendingUploads(dir)
+	if err != nil {
+		return nil, err
+	}
+	queued := map[string]bool{}
+	for _, p := range pending {
+		queued[p.ID] = true
+	}
+	locals, err := ioutil.ReadDir(c.localDir())
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range locals {
+		if !queued[info.Name()] {
+			os.Remove(filepath.Join(c.localDir(), info.Name()))
+		}
+	}
+
+	infos, err := ioutil.ReadDir(c.blockDir())
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ModTime().Before(infos[j].ModTime())
+	})
+	for _, info := range infos {
+		if strings.HasSuffix(info.Name(), ".tmp") {
+			os.Remove(filepath.Join(c.blockDir(), info.Name()))
+			continue
+		}
+		c.blocks[info.Name()] = c.lru.PushFront(&cachedBlock{name: info.Name(), size: info.Size()})
+		c.size += info.Size()
+	}
+	c.Lock()
+	c.evict()
+	c.Unlock()
+	return c, nil
+}
+
+func (c *BlockCache) blockDir() string {
+	return filepath.Join(c.dir, "blocks")
+}
+
+func (c *BlockCache) localDir() string {
+	return filepath.Join(c.dir, "local")
+}
+
+func blockName(key string, index int64) string {
+	return fmt.Sprintf("%s.%d", key, index)
+}
+
+// blockKey returns the key of the file a block belongs to.
+func blockKey(name string) string {
+	return name[:strings.LastIndexByte(name, '.')]
+}
+
+func blockCount(size uint64) int64 {
+	return (int64(size) + blockSize - 1) / blockSize
+}
+
+// window is how many blocks can be read ahead without evicting the block
+// being read.
+func (c *BlockCache) window() int64 {
+	return c.maxSize/2/blockSize + 1
+}
+
+// readAt reads from block index of key into p, starting off bytes into the
+// block. Reports false when the block isn't cached.
+func (c *BlockCache) readAt(key string, index int64, p []byte, off int64) (int, bool) {
+	name := blockName(key, index)
+	c.Lock()
+	el, found := c.blocks[name]
+	if found {
+		c.lru.MoveToFront(el)
+	}
+	c.Unlock()
+	if !found {
+		return 0, false
+	}
+	f, err := os.Open(filepath.Join(c.blockDir(), name))
+	if err != nil {
+		// Evicted in the meantime
+		return 0, false
+	}
+	defer f.Close()
+	n, err := f.ReadAt(p, off)
+	if err != nil && err != io.EOF {
+		log.Errorln("Unable to read cached block", name, err)
+		return 0, false
+	}
+	return n, true
+}
+
+// has reports whether block index of key is cached.
+func (c *BlockCache) has(key string, index int64) bool {
+	c.Lock()
+	defer c.Unlock()
+	_, found := c.blocks[blockName(key, index)]
+	return found
+}
+
+// claim marks block index of key as being downloaded by the caller. When
+// another download has it already, returns false and a channel that is
+// closed once that download is done.
+func (c *BlockCache) claim(key string, index int64) (<-chan struct{}, bool) {
+	name := blockName(key, index)
+	c.Lock()
+	defer c.Unlock()
+	if done, found := c.fetching[name]; found {
+		return done, false
+	}
+	c.fetching[name] = make(chan struct{})
+	return nil, true
+}
+
+func (c *BlockCache) unclaim(key string, index int64) {
+	name := blockName(key, index)
+	c.Lock()
+	defer c.Unlock()
+	if done, found := c.fetching[name]; found {
+		close(done)
+		delete(c.fetching, name)
+	}
+}
+
+// fill caches content read from r as the blocks of a file of the given size
+// starting at block first, up to limit blocks. When r holds the whole file it
+// is checked against hash first, parts of a file can't be checked.
+func (c *BlockCache) fill(key string, size int64, hash string, first int64, r io.Reader, limit int64) error {
+	var staged []*cachedBlock
+	discard := func() {
+		for _, b := range staged {
+			os.Remove(filepath.Join(c.blockDir(), b.name+".tmp"))
+		}
+	}
+	hashes := sha256.New()
+	buf := make([]byte, blockSize)
+	complete := false
+	for index := first; index < first+limit && index*blockSize < size; index++ {
+		want := size - index*blockSize
+		if want > blockSize {
+			want = blockSize
+		}
+		n, err := io.ReadFull(r, buf[:want])
+		if err != nil {
+			// A different version of the file than the one asked for
+			discard()
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return errContentHash
+			}
+			return err
+		}
+		sum := sha256.Sum256(buf[:n])
+		hashes.Write(sum[:])
+		b := &cachedBlock{name: blockName(key, index), size: int64(n)}
+		if err := ioutil.WriteFile(filepath.Join(c.blockDir(), b.name+".tmp"), buf[:n], 0600); err != nil {
+			discard()
+			return err
+		}
+		staged = append(staged, b)
+		complete = first == 0 && index*blockSize+want == size
+	}
+	if size == 0 {
+		complete = true
+	}
+	if complete && hash != "" && hex.EncodeToString(hashes.Sum(nil)) != hash {
+		discard()
+		return errContentHash
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	for _, b := range staged {
+		if err := os.Rename(filepath.Join(c.blockDir(), b.name+".tmp"), filepath.Join(c.blockDir(), b.name)); err != nil {
+			log.Errorln("Unable to cache block", b.name, err)
+			continue
+		}
+		if el, found := c.blocks[b.name]; found {
+			c.size -= el.Value.(*cachedBlock).size
+			c.lru.Remove(el)
+		}
+		c.blocks[b.name] = c.lru.PushFront(b)
+		c.size += b.size
+	}
+	c.evict()
+	return nil
+}
+
+// evict drops least recently used blocks until the cache fits in maxSize.
+// Pinned blocks are kept on top of it, so they can't crowd out the rest.
+// lock assumed
+func (c *BlockCache) evict() {
+	size := c.size
+	for _, b := range c.blocks {
+		if b := b.Value.(*cachedBlock); c.pinned[blockKey(b.name)] {
+			size -= b.size
+		}
+	}
+	for el := c.lru.Back(); el != nil && size > c.maxSize; {
+		b := el.Value.(*cachedBlock)
+		prev := el.Prev()
+		if !c.pinned[blockKey(b.name)] {
+			c.lru.Remove(el)
+			delete(c.blocks, b.name)
+			c.size -= b.size
+			size -= b.size
+			if err := os.Remove(filepath.Join(c.blockDir(), b.name)); err != nil && !os.IsNotExist(err) {
+				log.Errorln("Unable to evict cached block", b.name, err)
+			}
+		}
+		el = prev
+	}
+}
+
+// pin keeps the blocks of the given keys from eviction, instead of the ones
+// pinned before.
+func (c *BlockCache) pin(keys map[string]bool) {
+	c.Lock()
+	defer c.Unlock()
+	c.pinned = keys
+	c.evict()
+}
+
+// fits reports whether a file of size bytes under key could be cached whole
+// without evicting itself.
+func (c *BlockCache) fits(key string, size int64) bool {
+	c.Lock()
+	defer c.Unlock()
+	return size <= c.maxSize || c.pinned[key]
+}
+
+// localCopy makes a file to hold a copy of a file with local changes.
+func (c *BlockCache) localCopy() (*os.File, error) {
+	return ioutil.TempFile(c.localDir(), "file")
+}
+
+// CacheUsage returns how many bytes of file contents are cached in the cache
+// directory dir. Safe to call while dir is mounted.
+func CacheUsage(dir string) (int64, error) {
+	infos, err := ioutil.ReadDir(filepath.Join(dir, "blocks"))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var size int64
+	for _, info := range infos {
+		size += info.Size()
+	}
+	return size, nil
+}
+
+// ClearCache drops the file contents cached in the cache directory dir.
+// Changes waiting to be uploaded and the metadata stay. dir must not be
+// mounted.
+func ClearCache(dir string) error {
+	return os.RemoveAll(filepath.Join(dir, "blocks"))
+}
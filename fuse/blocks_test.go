@@ -0,0 +1,168 @@
+package fuse
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func openTestCache(t *testing.T, maxSize int64) *BlockCache {
+	dir, err := ioutil.TempDir("", "dropboxfs-blocks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	c, err := OpenBlockCache(dir, maxSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// contentHash hashes data the way Dropbox does for content_hash.
+func contentHash(data []byte) string {
+	hashes := sha256.New()
+	for len(data) > 0 {
+		n := len(data)
+		if n > blockSize {
+			n = blockSize
+		}
+		sum := sha256.Sum256(data[:n])
+		hashes.Write(sum[:])
+		data = data[n:]
+	}
+	return hex.EncodeToString(hashes.Sum(nil))
+}
+
+// fillAll caches the whole of data under key.
+func fillAll(t *testing.T, c *BlockCache, key string, data []byte) {
+	t.Helper()
+	size := int64(len(data))
+	if err := c.fill(key, size, contentHash(data), 0, bytes.NewReader(data), blockCount(uint64(size))); err != nil {
+		t.Fatal("Unable to cache", key, err)
+	}
+}
+
+func cachedKeys(c *BlockCache, keys ...string) []string {
+	var out []string
+	for _, key := range keys {
+		if c.has(key, 0) {
+			out = append(out, key)
+		}
+	}
+	return out
+}
+
+func TestBlockCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), 100)
+	c := openTestCache(t, 250)
+	fillAll(t, c, "a", data)
+	fillAll(t, c, "b", data)
+	// Read last, so b is the least recently used
+	if _, found := c.readAt("a", 0, make([]byte, 10), 0); !found {
+		t.Fatal("a not cached")
+	}
+	fillAll(t, c, "c", data)
+	if got := cachedKeys(c, "a", "b", "c"); !sameNames(got, "a", "c") {
+		t.Fatal("Unexpected blocks cached", got)
+	}
+	if _, err := os.Stat(filepath.Join(c.blockDir(), blockName("b", 0))); !os.IsNotExist(err) {
+		t.Error("Evicted block still on disk", err)
+	}
+	if used, err := CacheUsage(c.dir); err != nil || used != 200 {
+		t.Error("Unexpected usage", used, err)
+	}
+
+	// Reopened, blocks are picked up from disk
+	reopened, err := OpenBlockCache(c.dir, 250)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := cachedKeys(reopened, "a", "b", "c"); !sameNames(got, "a", "c") {
+		t.Fatal("Unexpected blocks after reopening", got)
+	}
+	buf := make([]byte, 200)
+	if n, found := reopened.readAt("c", 0, buf, 0); !found || !bytes.Equal(buf[:n], data) {
+		t.Fatalf("Read back %q", buf[:n])
+	}
+}
+
+func TestBlockCacheKeepsPinnedOnTop(t *testing.T) {
+	small := bytes.Repeat([]byte("s"), 100)
+	large := bytes.Repeat([]byte("l"), blockSize+100)
+	c := openTestCache(t, 150)
+	c.pin(map[string]bool{"pinned": true})
+	fillAll(t, c, "pinned", large)
+	if !c.has("pinned", 0) || !c.has("pinned", 1) {
+		t.Fatal("Pinned file evicted")
+	}
+	// The pinned blocks don't count towards the limit
+	fillAll(t, c, "a", small)
+	if got := cachedKeys(c, "pinned", "a"); !sameNames(got, "pinned", "a") {
+		t.Fatal("Pinned blocks crowded out the rest", got)
+	}
+	fillAll(t, c, "b", small)
+	if got := cachedKeys(c, "pinned", "a", "b"); !sameNames(got, "pinned", "b") {
+		t.Fatal("Unexpected blocks cached", got)
+	}
+
+	c.pin(map[string]bool{})
+	if c.has("pinned", 0) || c.has("pinned", 1) {
+		t.Fatal("Unpinned blocks kept over the limit")
+	}
+}
+
+func TestBlockCacheChecksContentHash(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), blockSize+100)
+	size := int64(len(data))
+	c := openTestCache(t, 4*blockSize)
+
+	wrong := contentHash([]byte("something else"))
+	if err := c.fill("a", size, wrong, 0, bytes.NewReader(data), 2); err != errContentHash {
+		t.Fatal("Expected a content hash mismatch, got", err)
+	}
+	// Short of what the metadata says, another version of the file
+	if err := c.fill("a", size, contentHash(data), 0, bytes.NewReader(data[:blockSize]), 2); err != errContentHash {
+		t.Fatal("Expected a content hash mismatch for short content, got", err)
+	}
+	if c.has("a", 0) || c.has("a", 1) {
+		t.Fatal("Cached content that failed the check")
+	}
+	if names, _ := ioutil.ReadDir(c.blockDir()); len(names) != 0 {
+		t.Fatal("Staged blocks left behind", len(names))
+	}
+
+	// Parts of a file can't be checked, only the whole
+	if err := c.fill("a", size, wrong, 1, bytes.NewReader(data[blockSize:]), 1); err != nil {
+		t.Fatal(err)
+	}
+	if !c.has("a", 1) || c.has("a", 0) {
+		t.Fatal("Unexpected blocks cached for a part")
+	}
+	fillAll(t, c, "a", data)
+	if !c.has("a", 0) {
+		t.Fatal("Checked content not cached")
+	}
+}
+
+func TestBlockCacheFits(t *testing.T) {
+	c := openTestCache(t, 100)
+	c.pin(map[string]bool{"pinned": true})
+	for _, test := range []struct {
+		key  string
+		size int64
+		want bool
+	}{
+		{"a", 100, true},
+		{"a", 101, false},
+		{"pinned", 101, true},
+	} {
+		if got := c.fits(test.key, test.size); got != test.want {
+			t.Error("fits", test.key, test.size, "got", got)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package fuse
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox/files"
+)
+
+// Conflict is a change to a file that was also changed on Dropbox since we
+// read it. Ours went to a copy next to it, theirs stayed.
+type Conflict struct {
+	Path string    `json:"path"`
+	Copy string    `json:"copy"` // where our changes went
+	Rev  string    `json:"rev"`  // version both changes were made to
+	Time time.Time `json:"time"`
+}
+
+func conflictLog(dir string) string {
+	return filepath.Join(dir, "conflicts.json")
+}
+
+// Conflicts lists the conflicted copies saved by mounts of the cache
+// directory dir, oldest first. Safe to call while dir is mounted.
+func Conflicts(dir string) ([]*Conflict, error) {
+	f, err := os.Open(conflictLog(dir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var conflicts []*Conflict
+	lines := bufio.NewScanner(f)
+	for lines.Scan() {
+		c := &Conflict{}
+		if err := json.Unmarshal(lines.Bytes(), c); err != nil {
+			// Cut short by a crash
+			continue
+		}
+		conflicts = append(conflicts, c)
+	}
+	return conflicts, lines.Err()
+}
+
+// addConflict appends c to the conflicts saved in the cache directory.
+func (j *journal) addConflict(c *Conflict) error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(conflictLog(j.dir), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(data, '\n'))
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// conflictedCopy names the copy of our changes to the file at p, the way the
+// desktop client does: "notes (host's conflicted copy 2006-01-02).txt".
+func conflictedCopy(p string, now time.Time) string {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "dropboxfs"
+	}
+	ext := path.Ext(p)
+	if ext == path.Base(p) {
+		// Dotfile, nothing to keep at the end
+		ext = ""
+	}
+	return fmt.Sprintf("%s (%s's conflicted copy %s)%s", strings.TrimSuffix(p, ext), host, now.Format("2006-01-02"), ext)
+}
+
+// conflicted records that our changes to the version rev of the file at p
+// went to saved instead, and reads the file from Dropbox again.
+func (u *uploader) conflicted(p string, rev string, saved *files.FileMetadata) {
+	log.Warnln("Conflicting change to", p, "on Dropbox, saved ours as", saved.PathDisplay)
+	c := &Conflict{Path: p, Copy: saved.PathDisplay, Rev: rev, Time: time.Now()}
+	if err := u.journal.addConflict(c); err != nil {
+		log.Errorln("Unable to record conflicted copy of", p, err)
+	}
+	// Holds the size of our changes, not theirs
+	u.db.refresh(p)
+}
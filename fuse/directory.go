@@ -1,8 +1,11 @@
 package fuse
 
 import (
+	"bytes"
+	"fmt"
 	"os"
 	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
@@ -14,137 +17,187 @@ import (
 )
 
 type Directory struct {
-	Metadata       *files.FolderMetadata
-	Subdirectories []*files.FolderMetadata
-	Files          []*files.FileMetadata
-	Client         *Dropbox
+	Metadata *files.FolderMetadata
+	Client   *Dropbox
 	sync.Mutex
 }
 
+// childPath is the Dropbox path of name inside d.
+func (d *Directory) childPath(name string) string {
+	return d.Metadata.PathDisplay + "/" + name
+}
+
 // lock assumed
-func (d *Directory) populateDirectory() {
-	if d.Client.IsDirectoryCached(d) {
+func (d *Directory) populateDirectory() error {
+	if d.Client.tree.isListed(d.Metadata.PathDisplay) {
 		log.Debugln("Directory", d.Metadata.PathDisplay, "cached. Not fetching.")
-		return
+		return nil
 	}
-	files, folders, err := d.Client.listFilesAndFolders(d)
-	if err != nil {
-		log.Panicln("Unable to load files and folders at path", d.Metadata.PathDisplay, err)
+	if err := d.Client.listFolder(d.Metadata.PathDisplay); err != nil {
+		log.Errorln("Unable to load files and folders at path", d.Metadata.PathDisplay, err)
+		return toErrno(err)
 	}
-	d.Lock()
-	d.Files = files
-	d.Subdirectories = folders
-	d.Unlock()
 	log.Infof("Populated directory at path %+v\n", d.Metadata)
+	return nil
+}
+
+// isEmpty reports whether the directory has no children, listing it if needed.
+func (d *Directory) isEmpty() (bool, error) {
+	if err := d.populateDirectory(); err != nil {
+		return false, err
+	}
+	children, _ := d.Client.tree.children(d.Metadata.PathDisplay)
+	return len(children) == 0, nil
 }
 
 func (d *Directory) Attr(ctx context.Context, a *fuse.Attr) error {
 	log.Debugln("Requested Attr for Directory", d.Metadata.PathDisplay)
-	a.Inode = Inode(d.Metadata.Id)
-	a.Mode = os.ModeDir | 0700
+	a.Inode = rootInode
+	if d != d.Client.rootDir {
+		a.Inode = d.Client.tree.inode(d.Metadata.Id)
+	}
+	a.Mode = os.ModeDir | d.Client.mode(d.Metadata.PropertyGroups)
+	a.Uid, a.Gid = d.Client.uid, d.Client.gid
+	a.Mtime = d.Client.started
+	a.Atime = a.Mtime
+	a.Ctime = a.Mtime
+	return nil
+}
+
+// Setattr changes the mode, kept in file properties. Folders have no times
+// on Dropbox and the owner can't change.
+func (d *Directory) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+	log.Infoln("Setattr call on directory", d.Metadata.PathDisplay)
+	if d.Client.readOnly {
+		return errReadOnly
+	}
+	if err := d.Client.checkOwner(req); err != nil {
+		return err
+	}
+	if !req.Valid.Mode() {
+		return nil
+	}
+	if d.Metadata.PathDisplay == "" {
+		// Dropbox keeps no properties on the root
+		return fuse.EPERM
+	}
+	if err := d.Client.setMode(d.Metadata.PathDisplay, d.Metadata.PropertyGroups, req.Mode); err != nil {
+		log.Errorln("Unable to change mode of", d.Metadata.PathDisplay, err)
+		return toErrno(err)
+	}
 	return nil
 }
 
 func (d *Directory) Lookup(ctx context.Context, name string) (fs.Node, error) {
 	log.Debugln("Requested lookup for ", name)
-	d.populateDirectory()
-	for _, n := range d.Files {
-		if n.Metadata.Name == name {
-			log.Infoln("Found match for file lookup with size", n.Size)
-			return d.Client.NewOrCachedFile(n), nil
-		}
+	if err := d.populateDirectory(); err != nil {
+		return nil, err
 	}
-	for _, n := range d.Subdirectories {
-		if n.Metadata.Name == name {
-			log.Debugln("Found match for directory lookup")
-			return d.Client.NewOrCachedDirectory(n), nil
-		}
+	if e := d.Client.tree.child(d.Metadata.PathDisplay, name); e != nil {
+		log.Debugln("Found match for lookup", name)
+		return d.Client.node(e), nil
 	}
 	return nil, fuse.ENOENT
 }
 
 func (d *Directory) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 	log.Infoln("Reading all dir", d.Metadata.PathDisplay)
-	d.populateDirectory()
-	var children []fuse.Dirent
-	for _, f := range d.Files {
-		children = append(children, fuse.Dirent{Inode: Inode(f.Id), Type: fuse.DT_File, Name: f.Metadata.Name})
+	if err := d.populateDirectory(); err != nil {
+		return nil, err
 	}
-	for _, dir := range d.Subdirectories {
-		children = append(children, fuse.Dirent{Inode: Inode(dir.Id), Type: fuse.DT_Dir, Name: dir.Metadata.Name})
+	entries, _ := d.Client.tree.children(d.Metadata.PathDisplay)
+	var children []fuse.Dirent
+	for _, e := range entries {
+		switch m := e.metadata.(type) {
+		case *files.FileMetadata:
+			children = append(children, fuse.Dirent{Inode: d.Client.tree.inode(m.Id), Type: fuse.DT_File, Name: m.Name})
+		case *files.FolderMetadata:
+			children = append(children, fuse.Dirent{Inode: d.Client.tree.inode(m.Id), Type: fuse.DT_Dir, Name: m.Name})
+		}
 	}
 	return children, nil
 }
 
 func (d *Directory) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (fs.Node, fs.Handle, error) {
 	log.Infoln("Create request for name", req.Name)
+	if d.Client.readOnly {
+		return nil, nil, errReadOnly
+	}
 
-	fileMetadata, err := d.Client.Upload(d.Metadata.PathDisplay+"/"+req.Name, []byte{})
-	if err != nil {
-		log.Panicln("Unable to create file ", d.Metadata.PathDisplay+"/"+req.Name, err)
+	if _, err := d.Client.Upload(d.childPath(req.Name), bytes.NewReader(nil), 0, "", time.Time{}); err != nil {
+		log.Errorln("Unable to create file ", d.childPath(req.Name), err)
+		return nil, nil, toErrno(err)
 	}
-	newFile := d.Client.NewOrCachedFile(fileMetadata)
-	d.Lock()
-	d.Files = append(d.Files, newFile.Metadata)
-	d.Unlock()
+	e := d.Client.tree.child(d.Metadata.PathDisplay, req.Name)
+	if e == nil {
+		return nil, nil, fuse.EIO
+	}
+	newFile := d.Client.node(e).(*File)
 	return newFile, newFile, nil
 }
 
 func (d *Directory) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fs.Node) error {
+	log.Infoln("Rename request for", req.OldName, "to", req.NewName)
+	if d.Client.readOnly {
+		return errReadOnly
+	}
 	d.Lock()
 	defer d.Unlock()
-	log.Infoln("Rename request for", req.OldName, "to", req.NewName)
 	newParentDir, _ := newDir.(*Directory)
 
-	// figure out if we're working on dir or file, because req doesn't give us this
-	isDir := false
-	for _, dir := range d.Subdirectories {
-		if dir.Name == req.OldName {
-			isDir = true
-			break
-		}
-	}
-
 	// populate these two for the Dropbox call
-	oldPath := ""
-	newPath := ""
-	if isDir {
-		newDirs := []*files.FolderMetadata{}
-		movingDir := &files.FolderMetadata{}
-		for _, dir := range d.Subdirectories {
-			if dir.Name != req.OldName {
-				newDirs = append(newDirs, dir)
-			} else {
-				movingDir = dir
+	oldPath := d.childPath(req.OldName)
+	newPath := newParentDir.childPath(req.NewName)
+
+	// Dropbox refuses to move over an existing item, so replace it like
+	// rename(2) would. Only a different item, renaming foo to Foo finds foo.
+	source := d.Client.tree.child(d.Metadata.PathDisplay, req.OldName)
+	target := d.Client.tree.child(newParentDir.Metadata.PathDisplay, req.NewName)
+	if target != nil && source != nil && metadataID(target.metadata) == metadataID(source.metadata) {
+		target = nil
+	}
+	aside := ""
+	if target != nil {
+		if source != nil && source.isDir() != target.isDir() {
+			if target.isDir() {
+				return errIsDir
 			}
+			return errNotDir
 		}
-
-		d.Subdirectories = newDirs
-		movingDir.Name = req.NewName
-		oldPath = movingDir.PathDisplay[:len(movingDir.PathDisplay)-1]
-		movingDir.Metadata.PathDisplay = newParentDir.Metadata.PathDisplay + "/" + req.NewName
-		newPath = newParentDir.Metadata.PathDisplay + req.NewName
-		newParentDir.Subdirectories = append(newParentDir.Subdirectories, movingDir)
-	} else { // Remove file
-		newFiles := []*files.FileMetadata{}
-		movingFile := &files.FileMetadata{}
-		for _, f := range d.Files {
-			if f.Name != req.OldName {
-				newFiles = append(newFiles, f)
-			} else {
-				movingFile = f
+		if target.isDir() {
+			if empty, err := d.Client.node(target).(*Directory).isEmpty(); err != nil {
+				return err
+			} else if !empty {
+				return errNotEmpty
 			}
 		}
-		d.Files = newFiles
-		movingFile.Name = req.NewName
-		oldPath = movingFile.PathDisplay
-		movingFile.Metadata.PathDisplay = newParentDir.Metadata.PathDisplay + "/" + req.NewName
-		newPath = movingFile.Metadata.PathDisplay
-		newParentDir.Files = append(newParentDir.Files, movingFile)
+		// Moved out of the way rather than deleted, so it can go back if
+		// the move fails
+		aside = newParentDir.childPath(fmt.Sprintf(".%s.replaced-%d", req.NewName, time.Now().UnixNano()))
+		if _, err := d.Client.Move(newPath, aside); err != nil {
+			if errno := toErrno(err); errno != fuse.ENOENT {
+				log.Errorln("Unable to replace existing item at", newPath, err)
+				return errno
+			}
+			aside = ""
+		}
 	}
 
 	if _, err := d.Client.Move(oldPath, newPath); err != nil {
-		log.Panicln("Unable to move form oldPath", oldPath, "to new path", newPath, err)
+		log.Errorln("Unable to move form oldPath", oldPath, "to new path", newPath, err)
+		if aside != "" {
+			if _, restoreErr := d.Client.Move(aside, newPath); restoreErr != nil {
+				log.Errorln("Unable to put back", newPath, "left at", aside, restoreErr)
+			}
+		}
+		return toErrno(err)
+	}
+	if aside != "" {
+		if _, err := d.Client.Delete(aside); err != nil {
+			log.Errorln("Unable to delete replaced item left at", aside, err)
+		} else {
+			log.Infoln("Replaced existing item at", newPath)
+		}
 	}
 
 	return nil
@@ -152,26 +205,31 @@ func (d *Directory) Rename(ctx context.Context, req *fuse.RenameRequest, newDir
 
 func (d *Directory) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
 	log.Infoln("Remove request for ", req.Name)
-	if req.Dir {
-		newDirs := []*files.FolderMetadata{}
-		for _, dir := range d.Subdirectories {
-			if dir.Name != req.Name {
-				newDirs = append(newDirs, dir)
-			}
-		}
-		d.Subdirectories = newDirs
-	} else { // Remove file
-		newFiles := []*files.FileMetadata{}
-		for _, f := range d.Files {
-			if f.Name != req.Name {
-				newFiles = append(newFiles, f)
+	if d.Client.readOnly {
+		return errReadOnly
+	}
+	// May have changed kind since the kernel looked it up. An entry keeps
+	// its kind, a file replacing a folder gets an entry of its own.
+	if target := d.Client.tree.child(d.Metadata.PathDisplay, req.Name); target != nil {
+		switch {
+		case req.Dir && !target.isDir():
+			return errNotDir
+		case !req.Dir && target.isDir():
+			// Would delete the folder and everything in it
+			return errIsDir
+		case req.Dir:
+			// Dropbox deletes folders recursively, rmdir(2) must not
+			if empty, err := d.Client.node(target).(*Directory).isEmpty(); err != nil {
+				return err
+			} else if !empty {
+				return errNotEmpty
 			}
 		}
-		d.Files = newFiles
 	}
-	_, err := d.Client.Delete(d.Metadata.PathDisplay + "/" + req.Name)
+	_, err := d.Client.Delete(d.childPath(req.Name))
 	if err != nil {
-		log.Panicln("Unable to delete item at path", d.Metadata.PathDisplay+"/"+req.Name, err)
+		log.Errorln("Unable to delete item at path", d.childPath(req.Name), err)
+		return toErrno(err)
 	}
 
 	return nil
@@ -179,11 +237,16 @@ func (d *Directory) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
 
 func (d *Directory) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, error) {
 	log.Infoln("Mkdir request for name", req.Name)
-	folderMetadata, err := d.Client.Mkdir(d.Metadata.PathDisplay + "/" + req.Name)
-	if err != nil {
-		log.Panicln("Unable to create new directory at path", d.Metadata.PathDisplay+"/"+req.Name, err)
+	if d.Client.readOnly {
+		return nil, errReadOnly
+	}
+	if _, err := d.Client.Mkdir(d.childPath(req.Name)); err != nil {
+		log.Errorln("Unable to create new directory at path", d.childPath(req.Name), err)
+		return nil, toErrno(err)
+	}
+	e := d.Client.tree.child(d.Metadata.PathDisplay, req.Name)
+	if e == nil {
+		return nil, fuse.EIO
 	}
-	newDir := d.Client.NewOrCachedDirectory(folderMetadata)
-	d.Subdirectories = append(d.Subdirectories, newDir.Metadata)
-	return newDir, nil
+	return d.Client.node(e), nil
 }
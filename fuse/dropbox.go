@@ -1,300 +1,434 @@
 package fuse
 
 import (
-	"bytes"
+	"context"
 	"crypto/sha1"
 	"encoding/hex"
-	"encoding/json"
-	"hash/fnv"
-	"io/ioutil"
-	"net/http"
-	"path"
+	"fmt"
+	"io"
+	"os"
 	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	"bazil.org/fuse/fs"
+	"github.com/cenkalti/backoff"
 	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox"
 	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox/files"
-	cmap "github.com/orcaman/concurrent-map"
+	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox/users"
 )
 
+// SyncPolicy says which calls wait for changes to be uploaded.
+type SyncPolicy int
+
+const (
+	// SyncFsync makes fsync wait for the upload and fail if it does.
+	SyncFsync SyncPolicy = iota
+	// SyncClose makes close wait for the upload as well.
+	SyncClose
+	// SyncAsync leaves every upload to the background.
+	SyncAsync
+)
+
+var syncPolicies = map[string]SyncPolicy{
+	"fsync": SyncFsync,
+	"close": SyncClose,
+	"async": SyncAsync,
+}
+
+// ParseSyncPolicy reads a policy given by name: fsync, close or async.
+func ParseSyncPolicy(name string) (SyncPolicy, error) {
+	if p, found := syncPolicies[name]; found {
+		return p, nil
+	}
+	return SyncFsync, fmt.Errorf("unknown sync policy %q, want fsync, close or async", name)
+}
+
+// Seconds a single longpoll call waits for changes.
+const longpollTimeout = 60
+
+// Files larger than this are uploaded in parts of this size. Dropbox takes at
+// most 150 MB in one upload and wants parts in multiples of 4 MiB.
+const uploadPartSize = 2 * blockSize
+
+// How many times in a row Dropbox may correct the offset of an upload session
+// before the attempt is given up on.
+const maxOffsetCorrections = 3
+
 type Dropbox struct {
-	fileClient files.Client
-	rootDir    *Directory
-	pathCache  cmap.ConcurrentMap // map[string]string
-	fileLookup cmap.ConcurrentMap // map[string]*File
-	dirLookup  cmap.ConcurrentMap // map[string]*Directory
+	backend Backend
+	rootDir *Directory
+	tree    *tree
+	store   *Store // nil when the tree isn't saved
+	blocks  *BlockCache
+	uploads *uploader // nil when read-only
+	// refuses changes, set by NewReadOnlyDropbox
+	readOnly bool
+	// which calls wait for uploads, set before serving
+	syncPolicy SyncPolicy
+	started    time.Time // reported as the times of folders, Dropbox has none
+	uid, gid   uint32    // owner of everything, set before serving
+	cursor     string    // recursive cursor the tree is current with
+	space      *users.SpaceUsage
+	spaceAt    time.Time // when space was fetched
+	polling    bool
+	done       chan struct{} // closed to stop background work
 	sync.Mutex
+
+	// Mode of items without a saved one, and the bits taken from every mode,
+	// set before serving
+	defaultMode os.FileMode
+	umask       os.FileMode
+
+	// ID of our property template, empty until found, and when finding it
+	// last failed. Found when first needed and retried until it is.
+	template      string
+	templateTried time.Time
+	templateLock  sync.Mutex
+	findLock      sync.Mutex // one lookup of the templates at a time
+
+	// ID and fields of the template holding user xattrs, created when the
+	// first one is set
+	xattrTemplate string
+	xattrFields   map[string]bool
+	xattrLock     sync.Mutex
 }
 
-func NewDropbox(c files.Client, root *Directory) *Dropbox {
+// NewDropbox serves b with file contents cached in blocks. Changes queued for
+// upload by earlier mounts of the same cache start going up right away.
+// Everything belongs to the user running it unless changed with SetOwner.
+func NewDropbox(b Backend, root *Directory, blocks *BlockCache) *Dropbox {
+	return newDropbox(b, root, blocks, false)
+}
+
+// NewReadOnlyDropbox serves b like NewDropbox, refusing every change with
+// EROFS. Nothing is uploaded, changes queued by earlier mounts stay queued
+// for the next writable one.
+func NewReadOnlyDropbox(b Backend, root *Directory, blocks *BlockCache) *Dropbox {
+	return newDropbox(b, root, blocks, true)
+}
+
+func newDropbox(b Backend, root *Directory, blocks *BlockCache, readOnly bool) *Dropbox {
 	db := &Dropbox{
-		fileClient: c,
-		rootDir:    root,
-		pathCache:  cmap.New(),
-		fileLookup: cmap.New(),
-		dirLookup:  cmap.New(),
+		backend:  b,
+		rootDir:  root,
+		tree:     newTree(root),
+		blocks:   blocks,
+		readOnly: readOnly,
+		started:  time.Now(),
+		uid:      uint32(os.Getuid()),
+		gid:      uint32(os.Getgid()),
+		done:     make(chan struct{}),
+		// Only the owner, as Dropbox has no notion of anyone else
+		defaultMode: 0700,
+	}
+	if err := db.findTemplate(); err != nil {
+		log.Warnln("Unable to find property templates, modes are the default until Dropbox answers", err)
 	}
 	root.Client = db
-	// Start polling for changes
-	// According to https://www.dropboxforum.com/t5/API-Support-Feedback/API-v2-Long-polling/td-p/247873
-	// And official docs this is account wide despite what folder is passed in.
-	go db.getRecursiveCursor("")
+	if !readOnly {
+		db.uploads = newUploader(db, blocks.dir)
+		go db.uploads.run(db.done)
+	}
+	go db.keepPinned()
 	return db
 }
 
-func Inode(s string) uint64 {
-	h := fnv.New32a()
-	h.Write([]byte(s))
-	return uint64(h.Sum32())
+// SetSyncPolicy picks which calls wait for changes to be uploaded. Fsync
+// waits by default.
+func (db *Dropbox) SetSyncPolicy(p SyncPolicy) {
+	db.syncPolicy = p
 }
 
-func (db Dropbox) Root() (fs.Node, error) {
-	return db.rootDir, nil
+// SetOwner picks the user and group reported as owning every file and
+// folder. Changing the owner isn't possible.
+func (db *Dropbox) SetOwner(uid uint32, gid uint32) {
+	db.uid, db.gid = uid, gid
 }
 
-func (db *Dropbox) IsFileCached(f *File) bool {
-	_, found := db.fileLookup.Get(f.Metadata.PathDisplay)
-	return found
+// Close stops polling and uploading. An upload under way is finished first,
+// the rest stay queued for the next mount.
+func (db *Dropbox) Close() {
+	db.Lock()
+	select {
+	case <-db.done:
+	default:
+		close(db.done)
+	}
+	db.Unlock()
+	if db.uploads != nil {
+		<-db.uploads.stopped
+	}
 }
 
-func (db *Dropbox) NewOrCachedFile(metadata *files.FileMetadata) *File {
-	if t, found := db.fileLookup.Get(metadata.PathDisplay); found {
-		f := t.(*File)
-		log.Debugln("Returning cached file", metadata.PathDisplay)
-		return f
-	}
-	log.Debugln("Returning uncached file", metadata.PathDisplay)
-	return &File{
-		Metadata: metadata,
-		Client:   db,
+// Drain waits for the changes queued so far to be uploaded, until ctx is
+// done. Failed uploads are retried right away. Returns how many are left
+// queued.
+func (db *Dropbox) Drain(ctx context.Context) int {
+	if db.uploads == nil {
+		return 0
 	}
+	return db.uploads.drain(ctx)
 }
 
-func (db *Dropbox) IsDirectoryCached(d *Directory) bool {
-	_, found := db.dirLookup.Get(d.Metadata.PathDisplay)
-	return found
+// SetUmask reports items without a saved mode as having every permission
+// bit not in umask, and takes the bits in umask from saved modes, like the
+// umask option of other filesystems. Without it, items without a saved
+// mode are only accessible to their owner.
+func (db *Dropbox) SetUmask(umask os.FileMode) {
+	db.umask = umask & os.ModePerm
+	db.defaultMode = os.ModePerm &^ db.umask
 }
 
-func (db *Dropbox) NewOrCachedDirectory(metadata *files.FolderMetadata) *Directory {
-	t, found := db.dirLookup.Get(metadata.PathDisplay)
-	if found {
-		dir := t.(*Directory)
-		log.Debugln("Returning cached dir", metadata.PathDisplay)
-		return dir
+// StartPolling watches the backend for remote changes in the background.
+func (db *Dropbox) StartPolling() {
+	// Longpolling wakes up for changes covered by the cursor, which is for
+	// the folder served, so changes elsewhere in the account are never fetched.
+	go func() {
+		db.Lock()
+		cursor := db.cursor
+		db.Unlock()
+		if cursor != "" {
+			// Restored, carry on from where the last mount left off
+			db.beginBackgroundPolling(cursor, "")
+			return
+		}
+		if _, err := db.getRecursiveCursor(""); err != nil {
+			log.Errorln("Unable to get cursor for polling", err)
+		}
+	}()
+}
+
+// Restore loads the metadata tree saved in s and catches up on the changes
+// since it was saved. From then on the tree is saved to s as it changes.
+// Refuses a store of another account, see Store.Claim.
+func (db *Dropbox) Restore(s *Store) error {
+	s.Lock()
+	claimed := s.account != ""
+	s.Unlock()
+	if !claimed {
+		if err := s.Claim(db.backend); err != nil {
+			return err
+		}
+	}
+	db.tree.Lock()
+	cursor, err := s.load(db.tree.loadNextInode, db.tree.loadInode, db.tree.load)
+	if err == nil {
+		db.tree.pruneInodes()
 	}
-	log.Debugln("Returning uncached dir", metadata.PathDisplay)
-	return &Directory{
-		Metadata: metadata,
-		Client:   db,
+	db.tree.clearChanges()
+	db.tree.Unlock()
+	if err != nil {
+		return err
+	}
+	db.store = s
+	if cursor == "" {
+		// Listed before a cursor was saved, what changed since is unknown
+		db.tree.unlistAll()
+		db.save("")
+		return nil
 	}
+	log.Infoln("Catching up on changes since cursor", cursorSHA(cursor))
+	nodes, next, err := db.listFolderAll(cursor)
+	switch {
+	case isReset(err):
+		if cursor, err = db.resetCursor(); err != nil {
+			return err
+		}
+	case err != nil:
+		// Serve what we have, polling catches up once Dropbox answers
+		log.Warnln("Unable to catch up on changes, cached metadata may be stale", err)
+	default:
+		db.applyChanges(nodes)
+		cursor = next
+	}
+	db.Lock()
+	db.cursor = cursor
+	db.Unlock()
+	db.save(cursor)
+	return nil
 }
 
-func cursorSHA(s string) string {
-	h := sha1.New()
-	h.Write([]byte(s))
-	sha1_hash := hex.EncodeToString(h.Sum(nil))
-	return sha1_hash
+// save writes the changes to the tree out to the store, along with the cursor
+// they bring it up to if there is one.
+func (db *Dropbox) save(cursor string) {
+	if db.store == nil {
+		return
+	}
+	if err := db.store.save(db.tree, cursor); err != nil {
+		log.Errorln("Unable to save metadata cache", err)
+	}
 }
 
-func longpoll(c string) (map[string]interface{}, bool) {
-	params := map[string]interface{}{"cursor": c, "timeout": 60}
-	jsonData, err := json.Marshal(params)
+// resetCursor replaces a cursor Dropbox expired. Changes since then are lost,
+// so every folder is listed again on next access.
+func (db *Dropbox) resetCursor() (string, error) {
+	log.Warnln("Dropbox reset the cursor, listing folders again")
+	db.tree.unlistAll()
+	cursor, err := db.backend.GetLatestCursor("", true)
 	if err != nil {
-		log.Errorln("Unable to create JSON for longpoll", c, params, err)
-		return nil, true
-	}
-	// Long poll becomes very inefficient for large file counts
-	resp, err := http.Post("https://notify.dropboxapi.com/2/files/list_folder/longpoll", "application/json", bytes.NewBuffer(jsonData))
-	if err != nil {
-		// TODO: retry
-		log.Errorln("Unable to longpoll on cursor", c, err)
-		return nil, true
+		return "", err
 	}
+	db.save(cursor)
+	return cursor, nil
+}
 
-	var output map[string]interface{}
-	outputData, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		// TODO: retry
-		log.Errorln("Unable to extract json from longpoll response on cursor", c, err)
-		return nil, true
+func (db *Dropbox) Root() (fs.Node, error) {
+	return db.rootDir, nil
+}
+
+// node returns the node the kernel knows e by, making one the first time.
+func (db *Dropbox) node(e *entry) fs.Node {
+	db.tree.Lock()
+	defer db.tree.Unlock()
+	if e.node == nil {
+		switch m := e.metadata.(type) {
+		case *files.FileMetadata:
+			f := &File{Metadata: m, Client: db}
+			if db.uploads != nil {
+				db.uploads.attach(f)
+			}
+			e.node = f
+		case *files.FolderMetadata:
+			e.node = &Directory{Metadata: m, Client: db}
+		}
 	}
-	resp.Body.Close()
+	return e.node
+}
 
-	if err := json.Unmarshal(outputData, &output); err != nil {
-		log.Errorln("Unable to extract json map from longpoll response on cursor", c, err)
-		return nil, true
+// fileNode returns the node the kernel knows the file at p by, if any.
+func (db *Dropbox) fileNode(p string) *File {
+	db.tree.Lock()
+	defer db.tree.Unlock()
+	if e := db.tree.byPath[lowerPath("", p)]; e != nil {
+		f, _ := e.node.(*File)
+		return f
 	}
-	return output, false
+	return nil
+}
+
+func cursorSHA(s string) string {
+	h := sha1.New()
+	h.Write([]byte(s))
+	sha1_hash := hex.EncodeToString(h.Sum(nil))
+	return sha1_hash
 }
 
-// Long polling reimplemented due to Dropbox Go SDK having broken implementation
-// Source: https://github.com/dropbox/dropbox-sdk-go-unofficial/issues/7
 func (db *Dropbox) beginBackgroundPolling(cursor, path string) {
-	if _, found := db.pathCache.Get(path); found {
+	db.Lock()
+	if db.polling {
+		db.Unlock()
 		log.Infoln("Polling already running for path ", path)
 		return
 	}
+	db.polling = true
+	db.cursor = cursor
+	db.Unlock()
 	delay := func() {
 		time.Sleep(250 * time.Millisecond)
 	}
 
-	db.pathCache.Set(path, cursor)
 	log.Infof("Starting polling call on path: '%s' for cursor: %s", path, cursorSHA(cursor))
 	go func(c string) {
 		for {
 			// check if we still need to be polling it
+			select {
+			case <-db.done:
+				return
+			default:
+			}
 			log.Infof("Polling call on path: '%s'", path)
 			// Setup consumer of the polling
 			// Setup the async polling
-			output, retry := longpoll(c)
-			if retry {
+			output, err := db.backend.Longpoll(c, longpollTimeout)
+			if isReset(err) {
+				if cursor, err := db.resetCursor(); err == nil {
+					c = cursor
+				}
+			}
+			if err != nil {
+				log.Errorln("Unable to longpoll on cursor", cursorSHA(c), err)
 				delay()
 				continue
 			}
 
-			if output["changes"].(bool) {
+			if output.Changes {
 				log.Infof("Change detected for path: '%s'\n", path)
 				nodes, cursor, err := db.listFolderAll(c)
 				log.Debugf("Nodes %+v", nodes)
+				if isReset(err) {
+					if cursor, err := db.resetCursor(); err == nil {
+						c = cursor
+					}
+				}
 				if err != nil {
 					log.Errorf("Error fetching Dropbox changes %s\n", err)
+					delay()
 					continue
 				}
-				err = db.applyChanges(nodes)
-				if err != nil {
-					log.Errorln("Unable to apply changes", err)
-				}
+				db.applyChanges(nodes)
 				// Follow up with the next cursor
 				log.Debugf("Switching out old cursor(%s) for new one (%s)", cursorSHA(c), cursorSHA(cursor))
 				c = cursor
+				db.Lock()
+				db.cursor = c
+				db.Unlock()
+				db.save(c)
 			} else { // just wait and poll again
-				extraSleep, ok := output["backoff"]
 				time.Sleep(time.Second * 5)
-				if ok {
-					log.Warnln("Dropbox requested backoff for cursor", c, ",", extraSleep, "seconds")
-					time.Sleep(time.Second * time.Duration(extraSleep.(int)))
+				if output.Backoff > 0 {
+					log.Warnln("Dropbox requested backoff for cursor", cursorSHA(c), ",", output.Backoff, "seconds")
+					time.Sleep(time.Second * time.Duration(output.Backoff))
 				}
 			}
 		}
 	}(cursor)
 }
 
-func (db *Dropbox) applyChanges(nodes []files.IsMetadata) error {
+// applyChanges merges changes from the cursor into the tree.
+func (db *Dropbox) applyChanges(nodes []files.IsMetadata) {
 	for _, entry := range nodes {
-		switch v := entry.(type) {
-		case *files.FileMetadata:
-			db.fileLookup.Set(v.PathDisplay, &File{
-				Metadata: v,
-				Client:   db,
-			})
-			// TODO: Merge into parent d.Files slice
-			db.evictParentFolder(v.PathDisplay)
-			log.Debugln("Added file at path", v.PathDisplay)
-		case *files.FolderMetadata:
-			db.dirLookup.Set(v.PathDisplay, &Directory{
-				Metadata: v,
-				Client:   db,
-			})
-			// TODO: Merge into parent d.Files slice
-			db.evictParentFolder(v.PathDisplay)
-			log.Debugln("Added folder at path", v.PathDisplay)
-		case *files.DeletedMetadata:
-			db.fileLookup.Remove(v.PathDisplay)
-			db.dirLookup.Remove(v.PathDisplay)
-			db.evictParentFolder(v.PathDisplay)
-			log.Debugln("Removed item at path", v.PathDisplay)
-		default:
-			log.Errorf("Unhandled change: %+v", v)
-		}
+		_, lower := metadataPaths(entry)
+		log.Debugf("Change at path %s: %T", lower, entry)
 	}
-	return nil
-}
-
-func (db *Dropbox) parentFolder(pathDisplay string) string {
-	parent := path.Dir(pathDisplay)
-	if parent == "." {
-		parent = ""
-	}
-	return parent
-}
-
-// TODO: setup background refresh for these folders
-func (db *Dropbox) evictParentFolder(pathDisplay string) {
-	// TODO: determine correct way to handle this situation
-	// Otherwise the parent is missing/has the added/deleted file
-	parentPathDisplay := db.parentFolder(pathDisplay)
-	db.dirLookup.Remove(parentPathDisplay)
-	log.Infoln("Evicted parent directory at path", parentPathDisplay)
+	db.tree.apply(nodes)
 }
 
 func (db *Dropbox) getRecursiveCursor(path string) (string, error) {
-	input := files.NewListFolderArg(path)
-	input.Limit = 2000
-	input.Recursive = true
-	output, err := db.fileClient.ListFolderGetLatestCursor(input)
+	cursor, err := db.backend.GetLatestCursor(path, true)
 	if err != nil {
 		return "", err
 	}
-	db.beginBackgroundPolling(output.Cursor, path)
-	return output.Cursor, nil
+	db.save(cursor)
+	db.beginBackgroundPolling(cursor, path)
+	return cursor, nil
 }
 
-// lock assumed
 func (db *Dropbox) fetchItems(path string) ([]files.IsMetadata, error) {
 	nodes := []files.IsMetadata{}
 	log.Debugln("Looking up items for path", path)
-	input := files.NewListFolderArg(path)
-	input.Limit = 2000
-	output, err := db.fileClient.ListFolder(input)
+	output, err := db.backend.ListFolder(path, false)
 	if err != nil {
 		return nodes, err
 	}
-
-	metadata := []*files.Metadata{}
-	for _, entry := range output.Entries {
-		nodes = append(nodes, entry)
-		if fileMetadata, isFile := entry.(*files.FileMetadata); isFile {
-			metadata = append(metadata, &fileMetadata.Metadata)
-		} else {
-			folderMetadata := entry.(*files.FolderMetadata)
-			metadata = append(metadata, &folderMetadata.Metadata)
-		}
-	}
+	nodes = append(nodes, output.Entries...)
 
 	for output.HasMore {
 		log.Infoln("Going for another round of fetching for path", path)
-		metadata := []*files.Metadata{}
-		nextInput := files.NewListFolderContinueArg(output.Cursor)
-		output, err = db.fileClient.ListFolderContinue(nextInput)
+		output, err = db.backend.ListFolderContinue(output.Cursor)
 		if err != nil {
 			return nodes, err
 		}
-		for _, entry := range output.Entries {
-			nodes = append(nodes, entry)
-			if fileMetadata, isFile := entry.(*files.FileMetadata); isFile {
-				metadata = append(metadata, &fileMetadata.Metadata)
-			} else {
-				folderMetadata := entry.(*files.FolderMetadata)
-				metadata = append(metadata, &folderMetadata.Metadata)
-			}
-		}
-	}
-
-	if _, found := db.dirLookup.Get(db.rootDir.Metadata.PathDisplay); !found {
-		db.dirLookup.Set(db.rootDir.Metadata.PathDisplay, db.rootDir)
+		nodes = append(nodes, output.Entries...)
 	}
-
 	return nodes, nil
 }
 
 func (db *Dropbox) listFolderAll(cursor string) ([]files.IsMetadata, string, error) {
 	nodes := []files.IsMetadata{}
-	arg := files.NewListFolderContinueArg(cursor)
 	log.Debugln("listFolderAll: starting")
-	output, err := db.fileClient.ListFolderContinue(arg)
+	output, err := db.backend.ListFolderContinue(cursor)
 	if err != nil {
 		log.Errorln("Error with ListFolderContinue", err)
 		return nil, cursor, err
@@ -303,8 +437,7 @@ func (db *Dropbox) listFolderAll(cursor string) ([]files.IsMetadata, string, err
 	nodes = append(nodes, output.Entries...)
 	for output.HasMore {
 		log.Debugln("listFolderAll: fetching more")
-		arg := files.NewListFolderContinueArg(output.Cursor)
-		output, err = db.fileClient.ListFolderContinue(arg)
+		output, err = db.backend.ListFolderContinue(output.Cursor)
 		if err != nil {
 			return nil, cursor, err
 		}
@@ -313,173 +446,270 @@ func (db *Dropbox) listFolderAll(cursor string) ([]files.IsMetadata, string, err
 	return nodes, output.Cursor, nil
 }
 
-func (db *Dropbox) listFolderContinueAll(cursor string) ([]*files.Metadata, string, error) {
-	nodes, c, err := db.listFolderAll(cursor)
+// listFolder fetches the complete listing of the folder at path into the tree.
+func (db *Dropbox) listFolder(path string) error {
+	nodes, err := db.fetchItems(path)
 	if err != nil {
-		log.Errorf("Error with listFolderAll %s", err)
-		return nil, cursor, err
+		return err
 	}
+	db.tree.setListing(path, nodes)
+	db.save("")
+	return nil
+}
 
-	metadata := []*files.Metadata{}
-	for _, entry := range nodes {
-		switch v := entry.(type) {
-		case *files.FileMetadata:
-			metadata = append(metadata, &v.Metadata)
-		case *files.FolderMetadata:
-			metadata = append(metadata, &v.Metadata)
-		case *files.DeletedMetadata:
-			metadata = append(metadata, &v.Metadata)
-		}
+// Upload writes size bytes of content to the file at path, modified at the
+// given time or now if it is zero. With a rev, it only replaces that version
+// of the file and fails with a conflict if the file changed since, without
+// one it overwrites whatever is there.
+func (db *Dropbox) Upload(path string, content io.ReaderAt, size int64, rev string, modified time.Time) (*files.FileMetadata, error) {
+	return db.upload(path, content, size, rev, modified, nil)
+}
+
+// upload is Upload carrying on with the upload session of r, if any.
+func (db *Dropbox) upload(path string, content io.ReaderAt, size int64, rev string, modified time.Time, r *resumable) (*files.FileMetadata, error) {
+	input := files.NewCommitInfo(path)
+	input.Mode = &files.WriteMode{Tagged: dropbox.Tagged{Tag: files.WriteModeOverwrite}}
+	if rev != "" {
+		input.Mode = &files.WriteMode{Tagged: dropbox.Tagged{Tag: files.WriteModeUpdate}, Update: rev}
 	}
-	return metadata, c, nil
+	return db.commit(input, content, size, modified, r)
 }
 
-func (db *Dropbox) listFilesAndFolders(d *Directory) ([]*files.FileMetadata, []*files.FolderMetadata, error) {
-	// Can only reliably be called inside ListFiles or ListFolders
-	path := d.Metadata.PathDisplay
-	out, err := db.fetchItems(path)
-	filesMetadata := []*files.FileMetadata{}
-	folderMetadata := []*files.FolderMetadata{}
-	for _, metadata := range out {
-		switch v := metadata.(type) {
-		case *files.FileMetadata:
-			filesMetadata = append(filesMetadata, v)
-		case *files.FolderMetadata:
-			folderMetadata = append(folderMetadata, v)
+// uploadCopy writes size bytes of content to a new file at path, or next to
+// it with a number added if path is taken.
+func (db *Dropbox) uploadCopy(path string, content io.ReaderAt, size int64, modified time.Time, r *resumable) (*files.FileMetadata, error) {
+	input := files.NewCommitInfo(path)
+	input.Mode = &files.WriteMode{Tagged: dropbox.Tagged{Tag: files.WriteModeAdd}}
+	input.Autorename = true
+	return db.commit(input, content, size, modified, r)
+}
+
+// commit uploads size bytes of content as described by input. Files larger
+// than a single part go up in parts through an upload session, carrying on
+// with the one in r if there is one.
+func (db *Dropbox) commit(input *files.CommitInfo, content io.ReaderAt, size int64, modified time.Time, r *resumable) (*files.FileMetadata, error) {
+	input.Mute = true // don't send user notification on other clients
+	if !modified.IsZero() {
+		// Dropbox only takes whole seconds
+		input.ClientModified = modified.UTC().Truncate(time.Second)
+	}
+	var output *files.FileMetadata
+	var err error
+	if size > uploadPartSize {
+		if r == nil {
+			r = &resumable{}
 		}
+		output, err = db.uploadSession(input, content, size, r)
+	} else {
+		output, err = db.backend.Upload(input, io.NewSectionReader(content, 0, size))
+	}
+	if err != nil {
+		return nil, err
 	}
-	db.dirLookup.Set(path, d)
-	return filesMetadata, folderMetadata, err
+	db.tree.merge(output, true)
+	db.save("")
+	return output, nil
 }
 
-func (db *Dropbox) ListFiles(d *Directory) ([]*files.FileMetadata, error) {
-	fx, _, err := db.listFilesAndFolders(d)
-	return fx, err
+// resumable is an upload session and the offset Dropbox acknowledged in it,
+// kept across attempts at uploading the same contents. saved, if set, is
+// called each time they change.
+type resumable struct {
+	session string
+	offset  int64
+	saved   func(session string, offset int64)
 }
 
-func (db *Dropbox) ListFolders(d *Directory) ([]*files.FolderMetadata, error) {
-	_, folders, err := db.listFilesAndFolders(d)
-	return folders, err
+func (r *resumable) set(session string, offset int64) {
+	r.session, r.offset = session, offset
+	if r.saved != nil {
+		r.saved(session, offset)
+	}
 }
 
-func (db *Dropbox) Upload(path string, data []byte) (*files.FileMetadata, error) {
-	r := bytes.NewReader(data)
-	input := files.NewCommitInfo(path)
-	input.Mute = true // don't send user notification on other clients
-	input.Mode = &files.WriteMode{Tagged: dropbox.Tagged{"overwrite"}}
-	output, err := db.fileClient.Upload(input, r)
-	if err != nil {
-		return nil, err
+// uploadSession uploads content in parts, starting from where r left off. A
+// part that fails is sent again from the offset Dropbox last acknowledged, so
+// an interrupted upload carries on where it left off rather than starting
+// over.
+func (db *Dropbox) uploadSession(commit *files.CommitInfo, content io.ReaderAt, size int64, r *resumable) (*files.FileMetadata, error) {
+	part := func(offset int64) io.Reader {
+		end := offset + uploadPartSize
+		if end > size {
+			end = size
+		}
+		return io.NewSectionReader(content, offset, end-offset)
+	}
+	retry := backoff.NewExponentialBackOff()
+	session, offset := r.session, r.offset
+	if offset > size {
+		session, offset = "", 0
 	}
-	fileT, cached := db.fileLookup.Get(path)
+	corrections := 0
+	for {
+		var output *files.FileMetadata
+		var err error
+		switch {
+		case session == "":
+			if session, err = db.backend.UploadSessionStart(part(0)); err == nil {
+				offset = uploadPartSize
+			}
+		case offset+uploadPartSize >= size:
+			if output, err = db.backend.UploadSessionFinish(session, uint64(offset), commit, part(offset)); err == nil {
+				return output, nil
+			}
+		default:
+			if err = db.backend.UploadSessionAppend(session, uint64(offset), part(offset)); err == nil {
+				offset += uploadPartSize
+			}
+		}
+		if err == nil {
+			r.set(session, offset)
+			retry.Reset()
+			corrections = 0
+			continue
+		}
 
-	// if cached update to latest path
-	if cached {
-		db.Lock()
-		db.fileLookup.Remove(path)
-		file := fileT.(*File)
-		file.Metadata = output
-		db.fileLookup.Set(file.Metadata.PathDisplay, file)
-		db.Unlock()
+		lookup := sessionLookup(err)
+		switch {
+		case lookup != nil && lookup.IncorrectOffset != nil && int64(lookup.IncorrectOffset.CorrectOffset) <= size:
+			if corrections == maxOffsetCorrections {
+				// Not getting anywhere, the next attempt starts over
+				log.Errorln("Giving up on upload session for", commit.Path, "after", corrections, "offset corrections")
+				r.set("", 0)
+				return nil, err
+			}
+			// An earlier part arrived after all, its answer didn't
+			corrections++
+			offset = int64(lookup.IncorrectOffset.CorrectOffset)
+			r.set(session, offset)
+			log.Infoln("Resuming upload of", commit.Path, "at offset", offset)
+			continue
+		case lookup != nil:
+			// Expired or closed, start over
+			log.Warnln("Upload session for", commit.Path, "is gone, starting over:", err)
+			session, offset = "", 0
+			r.set(session, offset)
+		case !retryable(err):
+			return nil, err
+		}
+		wait := retry.NextBackOff()
+		if wait == backoff.Stop {
+			return nil, err
+		}
+		log.Errorf("Retrying upload of %s at offset %d in %s due to %s\n", commit.Path, offset, wait, err)
+		time.Sleep(wait)
 	}
-	return output, nil
+}
+
+// refresh fetches the metadata of the file or folder at p again, for when
+// what the tree holds for it can't be trusted.
+func (db *Dropbox) refresh(p string) {
+	m, err := db.backend.GetMetadata(p)
+	if err != nil {
+		// The cursor brings what changed
+		log.Warnln("Unable to refresh metadata of", p, err)
+		return
+	}
+	db.tree.replace(m)
+	db.save("")
 }
 
 func (db *Dropbox) Move(oldPath string, newPath string) (files.IsMetadata, error) {
-	input := files.NewRelocationArg(oldPath, newPath)
-	output, err := db.fileClient.MoveV2(input)
+	output, err := db.backend.Move(oldPath, newPath)
 	if err != nil {
 		return nil, err
 	}
-	db.fileLookup.Remove(oldPath)
-	db.dirLookup.Remove(oldPath)
-	return output.Metadata, nil
+	db.uploads.moved(oldPath, newPath, output)
+	db.tree.merge(output, true)
+	db.save("")
+	return output, nil
 }
 
 func (db *Dropbox) Delete(path string) (files.IsMetadata, error) {
-	input := files.NewDeleteArg(path)
-	output, err := db.fileClient.DeleteV2(input)
+	output, err := db.backend.Delete(path)
 	if err != nil {
 		return nil, err
 	}
-	db.fileLookup.Remove(path)
-	db.dirLookup.Remove(path)
-	return output.Metadata, nil
-
+	// Marks open files removed first, so they don't queue again once closed
+	db.tree.remove(path)
+	db.uploads.removed(path)
+	db.save("")
+	return output, nil
 }
 
 func (db *Dropbox) Mkdir(path string) (*files.FolderMetadata, error) {
-	input := files.NewCreateFolderArg(path)
-	output, err := db.fileClient.CreateFolderV2(input)
+	output, err := db.backend.Mkdir(path)
 	if err != nil {
 		return nil, err
 	}
-	db.dirLookup.Set(output.Metadata.PathDisplay, &Directory{Metadata: output.Metadata, Client: db})
-	return output.Metadata, nil
-}
-
-func (db *Dropbox) Download(path string) ([]byte, error) {
-	input := files.NewDownloadArg(path)
-	_, content, err := db.fileClient.Download(input)
-	if err != nil {
-		return []byte{}, err
-	}
-	defer content.Close()
-	return ioutil.ReadAll(content)
-}
-
-// Credit: https://gist.github.com/unakatsuo/0dcab7898d092d87a77d684f3e71621b
-// Cursor api calls do not use auth headers because it's baked into the cursor itself.
-type noauthTransport struct {
-	http.Transport
-}
-
-func (t *noauthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
-	req.Header.Del("Authorization")
-	return t.Transport.RoundTrip(req)
-}
-
-func newNoAuthClient() *http.Client {
-	return &http.Client{
-		Transport: &noauthTransport{},
+	// A new folder is empty, no need to list it
+	if e := db.tree.merge(output, true); e != nil {
+		db.tree.markListed(e)
 	}
+	db.save("")
+	return output, nil
 }
 
-// End credit
-
-// TODO: switch this fn in for existing folder polling method
-// this uses the existing dropbox sdk with noAuth shim instead of needing
-// to roll our own with http client.
-func (db *Dropbox) FolderPoll(cursor string, c chan []files.IsMetadata) error {
-	for {
-		noauthdbx := files.New(dropbox.Config{Client: newNoAuthClient()})
-		req := files.NewListFolderLongpollArg(cursor)
-		res, err := noauthdbx.ListFolderLongpoll(req)
-		if err != nil {
-			return err
-		}
-		if res.Backoff > 0 {
-			time.Sleep(time.Duration(res.Backoff) * time.Second)
+// fetchBlocks makes sure blocks [from, to) of the contents described by m
+// are cached, downloading the missing ones in as few ranges as it can.
+func (db *Dropbox) fetchBlocks(m *files.FileMetadata, from int64, to int64) error {
+	key := cacheKey(m)
+	var waits []<-chan struct{}
+	var runs [][2]int64
+	for i := from; i < to; i++ {
+		if db.blocks.has(key, i) {
+			continue
 		}
-		// Continue using the same cursor to check for changes
-		if !res.Changes {
+		wait, mine := db.blocks.claim(key, i)
+		if !mine {
+			// Already on its way
+			waits = append(waits, wait)
 			continue
 		}
-		log.Infoln("There is a change")
-		req2 := files.NewListFolderContinueArg(cursor)
-		res2, err := db.fileClient.ListFolderContinue(req2)
-		if err != nil {
-			return err
+		if n := len(runs); n > 0 && runs[n-1][1] == i {
+			runs[n-1][1]++
+		} else {
+			runs = append(runs, [2]int64{i, i + 1})
 		}
-		c <- res2.Entries
-		for res2.HasMore {
-			req2 = files.NewListFolderContinueArg(res2.Cursor)
-			res2, err = db.fileClient.ListFolderContinue(req2)
-			if err != nil {
-				return err
-			}
-			c <- res2.Entries
+	}
+	var err error
+	for _, run := range runs {
+		if err == nil {
+			err = db.download(m, run[0], run[1])
 		}
-		cursor = res2.Cursor
+		for i := run[0]; i < run[1]; i++ {
+			db.blocks.unclaim(key, i)
+		}
+	}
+	for _, wait := range waits {
+		<-wait
+	}
+	if err != nil {
+		return err
+	}
+	for i := from; i < to; i++ {
+		if !db.blocks.has(key, i) {
+			return errNotCached
+		}
+	}
+	return nil
+}
+
+// download caches blocks [from, to) of the contents described by m.
+func (db *Dropbox) download(m *files.FileMetadata, from int64, to int64) error {
+	offset, length := from*blockSize, (to-from)*blockSize
+	if offset+length >= int64(m.Size) {
+		length = 0 // to the end
+	}
+	log.Debugf("Downloading blocks %d-%d of %s", from, to-1, m.PathDisplay)
+	current, content, err := db.backend.Download(m.PathDisplay, offset, length)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+	if current != nil && m.ContentHash != "" && current.ContentHash != m.ContentHash {
+		// Changed since, the new metadata arrives with the cursor
+		return errContentHash
 	}
+	return db.blocks.fill(cacheKey(m), int64(m.Size), m.ContentHash, from, content, to-from)
 }
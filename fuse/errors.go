@@ -0,0 +1,227 @@
+package fuse
+
+import (
+	"net/url"
+	"strings"
+	"syscall"
+
+	"bazil.org/fuse"
+	"github.com/cenkalti/backoff"
+	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox"
+	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox/auth"
+	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox/files"
+)
+
+var (
+	errNoSpace  = fuse.Errno(syscall.ENOSPC)
+	errTryAgain = fuse.Errno(syscall.EAGAIN)
+	errAccess   = fuse.Errno(syscall.EACCES)
+	errNotEmpty = fuse.Errno(syscall.ENOTEMPTY)
+	errInvalid  = fuse.Errno(syscall.EINVAL)
+	errReadOnly = fuse.Errno(syscall.EROFS)
+	errIsDir    = fuse.Errno(syscall.EISDIR)
+	errNotDir   = fuse.Errno(syscall.ENOTDIR)
+	// Dropbox can't keep it
+	errNotSupported = fuse.Errno(syscall.ENOTSUP)
+)
+
+// Errnos for the tags of the lookup and write errors most endpoint errors
+// come down to.
+var (
+	lookupErrnos = map[string]fuse.Errno{
+		files.LookupErrorNotFound:          fuse.ENOENT,
+		files.LookupErrorNotFile:           errIsDir,
+		files.LookupErrorNotFolder:         errNotDir,
+		files.LookupErrorRestrictedContent: errAccess,
+	}
+	writeErrnos = map[string]fuse.Errno{
+		files.WriteErrorConflict:               fuse.EEXIST,
+		files.WriteErrorNoWritePermission:      errAccess,
+		files.WriteErrorInsufficientSpace:      errNoSpace,
+		files.WriteErrorTooManyWriteOperations: errTryAgain,
+	}
+)
+
+// Dropbox error summaries look like "path/not_found/..", these are the parts
+// we can map onto an errno, for errors without a type saying as much. Checked
+// in order.
+var summaryErrnos = []struct {
+	part  string
+	errno fuse.Errno
+}{
+	{"not_found", fuse.ENOENT},
+	{"insufficient_space", errNoSpace},
+	{"too_many_write_operations", errTryAgain},
+	{"too_many_requests", errTryAgain},
+	{"conflict", fuse.EEXIST},
+	{"not_empty", errNotEmpty},
+	{"no_write_permission", errAccess},
+	// More fields than a property template takes
+	{"too_many_properties", errNoSpace},
+	{"property_field_too_large", fuse.ERANGE},
+}
+
+// toErrno maps an error from the backend to the errno the kernel should see.
+func toErrno(err error) error {
+	switch e := err.(type) {
+	case nil:
+		return nil
+	case fuse.ErrorNumber:
+		return err
+	case *backoff.PermanentError:
+		return toErrno(e.Err)
+	case auth.AuthAPIError, auth.AccessAPIError:
+		return errAccess
+	case auth.RateLimitAPIError:
+		return errTryAgain
+	}
+	if errno, known := endpointErrno(err); known {
+		return errno
+	}
+	summary := err.Error()
+	for _, s := range summaryErrnos {
+		if strings.Contains(summary, s.part) {
+			return s.errno
+		}
+	}
+	return fuse.EIO
+}
+
+// endpointErrno maps the typed errors of the files endpoints we call,
+// reporting whether err is one whose tag says more than "other".
+func endpointErrno(err error) (fuse.Errno, bool) {
+	switch e := err.(type) {
+	case files.GetMetadataAPIError:
+		if e.EndpointError != nil {
+			return lookupErrno(e.EndpointError.Path)
+		}
+	case files.DownloadAPIError:
+		if e.EndpointError != nil {
+			return lookupErrno(e.EndpointError.Path)
+		}
+	case files.ListFolderAPIError:
+		if e.EndpointError != nil {
+			return lookupErrno(e.EndpointError.Path)
+		}
+	case files.ListFolderGetLatestCursorAPIError:
+		if e.EndpointError != nil {
+			return lookupErrno(e.EndpointError.Path)
+		}
+	case files.ListFolderContinueAPIError:
+		if e.EndpointError != nil {
+			return lookupErrno(e.EndpointError.Path)
+		}
+	case files.UploadAPIError:
+		if e.EndpointError != nil && e.EndpointError.Path != nil {
+			return writeErrno(e.EndpointError.Path.Reason)
+		}
+	case files.UploadSessionFinishAPIError:
+		if e.EndpointError != nil {
+			return writeErrno(e.EndpointError.Path)
+		}
+	case files.CreateFolderV2APIError:
+		if e.EndpointError != nil {
+			return writeErrno(e.EndpointError.Path)
+		}
+	case files.DeleteV2APIError:
+		if e := e.EndpointError; e != nil {
+			switch e.Tag {
+			case files.DeleteErrorPathLookup:
+				return lookupErrno(e.PathLookup)
+			case files.DeleteErrorPathWrite:
+				return writeErrno(e.PathWrite)
+			case files.DeleteErrorTooManyWriteOperations:
+				return errTryAgain, true
+			}
+		}
+	case files.MoveV2APIError:
+		if e := e.EndpointError; e != nil {
+			switch e.Tag {
+			case files.RelocationErrorFromLookup:
+				return lookupErrno(e.FromLookup)
+			case files.RelocationErrorFromWrite:
+				return writeErrno(e.FromWrite)
+			case files.RelocationErrorTo:
+				return writeErrno(e.To)
+			case files.RelocationErrorInsufficientQuota:
+				return errNoSpace, true
+			case files.RelocationErrorCantMoveFolderIntoItself:
+				return errInvalid, true
+			}
+		}
+	}
+	return 0, false
+}
+
+func lookupErrno(e *files.LookupError) (fuse.Errno, bool) {
+	if e == nil {
+		return 0, false
+	}
+	errno, known := lookupErrnos[e.Tag]
+	return errno, known
+}
+
+func writeErrno(e *files.WriteError) (fuse.Errno, bool) {
+	if e == nil {
+		return 0, false
+	}
+	errno, known := writeErrnos[e.Tag]
+	return errno, known
+}
+
+// isReset reports whether Dropbox expired the cursor, so it has to be replaced
+// and everything listed with it fetched again.
+func isReset(err error) bool {
+	return err != nil && strings.HasPrefix(err.Error(), "reset")
+}
+
+// isConflict reports whether Dropbox refused a write because something else
+// is at the path, or a different version of the file than the one given.
+func isConflict(err error) bool {
+	return err != nil && toErrno(err) == fuse.EEXIST
+}
+
+// isGroupExists reports whether Dropbox refused to add a property group the
+// item already has.
+func isGroupExists(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "property_group_already_exists")
+}
+
+// sessionLookup returns what was wrong with the upload session an upload
+// part was sent to, or nil for other errors.
+func sessionLookup(err error) *files.UploadSessionLookupError {
+	switch e := err.(type) {
+	case files.UploadSessionAppendAPIError:
+		// What the SDK returns for append_v2 too
+		return e.EndpointError
+	case files.UploadSessionAppendV2APIError:
+		return e.EndpointError
+	case files.UploadSessionFinishAPIError:
+		if e.EndpointError != nil {
+			return e.EndpointError.LookupFailed
+		}
+	}
+	return nil
+}
+
+// retryable reports whether err is worth retrying: being told to slow down,
+// server errors and network trouble. Anything else is an answer from Dropbox
+// that won't change by asking again.
+func retryable(err error) bool {
+	if err == errNotCached {
+		return true
+	}
+	switch err.(type) {
+	case auth.RateLimitAPIError, dropbox.APIError, *url.Error:
+		return true
+	}
+	return toErrno(err) == errTryAgain
+}
+
+// permanent stops backoff from retrying errors that won't go away.
+func permanent(err error) error {
+	if err == nil || retryable(err) {
+		return err
+	}
+	return backoff.Permanent(err)
+}
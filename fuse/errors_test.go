@@ -0,0 +1,84 @@
+package fuse
+
+import (
+	"errors"
+	"testing"
+
+	"bazil.org/fuse"
+	"github.com/cenkalti/backoff"
+	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox"
+	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox/auth"
+	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox/files"
+)
+
+func tag(t string) dropbox.Tagged {
+	return dropbox.Tagged{Tag: t}
+}
+
+func lookupError(t string) *files.LookupError {
+	return &files.LookupError{Tagged: tag(t)}
+}
+
+func writeError(t string) *files.WriteError {
+	return &files.WriteError{Tagged: tag(t)}
+}
+
+func TestToErrno(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want error
+	}{
+		{"nil", nil, nil},
+		{"errno", errNotEmpty, errNotEmpty},
+		{"metadata not found", files.GetMetadataAPIError{
+			EndpointError: &files.GetMetadataError{Tagged: tag("path"), Path: lookupError(files.LookupErrorNotFound)},
+		}, fuse.ENOENT},
+		{"download not a file", files.DownloadAPIError{
+			EndpointError: &files.DownloadError{Tagged: tag("path"), Path: lookupError(files.LookupErrorNotFile)},
+		}, errIsDir},
+		{"move source not found", files.MoveV2APIError{
+			EndpointError: &files.RelocationError{Tagged: tag(files.RelocationErrorFromLookup), FromLookup: lookupError(files.LookupErrorNotFound)},
+		}, fuse.ENOENT},
+		{"move target conflict", files.MoveV2APIError{
+			EndpointError: &files.RelocationError{Tagged: tag(files.RelocationErrorTo), To: writeError(files.WriteErrorConflict)},
+		}, fuse.EEXIST},
+		{"mkdir conflict", files.CreateFolderV2APIError{
+			EndpointError: &files.CreateFolderError{Tagged: tag("path"), Path: writeError(files.WriteErrorConflict)},
+		}, fuse.EEXIST},
+		{"upload conflict", files.UploadAPIError{
+			EndpointError: &files.UploadError{Tagged: tag("path"), Path: &files.UploadWriteFailed{Reason: writeError(files.WriteErrorConflict)}},
+		}, fuse.EEXIST},
+		{"upload insufficient space", files.UploadAPIError{
+			EndpointError: &files.UploadError{Tagged: tag("path"), Path: &files.UploadWriteFailed{Reason: writeError(files.WriteErrorInsufficientSpace)}},
+		}, errNoSpace},
+		{"move insufficient quota", files.MoveV2APIError{
+			EndpointError: &files.RelocationError{Tagged: tag(files.RelocationErrorInsufficientQuota)},
+		}, errNoSpace},
+		{"too many requests", auth.RateLimitAPIError{}, errTryAgain},
+		{"too many write operations", files.DeleteV2APIError{
+			EndpointError: &files.DeleteError{Tagged: tag(files.DeleteErrorTooManyWriteOperations)},
+		}, errTryAgain},
+		{"no write permission", files.DeleteV2APIError{
+			EndpointError: &files.DeleteError{Tagged: tag(files.DeleteErrorPathWrite), PathWrite: writeError(files.WriteErrorNoWritePermission)},
+		}, errAccess},
+		{"expired token", auth.AuthAPIError{}, errAccess},
+		{"retries given up", backoff.Permanent(auth.AccessAPIError{}), errAccess},
+		{"other", files.DeleteV2APIError{
+			APIError:      dropbox.APIError{ErrorSummary: "other/..."},
+			EndpointError: &files.DeleteError{Tagged: tag("other")},
+		}, fuse.EIO},
+		{"other with a telling summary", files.UploadAPIError{
+			APIError:      dropbox.APIError{ErrorSummary: "path/insufficient_space/..."},
+			EndpointError: &files.UploadError{Tagged: tag("other")},
+		}, errNoSpace},
+		{"property template full", dropbox.APIError{ErrorSummary: "too_many_properties/"}, errNoSpace},
+		{"server error", dropbox.APIError{ErrorSummary: "Internal Server Error"}, fuse.EIO},
+		{"network", errors.New("connection reset by peer"), fuse.EIO},
+	}
+	for _, test := range tests {
+		if got := toErrno(test.err); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
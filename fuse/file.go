@@ -1,6 +1,9 @@
 package fuse
 
 import (
+	"io"
+	"os"
+	"path/filepath"
 	"sync"
 	"time"
 
@@ -12,133 +15,389 @@ import (
 
 	"bazil.org/fuse"
 	"bazil.org/fuse/fs"
-	"bazil.org/fuse/fuseutil"
 	"github.com/cenkalti/backoff"
 )
 
+// Most blocks read ahead of a reader going through a file in order.
+const maxReadahead = 16
+
 type File struct {
 	Metadata    *files.FileMetadata
-	Data        []byte
 	NeedsUpload bool
 	Client      *Dropbox
+	local       *os.File // copy holding the local changes, nil while clean
+	base        string   // rev the local changes are made to
+	writes      uint64   // counts writes, to tell whether an upload is stale
+	removed     bool     // deleted through the mount, changes stay local
+	lastBlock   int64    // last block read, to spot reading in order
+	ahead       int64    // blocks to read ahead
 	sync.Mutex
 }
 
-func (f *File) populateFile() {
-	if f.Client.IsFileCached(f) {
-		log.Infoln("File", f.Metadata.PathDisplay, "cached. Not refreshing it.")
-		return
+// cacheKey names the blocks of the contents described by m.
+func cacheKey(m *files.FileMetadata) string {
+	if m.ContentHash != "" {
+		return m.ContentHash
 	}
-	retryNotice := func(err error, duration time.Duration) {
-		log.Errorf("Retrying %s in %s due to %s\n", f.Metadata.PathDisplay, err, duration)
+	return "rev-" + m.Rev
+}
+
+// readRemote reads size bytes at off of the contents described by m from the
+// block cache, downloading blocks that aren't cached, and reads ahead in the
+// background while the file is read in order.
+func (f *File) readRemote(ctx context.Context, m *files.FileMetadata, off int64, size int) ([]byte, error) {
+	if off < int64(m.Size) && size > 0 {
+		first, last := off/blockSize, (off+int64(size)-1)/blockSize
+		if ahead := f.readahead(first, last); ahead > 0 {
+			from, to := last+1, last+1+ahead
+			if blocks := blockCount(m.Size); to > blocks {
+				to = blocks
+			}
+			go func() {
+				if err := f.Client.fetchBlocks(m, from, to); err != nil {
+					log.Debugln("Unable to read ahead in", m.PathDisplay, err)
+				}
+			}()
+		}
 	}
-	err := backoff.RetryNotify(func() error {
-		data, err := f.Client.Download(f.Metadata.PathDisplay)
+	return f.readBlocks(ctx, m, off, size)
+}
+
+// readahead works out how many blocks to fetch past a read of blocks
+// [first, last]. Doubles each time the reader moves on to the next block and
+// drops back to none when it jumps elsewhere.
+func (f *File) readahead(first int64, last int64) int64 {
+	f.Lock()
+	defer f.Unlock()
+	defer func() { f.lastBlock = last }()
+	switch first {
+	case f.lastBlock:
+		// Still in the same block, already read ahead
+		return 0
+	case f.lastBlock + 1:
+		f.ahead *= 2
+		if f.ahead == 0 {
+			f.ahead = 1
+		}
+		if limit := f.Client.blocks.window() - 1; f.ahead > limit {
+			f.ahead = limit
+		}
+		if f.ahead > maxReadahead {
+			f.ahead = maxReadahead
+		}
+	default:
+		f.ahead = 0
+	}
+	return f.ahead
+}
 
+// readBlocks reads size bytes at off of the contents described by m from the
+// block cache, downloading blocks that aren't cached.
+func (f *File) readBlocks(ctx context.Context, m *files.FileMetadata, off int64, size int) ([]byte, error) {
+	if off >= int64(m.Size) {
+		return nil, nil
+	}
+	end := off + int64(size)
+	if end > int64(m.Size) {
+		end = int64(m.Size)
+	}
+	buf := make([]byte, end-off)
+	for pos := off; pos < end; {
+		n, err := f.readBlock(ctx, m, pos/blockSize, buf[pos-off:], pos%blockSize)
 		if err != nil {
-			return err
+			return nil, err
 		}
+		pos += int64(n)
+	}
+	return buf, nil
+}
 
-		f.Lock()
-		f.setData(data)
-		f.Metadata.Size = uint64(len(data))
-		f.NeedsUpload = false
-		f.Unlock()
+func (f *File) readBlock(ctx context.Context, m *files.FileMetadata, index int64, p []byte, off int64) (int, error) {
+	blocks := f.Client.blocks
+	if n, found := blocks.readAt(cacheKey(m), index, p, off); found && n > 0 {
+		return n, nil
+	}
+	retryNotice := func(err error, duration time.Duration) {
+		log.Errorf("Retrying %s in %s due to %s\n", m.PathDisplay, err, duration)
+	}
+	var n int
+	err := backoff.RetryNotify(func() error {
+		if err := f.Client.fetchBlocks(m, index, index+1); err != nil {
+			return permanent(err)
+		}
+		var found bool
+		if n, found = blocks.readAt(cacheKey(m), index, p, off); !found || n == 0 {
+			return errNotCached
+		}
 		return nil
-	}, backoff.NewExponentialBackOff(), retryNotice)
+	}, backoff.WithContext(backoff.NewExponentialBackOff(), ctx), retryNotice)
 
 	if err != nil {
-		// TODO: retry
-		log.Panicln("Unable to download file and retries failed", f.Metadata.PathDisplay, err)
+		log.Errorln("Unable to download file and retries failed", m.PathDisplay, err)
+		return 0, toErrno(err)
 	}
+	return n, nil
 }
 
-func (f *File) getData() []byte {
-	return f.Data
+// openLocal copies the file to local disk for writing, unless it already is.
+// lock assumed
+func (f *File) openLocal(ctx context.Context) error {
+	return f.openLocalUpTo(ctx, int64(f.Metadata.Size))
 }
 
-func (f *File) setData(data []byte) {
-	f.Data = data
+// openLocalUpTo is openLocal copying no more than about size bytes, for when
+// the rest is about to be cut off.
+// lock assumed
+func (f *File) openLocalUpTo(ctx context.Context, size int64) error {
+	if f.local != nil {
+		return nil
+	}
+	local, err := f.Client.blocks.localCopy()
+	if err != nil {
+		log.Errorln("Unable to make local copy of", f.Metadata.PathDisplay, err)
+		return fuse.EIO
+	}
+	for off := int64(0); off < size && off < int64(f.Metadata.Size); off += blockSize {
+		data, err := f.readBlocks(ctx, f.Metadata, off, blockSize)
+		if err == nil {
+			_, err = local.WriteAt(data, off)
+		}
+		if err != nil {
+			local.Close()
+			os.Remove(local.Name())
+			return toErrno(err)
+		}
+	}
+	f.local, f.base = local, f.Metadata.Rev
+	return nil
+}
+
+// closeLocal drops the local copy once its changes are uploaded.
+// lock assumed
+func (f *File) closeLocal() {
+	if f.local == nil {
+		return
+	}
+	f.local.Close()
+	os.Remove(f.local.Name())
+	f.local = nil
 }
 
 func (f *File) Attr(ctx context.Context, a *fuse.Attr) error {
 	log.Infoln("Requested Attr for File", f.Metadata.PathDisplay)
-	a.Inode = Inode(f.Metadata.Id)
-	// TODO: fetch Mode from Dropbox if available
-	a.Mode = 0700
+	a.Inode = f.Client.tree.inode(f.Metadata.Id)
+	a.Mode = f.Client.mode(f.Metadata.PropertyGroups)
+	a.Uid, a.Gid = f.Client.uid, f.Client.gid
 	a.Size = f.Metadata.Size
+	a.Mtime = f.Metadata.ClientModified
+	a.Atime = a.Mtime
+	a.Ctime = f.Metadata.ServerModified
 	return nil
 }
 
 func (f *File) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
 	log.Infoln("Requested Read on File", f.Metadata.PathDisplay)
-	f.populateFile()
-	fuseutil.HandleRead(req, resp, f.getData())
+	f.Lock()
+	if f.local != nil {
+		defer f.Unlock()
+		buf := make([]byte, req.Size)
+		n, err := f.local.ReadAt(buf, req.Offset)
+		if err != nil && err != io.EOF {
+			log.Errorln("Unable to read local copy of", f.Metadata.PathDisplay, err)
+			return fuse.EIO
+		}
+		resp.Data = buf[:n]
+		return nil
+	}
+	m := f.Metadata
+	f.Unlock()
+	data, err := f.readRemote(ctx, m, req.Offset, req.Size)
+	if err != nil {
+		return err
+	}
+	resp.Data = data
 	return nil
 }
 
-func (f *File) ReadAll(ctx context.Context) ([]byte, error) {
-	log.Infoln("Reading all of file", f.Metadata.PathDisplay)
-	f.populateFile()
-	return f.getData(), nil
-}
-
 func (f *File) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
 	log.Infoln("Trying to write to ", f.Metadata.PathDisplay, "offset", req.Offset, "dataSize:", len(req.Data))
+	if f.Client.readOnly {
+		return errReadOnly
+	}
 	f.Lock()
 	defer f.Unlock()
-	oldData := f.getData()
+	if err := f.openLocal(ctx); err != nil {
+		return err
+	}
+	if _, err := f.local.WriteAt(req.Data, req.Offset); err != nil {
+		log.Errorln("Unable to write local copy of", f.Metadata.PathDisplay, err)
+		return fuse.EIO
+	}
 	resp.Size = len(req.Data)
-	newData := oldData[:req.Offset]
-	newData = append(newData, req.Data...)
-	if secondOffset := int64(len(req.Data)) + req.Offset; secondOffset < int64(len(oldData)) {
-		newData = append(newData, oldData[secondOffset:]...)
+	if end := uint64(req.Offset) + uint64(len(req.Data)); end > f.Metadata.Size {
+		f.Metadata.Size = end
 	}
-	f.setData(newData)
-	f.Metadata.Size = uint64(len(newData))
+	f.Metadata.ClientModified = time.Now().UTC().Truncate(time.Second)
 	f.NeedsUpload = true
+	f.writes++
 	log.Infoln("Wrote to file locally", f.Metadata.PathDisplay)
 	return nil
 }
+
+// Setattr changes the size, modification time and mode. Dropbox only takes a
+// modification time along with the contents, so they are uploaded again.
+// Modes are kept in file properties, the owner can't change.
+func (f *File) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+	log.Infoln("Setattr call on file", f.Metadata.PathDisplay)
+	if f.Client.readOnly {
+		return errReadOnly
+	}
+	if err := f.Client.checkOwner(req); err != nil {
+		return err
+	}
+	if req.Valid.Mode() {
+		f.Lock()
+		p, groups := f.Metadata.PathDisplay, f.Metadata.PropertyGroups
+		f.Unlock()
+		// Takes the tree's lock, which comes before ours
+		if err := f.Client.setMode(p, groups, req.Mode); err != nil {
+			log.Errorln("Unable to change mode of", p, err)
+			return toErrno(err)
+		}
+	}
+	var mtime time.Time
+	switch {
+	case req.Valid.MtimeNow():
+		mtime = time.Now()
+	case req.Valid.Mtime():
+		mtime = req.Mtime
+	}
+	mtime = mtime.UTC().Truncate(time.Second)
+	f.Lock()
+	defer f.Unlock()
+	changed := false
+	if req.Valid.Size() && req.Size != f.Metadata.Size {
+		if err := f.openLocalUpTo(ctx, int64(req.Size)); err != nil {
+			return err
+		}
+		if err := f.local.Truncate(int64(req.Size)); err != nil {
+			log.Errorln("Unable to resize local copy of", f.Metadata.PathDisplay, err)
+			return fuse.EIO
+		}
+		f.Metadata.Size = req.Size
+		if mtime.IsZero() {
+			mtime = time.Now().UTC().Truncate(time.Second)
+		}
+		changed = true
+	}
+	// Dropbox can only change the time by uploading the whole file again, so
+	// a time it already has, as rsync -t sets on unchanged files, is left be
+	if !mtime.IsZero() && !mtime.Equal(f.Metadata.ClientModified) {
+		if err := f.openLocal(ctx); err != nil {
+			return err
+		}
+		f.Metadata.ClientModified = mtime
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+	f.NeedsUpload = true
+	f.writes++
+	if req.Valid.Handle() {
+		// Open, the release queues it
+		return nil
+	}
+	// truncate(2) and utimes(2) needn't open the file, so no release follows
+	_, _, err := f.queue()
+	return err
+}
+
+// checkOwner refuses to change the owner to anyone but who everything is
+// reported to belong to.
+func (db *Dropbox) checkOwner(req *fuse.SetattrRequest) error {
+	if (req.Valid.Uid() && req.Uid != db.uid) || (req.Valid.Gid() && req.Gid != db.gid) {
+		return fuse.EPERM
+	}
+	return nil
+}
+
+// Flush waits for the changes to be uploaded under SyncClose, so close
+// reports whether they made it.
 func (f *File) Flush(ctx context.Context, req *fuse.FlushRequest) error {
 	log.Infoln("Flushing file", f.Metadata.PathDisplay)
-	return nil
+	if f.Client.syncPolicy != SyncClose {
+		return nil
+	}
+	return f.commit(ctx)
 }
 func (f *File) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
 	log.Infoln("Open call on file", f.Metadata.PathDisplay)
-	f.populateFile()
+	if f.Client.readOnly && !req.Flags.IsReadOnly() {
+		return nil, errReadOnly
+	}
 	return f, nil
 }
 
-// Can this be done asynchronously?
+// Release queues the local changes for upload. They are saved to the upload
+// journal first, so they go up even if the mount doesn't last that long.
 func (f *File) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
 	log.Infoln("Release requested on file", f.Metadata.PathDisplay)
-	if f.NeedsUpload {
-		// Entirely reckless
-		go func() {
-			log.Infoln("Uploading file to Dropbox", f.Metadata.PathDisplay)
-			retryNotice := func(err error, duration time.Duration) {
-				log.Errorf("Retrying %s in %s due to %s\n", f.Metadata.PathDisplay, err, duration)
-			}
-			err := backoff.RetryNotify(func() error {
-				_, err := f.Client.Upload(f.Metadata.PathDisplay, f.getData())
-				if err != nil {
-					return err
-				}
-				return nil
-			}, backoff.NewExponentialBackOff(), retryNotice)
+	f.Lock()
+	defer f.Unlock()
+	if _, _, err := f.queue(); err != nil {
+		return err
+	}
+	return nil
+}
 
-			if err != nil {
-				log.Panicln("Unable to upload file", f.Metadata.PathDisplay, err)
-			}
-			f.NeedsUpload = false
-		}()
+// queue puts the local changes in the upload journal. Returns the local copy
+// and the sequence number to wait on, or an empty id when there is nothing
+// to upload.
+// lock assumed
+func (f *File) queue() (string, uint64, error) {
+	if !f.NeedsUpload || f.local == nil || f.removed {
+		return "", 0, nil
+	}
+	if err := f.local.Sync(); err != nil {
+		log.Errorln("Unable to save local copy of", f.Metadata.PathDisplay, err)
+		return "", 0, fuse.EIO
 	}
+	id := filepath.Base(f.local.Name())
+	seq, err := f.Client.uploads.add(id, f.Metadata.PathDisplay, f.base, int64(f.Metadata.Size), f.Metadata.ClientModified, f.writes)
+	if err != nil {
+		log.Errorln("Unable to queue upload of", f.Metadata.PathDisplay, err)
+		return "", 0, fuse.EIO
+	}
+	return id, seq, nil
+}
 
-	return nil
+// commit uploads the local changes and waits until Dropbox has them.
+func (f *File) commit(ctx context.Context) error {
+	f.Lock()
+	id, seq, err := f.queue()
+	f.Unlock()
+	if err != nil || id == "" {
+		return err
+	}
+	select {
+	case err := <-f.Client.uploads.wait(id, seq):
+		if err != nil {
+			log.Errorln("Unable to upload", f.Metadata.PathDisplay, err)
+			return fuse.EIO
+		}
+		return nil
+	case <-ctx.Done():
+		return fuse.EINTR
+	}
 }
 
+// Fsync waits for the changes to be uploaded, unless uploads are left to the
+// background by SyncAsync.
 func (f *File) Fsync(ctx context.Context, req *fuse.FsyncRequest) error {
 	log.Infoln("Fsync call on file", f.Metadata.PathDisplay)
-	return nil
+	if f.Client.syncPolicy == SyncAsync {
+		return nil
+	}
+	return f.commit(ctx)
 }
@@ -0,0 +1,83 @@
+package fuse
+
+import "encoding/binary"
+
+// Inode number of the root folder, which has no Dropbox ID of its own.
+const rootInode = 1
+
+// inode returns the inode number of the item with Dropbox ID id, handing out
+// the next one the first time. Numbers follow the ID, so they stay the same
+// across renames, and are saved with the tree so they survive restarts. Once
+// the item is gone its number isn't handed out again.
+func (t *tree) inode(id string) uint64 {
+	t.Lock()
+	defer t.Unlock()
+	return t.inodeLocked(id)
+}
+
+// lock assumed
+func (t *tree) inodeLocked(id string) uint64 {
+	if id == "" {
+		return rootInode
+	}
+	if ino, found := t.inodes[id]; found {
+		return ino
+	}
+	ino := t.nextInode
+	t.nextInode++
+	t.inodes[id] = ino
+	t.newInodes[id] = ino
+	return ino
+}
+
+// forgetInode drops the inode number of the item with Dropbox ID id, which is
+// gone. The number stays used up, nextInode is saved on its own.
+// lock assumed
+func (t *tree) forgetInode(id string) {
+	if _, found := t.inodes[id]; !found {
+		return
+	}
+	delete(t.inodes, id)
+	t.newInodes[id] = 0
+}
+
+// loadNextInode picks up where handing out numbers stopped when saved.
+// lock assumed
+func (t *tree) loadNextInode(next uint64) {
+	if next > t.nextInode {
+		t.nextInode = next
+	}
+}
+
+// pruneInodes drops the numbers of items no longer in the tree, which mounts
+// from before numbers were dropped along with their items kept.
+// lock assumed
+func (t *tree) pruneInodes() {
+	for id := range t.inodes {
+		if t.byID[id] == nil {
+			t.forgetInode(id)
+		}
+	}
+}
+
+// loadInode adds back the inode number saved for id.
+// lock assumed
+func (t *tree) loadInode(id string, ino uint64) {
+	t.inodes[id] = ino
+	if ino >= t.nextInode {
+		t.nextInode = ino + 1
+	}
+}
+
+func encodeInode(ino uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, ino)
+	return b
+}
+
+func decodeInode(b []byte) (uint64, bool) {
+	if len(b) != 8 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint64(b), true
+}
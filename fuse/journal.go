@@ -0,0 +1,547 @@
+package fuse
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/cenkalti/backoff"
+	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox/files"
+)
+
+// Longest wait between attempts at an upload that keeps failing.
+const maxUploadInterval = 5 * time.Minute
+
+// How long an upload waited on by fsync is retried before giving up on it.
+// It stays queued either way.
+const syncTimeout = 30 * time.Second
+
+// Upload is a file whose local changes are waiting to go up to Dropbox.
+type Upload struct {
+	ID        string    `json:"id"` // names the local copy holding the changes
+	Path      string    `json:"path"`
+	Rev       string    `json:"rev,omitempty"` // version the changes are made to
+	Size      int64     `json:"size"`
+	Modified  time.Time `json:"modified"` // when the changes were made
+	Queued    time.Time `json:"queued"`
+	Attempts  int       `json:"attempts,omitempty"`
+	LastError string    `json:"last_error,omitempty"`
+	// Upload session of a file going up in parts and how much of it Dropbox
+	// acknowledged, so a restart carries on from there
+	Session       string `json:"session,omitempty"`
+	SessionOffset int64  `json:"session_offset,omitempty"`
+
+	seq    uint64 // bumped each time the changes are queued again
+	writes uint64 // writes to the file when last queued
+	held   bool   // a File has the local copy open
+	retry  backoff.BackOff
+	next   time.Time // not tried again before this
+	// failing since, for the changes queued as seq
+	failing time.Time
+	waiters []waiter
+}
+
+// waiter is told how the upload of the changes queued as seq went.
+type waiter struct {
+	seq  uint64
+	done chan error
+}
+
+// notify tells the waiters for changes up to seq how their upload went.
+// lock assumed
+func (p *Upload) notify(seq uint64, err error) {
+	kept := p.waiters[:0]
+	for _, w := range p.waiters {
+		if w.seq <= seq {
+			w.done <- err
+		} else {
+			kept = append(kept, w)
+		}
+	}
+	p.waiters = kept
+}
+
+// journal keeps one entry on disk per queued upload, next to the local copy
+// it refers to, so changes not uploaded yet survive a restart.
+type journal struct {
+	dir string // cache directory
+}
+
+func (j *journal) entryDir() string {
+	return filepath.Join(j.dir, "journal")
+}
+
+func (j *journal) entry(id string) string {
+	return filepath.Join(j.entryDir(), id+".json")
+}
+
+func (j *journal) local(id string) string {
+	return filepath.Join(j.dir, "local", id)
+}
+
+// write saves p, replacing what was saved for it before.
+func (j *journal) write(p *Upload) error {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	tmp := j.entry(p.ID) + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, j.entry(p.ID))
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return syncDir(j.entryDir())
+}
+
+// remove drops the entry for id, along with its local copy unless keepLocal.
+func (j *journal) remove(id string, keepLocal bool) {
+	if err := os.Remove(j.entry(id)); err != nil && !os.IsNotExist(err) {
+		log.Errorln("Unable to remove upload journal entry", id, err)
+	}
+	if !keepLocal {
+		os.Remove(j.local(id))
+	}
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// PendingUploads lists the uploads still queued in the cache directory dir,
+// oldest first. Safe to call while dir is mounted.
+func PendingUploads(dir string) ([]*Upload, error) {
+	j := &journal{dir: dir}
+	infos, err := ioutil.ReadDir(j.entryDir())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var pending []*Upload
+	for _, info := range infos {
+		if !strings.HasSuffix(info.Name(), ".json") {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(j.entryDir(), info.Name()))
+		if os.IsNotExist(err) {
+			// Uploaded in the meantime
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		p := &Upload{}
+		if err := json.Unmarshal(data, p); err != nil || p.ID == "" {
+			log.Warnln("Skipping unreadable upload journal entry", info.Name(), err)
+			continue
+		}
+		if _, err := os.Stat(j.local(p.ID)); err != nil {
+			// Nothing left to upload
+			continue
+		}
+		pending = append(pending, p)
+	}
+	sort.Slice(pending, func(i, k int) bool {
+		return pending[i].Queued.Before(pending[k].Queued)
+	})
+	return pending, nil
+}
+
+// uploader drains the journal in the background, retrying uploads that fail
+// until they go through.
+type uploader struct {
+	db      *Dropbox
+	journal *journal
+	queue   map[string]*Upload // by ID
+	wake    chan struct{}
+	stopped chan struct{}
+	// Leaf lock: taken inside the tree's and Files' locks, takes none itself
+	sync.Mutex
+}
+
+// newUploader picks up the uploads queued in the cache directory dir by
+// earlier mounts.
+func newUploader(db *Dropbox, dir string) *uploader {
+	u := &uploader{
+		db:      db,
+		journal: &journal{dir: dir},
+		queue:   map[string]*Upload{},
+		wake:    make(chan struct{}, 1),
+		stopped: make(chan struct{}),
+	}
+	if err := os.MkdirAll(u.journal.entryDir(), 0700); err != nil {
+		log.Errorln("Unable to create upload journal", err)
+	}
+	pending, err := PendingUploads(dir)
+	if err != nil {
+		log.Errorln("Unable to read upload journal, earlier changes won't be uploaded", err)
+	}
+	for _, p := range pending {
+		log.Infoln("Resuming upload of", p.Path, "queued at", p.Queued)
+		p.retry = newUploadRetry()
+		u.queue[p.ID] = p
+	}
+	// Half-written entries and ones whose local copy is gone
+	stale, _ := ioutil.ReadDir(u.journal.entryDir())
+	for _, info := range stale {
+		if u.queue[strings.TrimSuffix(info.Name(), ".json")] == nil {
+			os.Remove(filepath.Join(u.journal.entryDir(), info.Name()))
+		}
+	}
+	return u
+}
+
+func newUploadRetry() backoff.BackOff {
+	retry := backoff.NewExponentialBackOff()
+	retry.MaxInterval = maxUploadInterval
+	retry.MaxElapsedTime = 0
+	return retry
+}
+
+// add queues size bytes of the local copy id, modified at the given time, for
+// upload to path as of the given count of writes to the file. The changes
+// replace version rev of the file, or whatever is there without one. Returns
+// the sequence number to wait on.
+func (u *uploader) add(id string, path string, rev string, size int64, modified time.Time, writes uint64) (uint64, error) {
+	u.Lock()
+	defer u.Unlock()
+	p := u.queue[id]
+	if p != nil && p.Path == path && p.Size == size && p.writes == writes {
+		// Nothing new since it was queued
+		return p.seq, nil
+	}
+	if p == nil {
+		p = &Upload{ID: id, Queued: time.Now(), retry: newUploadRetry()}
+		u.queue[id] = p
+	}
+	p.Path, p.Rev, p.Size, p.Modified, p.writes, p.held = path, rev, size, modified, writes, true
+	p.seq++
+	p.Attempts, p.LastError, p.next, p.failing = 0, "", time.Time{}, time.Time{}
+	// The session holds the contents as they were
+	p.Session, p.SessionOffset = "", 0
+	p.retry.Reset()
+	u.kick()
+	return p.seq, u.journal.write(p)
+}
+
+// wait returns a channel that is sent how the upload of the changes to id
+// queued as seq went. Changes that aren't queued anymore are done.
+func (u *uploader) wait(id string, seq uint64) <-chan error {
+	done := make(chan error, 1)
+	u.Lock()
+	defer u.Unlock()
+	if p := u.queue[id]; p != nil {
+		p.waiters = append(p.waiters, waiter{seq: seq, done: done})
+	} else {
+		done <- nil
+	}
+	return done
+}
+
+func (u *uploader) kick() {
+	select {
+	case u.wake <- struct{}{}:
+	default:
+	}
+}
+
+// attach hands f the local copy of changes to it queued by an earlier mount.
+func (u *uploader) attach(f *File) {
+	u.Lock()
+	defer u.Unlock()
+	for _, p := range u.queue {
+		if p.held || !strings.EqualFold(p.Path, f.Metadata.PathDisplay) {
+			continue
+		}
+		local, err := os.OpenFile(u.journal.local(p.ID), os.O_RDWR, 0600)
+		if err != nil {
+			log.Errorln("Unable to open local copy of", p.Path, err)
+			return
+		}
+		f.local, f.base, f.NeedsUpload, f.writes = local, p.Rev, true, 0
+		f.Metadata.Size = uint64(p.Size)
+		if !p.Modified.IsZero() {
+			f.Metadata.ClientModified = p.Modified
+		}
+		p.held, p.writes = true, 0
+		return
+	}
+}
+
+// moved follows a rename of oldPath to newPath, which Dropbox answered with
+// output, with the uploads below it.
+func (u *uploader) moved(oldPath string, newPath string, output files.IsMetadata) {
+	u.Lock()
+	defer u.Unlock()
+	for _, p := range u.queue {
+		if !isBelow(p.Path, oldPath) {
+			continue
+		}
+		p.Path = newPath + p.Path[len(oldPath):]
+		if m, isFile := output.(*files.FileMetadata); isFile {
+			p.Rev = m.Rev
+		} else {
+			// Files in a moved folder get revs we don't know yet
+			p.Rev = ""
+		}
+		if err := u.journal.write(p); err != nil {
+			log.Errorln("Unable to update upload journal for", p.Path, err)
+		}
+	}
+}
+
+// removed drops the uploads at or below path.
+func (u *uploader) removed(path string) {
+	u.Lock()
+	defer u.Unlock()
+	for id, p := range u.queue {
+		if isBelow(p.Path, path) {
+			p.notify(p.seq, nil)
+			delete(u.queue, id)
+			u.journal.remove(id, false)
+		}
+	}
+}
+
+func isBelow(p string, dir string) bool {
+	p, dir = strings.ToLower(p), strings.ToLower(dir)
+	return p == dir || strings.HasPrefix(p, dir+"/")
+}
+
+// drain waits until the queue is empty or ctx is done, retrying failed
+// uploads right away instead of waiting out their backoff. Returns how many
+// uploads are left.
+func (u *uploader) drain(ctx context.Context) int {
+	u.Lock()
+	for _, p := range u.queue {
+		p.next = time.Time{}
+	}
+	u.Unlock()
+	u.kick()
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		u.Lock()
+		left := len(u.queue)
+		u.Unlock()
+		if left == 0 {
+			return 0
+		}
+		select {
+		case <-ctx.Done():
+			return left
+		case <-ticker.C:
+		}
+	}
+}
+
+// run uploads whatever is due until done is closed.
+func (u *uploader) run(done <-chan struct{}) {
+	defer close(u.stopped)
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		p, wait := u.due()
+		if p != nil {
+			u.upload(p)
+			continue
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-u.wake:
+		case <-timer.C:
+		case <-done:
+		}
+		timer.Stop()
+	}
+}
+
+// due returns the upload to try next, or how long until one is due.
+func (u *uploader) due() (*Upload, time.Duration) {
+	u.Lock()
+	defer u.Unlock()
+	var next *Upload
+	for _, p := range u.queue {
+		if next == nil || p.next.Before(next.next) {
+			next = p
+		}
+	}
+	if next == nil {
+		return nil, time.Hour
+	}
+	if wait := time.Until(next.next); wait > 0 {
+		return nil, wait
+	}
+	return next, 0
+}
+
+func (u *uploader) upload(p *Upload) {
+	u.Lock()
+	path, rev, size, modified, seq := p.Path, p.Rev, p.Size, p.Modified, p.seq
+	r := &resumable{session: p.Session, offset: p.SessionOffset}
+	u.Unlock()
+	r.saved = func(session string, offset int64) {
+		u.sessionSaved(p, seq, session, offset)
+	}
+	log.Infoln("Uploading file to Dropbox", path)
+	local, err := os.Open(u.journal.local(p.ID))
+	if os.IsNotExist(err) {
+		// Removed since, nothing left to upload
+		u.Lock()
+		if u.queue[p.ID] == p {
+			p.notify(p.seq, nil)
+			delete(u.queue, p.ID)
+			u.journal.remove(p.ID, false)
+		}
+		u.Unlock()
+		return
+	}
+	if err != nil {
+		u.failed(p, seq, err)
+		return
+	}
+	defer local.Close()
+	output, err := u.db.upload(path, local, size, rev, modified, r)
+	conflict := rev != "" && isConflict(err)
+	if conflict {
+		// Changed on Dropbox since, keep both like the desktop client does
+		output, err = u.db.uploadCopy(conflictedCopy(path, time.Now()), local, size, modified, r)
+	}
+	if err != nil {
+		u.failed(p, seq, err)
+		return
+	}
+	stale, retired := u.uploaded(p, path, seq, output, conflict)
+	if stale {
+		// Removed or renamed while uploading, don't leave it behind
+		if _, err := u.db.Delete(output.PathDisplay); err != nil {
+			log.Warnln("Unable to remove stale upload at", output.PathDisplay, err)
+		}
+		return
+	}
+	if retired && u.db.blocks.fits(cacheKey(output), int64(output.Size)) {
+		// What was uploaded is what the next read would download. Filled
+		// outside the locks, it takes as long as reading the whole file.
+		size := int64(output.Size)
+		if err := u.db.blocks.fill(cacheKey(output), size, output.ContentHash, 0, io.NewSectionReader(local, 0, size), size/blockSize+1); err != nil {
+			log.Warnln("Unable to cache uploaded contents of", path, err)
+		}
+	}
+	if conflict {
+		u.conflicted(path, rev, output)
+	}
+}
+
+// sessionSaved records how far the upload session for the changes queued
+// as seq got.
+func (u *uploader) sessionSaved(p *Upload, seq uint64, session string, offset int64) {
+	u.Lock()
+	defer u.Unlock()
+	if u.queue[p.ID] != p || p.seq != seq {
+		// Queued again since, the session holds old contents
+		return
+	}
+	p.Session, p.SessionOffset = session, offset
+	if err := u.journal.write(p); err != nil {
+		log.Errorln("Unable to update upload journal for", p.Path, err)
+	}
+}
+
+func (u *uploader) failed(p *Upload, seq uint64, err error) {
+	u.Lock()
+	defer u.Unlock()
+	if u.queue[p.ID] != p || p.seq != seq {
+		// Gone or queued again since, no reason to wait
+		return
+	}
+	p.Attempts++
+	p.LastError = err.Error()
+	wait := p.retry.NextBackOff()
+	p.next = time.Now().Add(wait)
+	if p.failing.IsZero() {
+		p.failing = time.Now()
+	}
+	if !retryable(err) || time.Since(p.failing) > syncTimeout {
+		p.notify(seq, err)
+	}
+	log.Errorf("Retrying upload of %s in %s due to %s\n", p.Path, wait, err)
+	if err := u.journal.write(p); err != nil {
+		log.Errorln("Unable to update upload journal for", p.Path, err)
+	}
+}
+
+// uploaded retires p after the changes queued as seq went up to path as
+// output, or to a conflicted copy of it, handing the file back to reading
+// from Dropbox. Reports whether path was removed or renamed away from during
+// the upload, and whether the file now reads what was uploaded.
+func (u *uploader) uploaded(p *Upload, path string, seq uint64, output *files.FileMetadata, conflict bool) (stale bool, retired bool) {
+	f := u.db.fileNode(path)
+	if f != nil {
+		f.Lock()
+		defer f.Unlock()
+		if f.local == nil || filepath.Base(f.local.Name()) != p.ID {
+			f = nil
+		}
+	}
+	u.Lock()
+	defer u.Unlock()
+	if u.queue[p.ID] != p || p.Path != path {
+		// Still queued when renamed, goes up again under the new name
+		p.next = time.Time{}
+		return true, false
+	}
+	p.notify(seq, nil)
+	if p.seq != seq {
+		// Queued again since, that upload follows. After a conflict it
+		// still conflicts and ends up in a copy of its own.
+		if !conflict {
+			p.Rev = output.Rev
+		}
+		return false, false
+	}
+	delete(u.queue, p.ID)
+	if f != nil && f.writes != p.writes {
+		// Written to since, the next release queues it again
+		u.journal.remove(p.ID, true)
+		return false, false
+	}
+	if f != nil {
+		f.closeLocal()
+		f.NeedsUpload = false
+	}
+	// The open local copy is still read from once removed
+	u.journal.remove(p.ID, false)
+	return false, true
+}
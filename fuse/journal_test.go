@@ -0,0 +1,111 @@
+package fuse
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox"
+	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox/files"
+	"github.com/melinysh/dropboxfs/fakedropbox"
+)
+
+func TestUploadResumesJournaledSession(t *testing.T) {
+	server := fakedropbox.New()
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "dropboxfs-journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data := bytes.Repeat([]byte("x"), 2*uploadPartSize+123)
+	backend := NewSDKBackend(server.Config())
+
+	// What a mount stopped after the first part leaves behind
+	session, err := backend.UploadSessionStart(bytes.NewReader(data[:uploadPartSize]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	j := &journal{dir: dir}
+	for _, d := range []string{j.entryDir(), dir + "/local"} {
+		if err := os.MkdirAll(d, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(j.local("big"), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	err = j.write(&Upload{
+		ID:            "big",
+		Path:          "/big.bin",
+		Size:          int64(len(data)),
+		Queued:        time.Now(),
+		Session:       session,
+		SessionOffset: uploadPartSize,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blocks, err := OpenBlockCache(dir, 4*blockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := NewDropbox(backend, &Directory{Metadata: &files.FolderMetadata{}}, blocks)
+	defer db.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	if left := db.Drain(ctx); left != 0 {
+		t.Fatal(left, "uploads left")
+	}
+	if remote, _ := server.ReadFile("/big.bin"); !bytes.Equal(remote, data) {
+		t.Fatal("Uploaded differently, got", len(remote), "bytes")
+	}
+	if calls := server.Calls("files/upload_session/start"); calls != 1 {
+		t.Error("Expected the journaled session to be carried on with, got", calls, "sessions")
+	}
+	if calls := server.Calls("files/upload_session/append_v2"); calls != 1 {
+		t.Error("Expected only the part after the journaled offset, got", calls, "appends")
+	}
+}
+
+// confusedBackend keeps telling uploads in parts the offset is wrong.
+type confusedBackend struct {
+	Backend
+	appends int
+}
+
+func (b *confusedBackend) UploadSessionStart(content io.Reader) (string, error) {
+	return "session", nil
+}
+
+func (b *confusedBackend) UploadSessionAppend(sessionID string, offset uint64, content io.Reader) error {
+	b.appends++
+	return files.UploadSessionAppendV2APIError{
+		APIError: dropbox.APIError{ErrorSummary: "incorrect_offset/"},
+		EndpointError: &files.UploadSessionLookupError{
+			Tagged:          dropbox.Tagged{Tag: files.UploadSessionLookupErrorIncorrectOffset},
+			IncorrectOffset: &files.UploadSessionOffsetError{CorrectOffset: uploadPartSize},
+		},
+	}
+}
+
+func TestUploadSessionGivesUpOnOffsetCorrections(t *testing.T) {
+	b := &confusedBackend{}
+	db := &Dropbox{backend: b}
+	r := &resumable{}
+	content := bytes.NewReader(make([]byte, 3*uploadPartSize))
+	if _, err := db.uploadSession(files.NewCommitInfo("/big.bin"), content, content.Size(), r); err == nil {
+		t.Fatal("Expected the upload to fail")
+	}
+	if b.appends != maxOffsetCorrections+1 {
+		t.Error("Expected", maxOffsetCorrections+1, "appends, got", b.appends)
+	}
+	if r.session != "" || r.offset != 0 {
+		t.Error("Session kept for the next attempt", r.session, r.offset)
+	}
+}
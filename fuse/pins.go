@@ -0,0 +1,144 @@
+package fuse
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox/files"
+)
+
+// How often a mount picks up changes to its pins and downloads what pinned
+// files are missing.
+const pinInterval = 30 * time.Second
+
+func pinList(dir string) string {
+	return filepath.Join(dir, "pins.json")
+}
+
+// Pins lists the files pinned in the cache directory dir, by their path in
+// the folder mounted, sorted. Safe to call while dir is mounted.
+func Pins(dir string) ([]string, error) {
+	data, err := ioutil.ReadFile(pinList(dir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var pins []string
+	if err := json.Unmarshal(data, &pins); err != nil {
+		return nil, err
+	}
+	return pins, nil
+}
+
+// SetPinned pins or unpins the file at p in the cache directory dir. Mounts
+// of dir keep pinned files downloaded in full, and never evict them however
+// full the cache gets. Safe to call while dir is mounted, the mount picks it
+// up within pinInterval.
+func SetPinned(dir string, p string, pinned bool) error {
+	pins, err := Pins(dir)
+	if err != nil {
+		return err
+	}
+	p = "/" + strings.Trim(p, "/")
+	kept := []string{}
+	for _, q := range pins {
+		if !strings.EqualFold(q, p) {
+			kept = append(kept, q)
+		}
+	}
+	if pinned {
+		kept = append(kept, p)
+	}
+	sort.Strings(kept)
+	data, err := json.MarshalIndent(kept, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, "pins")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(append(data, '\n'))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), pinList(dir))
+}
+
+// keepPinned keeps the pinned files downloaded until done is closed.
+func (db *Dropbox) keepPinned() {
+	ticker := time.NewTicker(pinInterval)
+	defer ticker.Stop()
+	for {
+		db.fetchPinned()
+		select {
+		case <-db.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// fetchPinned keeps the blocks of the current version of each pinned file
+// from eviction, and downloads the ones missing.
+func (db *Dropbox) fetchPinned() {
+	pins, err := Pins(db.blocks.dir)
+	if err != nil {
+		log.Errorln("Unable to read pinned files", err)
+		return
+	}
+	keys := map[string]bool{}
+	var fetch []*files.FileMetadata
+	for _, p := range pins {
+		m, err := db.pinnedFile(p)
+		if err != nil {
+			log.Warnln("Unable to find pinned file", p, err)
+			continue
+		}
+		if m == nil {
+			continue
+		}
+		keys[cacheKey(m)] = true
+		fetch = append(fetch, m)
+	}
+	db.blocks.pin(keys)
+	for _, m := range fetch {
+		if err := db.fetchBlocks(m, 0, blockCount(m.Size)); err != nil {
+			log.Warnln("Unable to download pinned file", m.PathDisplay, err)
+		}
+	}
+}
+
+// pinnedFile returns the metadata of the file at p, nil when it has local
+// changes, whose contents are kept anyway.
+func (db *Dropbox) pinnedFile(p string) (*files.FileMetadata, error) {
+	m, known, err := db.tree.file(p)
+	if err != nil || known {
+		return m, err
+	}
+	// In a folder not listed yet
+	fetched, err := db.backend.GetMetadata(p)
+	if err != nil {
+		return nil, err
+	}
+	if m, isFile := fetched.(*files.FileMetadata); isFile {
+		return m, nil
+	}
+	return nil, errIsDir
+}
@@ -0,0 +1,262 @@
+package fuse
+
+import (
+	"os"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox"
+	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox/file_properties"
+	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox/files"
+)
+
+// Name of the property template holding what Dropbox has no field of its own
+// for, such as mode bits.
+const templateName = "dropboxfs"
+
+// Name of the property template holding user xattrs, a field for each name.
+const xattrTemplateName = "dropboxfs-xattrs"
+
+// Field holding the permission bits of a file or folder, in octal.
+const modeField = "mode"
+
+var templateFields = []*file_properties.PropertyFieldTemplate{
+	file_properties.NewPropertyFieldTemplate(modeField, "Permission bits, in octal", stringProperty()),
+}
+
+func stringProperty() *file_properties.PropertyType {
+	return &file_properties.PropertyType{Tagged: dropbox.Tagged{Tag: file_properties.PropertyTypeString}}
+}
+
+// How long after failing to find our property templates they are looked up
+// again when a mode is read.
+const templateRetry = 30 * time.Second
+
+// findTemplate looks up our property templates, creating the one for modes
+// the first time, and has metadata carry our properties from then on.
+// Without it, modes can't be changed. Failing, it is tried again by the next
+// chmod, or by reading a mode once templateRetry passed.
+func (db *Dropbox) findTemplate() error {
+	db.findLock.Lock()
+	defer db.findLock.Unlock()
+	db.templateLock.Lock()
+	found, retried := db.template != "", !db.templateTried.IsZero()
+	db.templateTried = time.Now()
+	db.templateLock.Unlock()
+	if found {
+		// By a lookup we waited on
+		return nil
+	}
+	ids, err := db.backend.ListPropertyTemplates()
+	if err != nil {
+		return err
+	}
+	template := ""
+	for _, id := range ids {
+		t, err := db.backend.GetPropertyTemplate(id)
+		if err != nil {
+			return err
+		}
+		switch t.Name {
+		case templateName:
+			template = id
+		case xattrTemplateName:
+			db.xattrLock.Lock()
+			if db.xattrTemplate == "" {
+				db.xattrTemplate = id
+				db.setXattrFields(t)
+			}
+			db.xattrLock.Unlock()
+		}
+	}
+	if template == "" && !db.readOnly {
+		t := file_properties.NewPropertyGroupTemplate(templateName, "Attributes kept by dropboxfs", templateFields)
+		if template, err = db.backend.AddPropertyTemplate(t); err != nil {
+			return err
+		}
+		log.Infoln("Created property template", template)
+	}
+	db.templateLock.Lock()
+	db.template = template
+	db.templateLock.Unlock()
+	db.xattrLock.Lock()
+	db.includeProperties()
+	db.xattrLock.Unlock()
+	if retried && template != "" {
+		// Listed without our properties so far
+		log.Infoln("Found property template", template, "fetching listings again for modes")
+		db.tree.unlistAll()
+	}
+	return nil
+}
+
+// modeTemplate returns the ID of our property template, empty while it isn't
+// found. After a failed lookup, it is looked up again in the background once
+// templateRetry passed, so a mount started offline gets modes once back.
+func (db *Dropbox) modeTemplate() string {
+	db.templateLock.Lock()
+	defer db.templateLock.Unlock()
+	if db.template == "" && time.Since(db.templateTried) > templateRetry {
+		db.templateTried = time.Now()
+		go func() {
+			if err := db.findTemplate(); err != nil {
+				log.Warnln("Unable to find property templates", err)
+			}
+		}()
+	}
+	return db.template
+}
+
+// templateNamed looks up the user's property template called name, returning
+// an empty ID if there is none.
+func (db *Dropbox) templateNamed(name string) (string, *file_properties.PropertyGroupTemplate, error) {
+	ids, err := db.backend.ListPropertyTemplates()
+	if err != nil {
+		return "", nil, err
+	}
+	for _, id := range ids {
+		t, err := db.backend.GetPropertyTemplate(id)
+		if err != nil {
+			return "", nil, err
+		}
+		if t.Name == name {
+			return id, t, nil
+		}
+	}
+	return "", nil, nil
+}
+
+// includeProperties has metadata carry the groups of the templates we have.
+// lock assumed on xattrLock
+func (db *Dropbox) includeProperties() {
+	var ids []string
+	db.templateLock.Lock()
+	template := db.template
+	db.templateLock.Unlock()
+	for _, id := range []string{template, db.xattrTemplate} {
+		if id != "" {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) > 0 {
+		db.backend.IncludeProperties(ids)
+	}
+}
+
+func propertyGroups(m files.IsMetadata) []*file_properties.PropertyGroup {
+	switch v := m.(type) {
+	case *files.FileMetadata:
+		return v.PropertyGroups
+	case *files.FolderMetadata:
+		return v.PropertyGroups
+	}
+	return nil
+}
+
+func setPropertyGroups(m files.IsMetadata, groups []*file_properties.PropertyGroup) {
+	switch v := m.(type) {
+	case *files.FileMetadata:
+		v.PropertyGroups = groups
+	case *files.FolderMetadata:
+		v.PropertyGroups = groups
+	}
+}
+
+// property returns field of our property group among groups.
+func (db *Dropbox) property(groups []*file_properties.PropertyGroup, field string) (string, bool) {
+	template := db.modeTemplate()
+	for _, g := range groups {
+		if g.TemplateId != template || template == "" {
+			continue
+		}
+		for _, f := range g.Fields {
+			if f.Name == field {
+				return f.Value, true
+			}
+		}
+	}
+	return "", false
+}
+
+// mode returns the permission bits saved among groups, or the default if
+// there are none, less the umask.
+func (db *Dropbox) mode(groups []*file_properties.PropertyGroup) os.FileMode {
+	value, found := db.property(groups, modeField)
+	if !found {
+		return db.defaultMode
+	}
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil {
+		return db.defaultMode
+	}
+	return os.FileMode(mode) & os.ModePerm &^ db.umask
+}
+
+// setProperty saves value as field of the item at p, whose property groups
+// are groups, keeping its other fields.
+func (db *Dropbox) setProperty(p string, groups []*file_properties.PropertyGroup, field string, value string) error {
+	template := db.modeTemplate()
+	if template == "" {
+		// Dropbox may answer by now
+		if err := db.findTemplate(); err != nil {
+			return err
+		}
+		if template = db.modeTemplate(); template == "" {
+			return errNotSupported
+		}
+	}
+	fields := append(otherFields(groups, template, field), file_properties.NewPropertyField(field, value))
+	group := file_properties.NewPropertyGroup(template, fields)
+	if err := db.backend.SetProperties(p, group); err != nil {
+		return err
+	}
+	db.tree.setProperties(p, group)
+	db.save("")
+	return nil
+}
+
+// otherFields returns the fields of the group with templateID among groups,
+// leaving out field.
+func otherFields(groups []*file_properties.PropertyGroup, templateID string, field string) []*file_properties.PropertyField {
+	var fields []*file_properties.PropertyField
+	for _, g := range groups {
+		if g.TemplateId != templateID {
+			continue
+		}
+		for _, f := range g.Fields {
+			if f.Name != field {
+				fields = append(fields, f)
+			}
+		}
+	}
+	return fields
+}
+
+// setMode saves the permission bits of the item at p.
+func (db *Dropbox) setMode(p string, groups []*file_properties.PropertyGroup, mode os.FileMode) error {
+	return db.setProperty(p, groups, modeField, strconv.FormatUint(uint64(mode&os.ModePerm), 8))
+}
+
+// setProperties replaces the property group of the item at p that has the
+// template of group. A group without fields is removed.
+func (t *tree) setProperties(p string, group *file_properties.PropertyGroup) {
+	t.Lock()
+	defer t.Unlock()
+	e := t.byPath[lowerPath("", p)]
+	if e == nil {
+		return
+	}
+	var groups []*file_properties.PropertyGroup
+	if len(group.Fields) > 0 {
+		groups = append(groups, group)
+	}
+	for _, g := range propertyGroups(e.metadata) {
+		if g.TemplateId != group.TemplateId {
+			groups = append(groups, g)
+		}
+	}
+	setPropertyGroups(e.metadata, groups)
+	t.dirty[e] = true
+}
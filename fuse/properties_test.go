@@ -0,0 +1,46 @@
+package fuse
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox/files"
+	"github.com/melinysh/dropboxfs/fakedropbox"
+)
+
+func TestModeTemplateRetriedInBackground(t *testing.T) {
+	server := fakedropbox.New()
+	defer server.Close()
+	server.FailNext("file_properties/templates/list_for_user", 1, 500, "internal_error/")
+	dir, err := ioutil.TempDir("", "dropboxfs-properties")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	blocks, err := OpenBlockCache(dir, 4*blockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := NewDropbox(NewSDKBackend(server.Config()), &Directory{Metadata: &files.FolderMetadata{}}, blocks)
+	defer db.Close()
+	if id := db.modeTemplate(); id != "" {
+		t.Fatal("Found a template Dropbox failed to list", id)
+	}
+	// Not looked up again on every read
+	if calls := server.Calls("file_properties/templates/list_for_user"); calls != 1 {
+		t.Fatal("Looked up", calls, "times")
+	}
+	db.templateLock.Lock()
+	db.templateTried = time.Now().Add(-templateRetry)
+	db.templateLock.Unlock()
+	db.modeTemplate()
+	deadline := time.Now().Add(5 * time.Second)
+	for db.modeTemplate() == "" {
+		if time.Now().After(deadline) {
+			t.Fatal("Template not found once Dropbox answered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,226 @@
+package fuse
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox"
+	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox/file_properties"
+	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox/files"
+	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox/users"
+)
+
+// Page size used for every folder listing.
+const listFolderLimit = 2000
+
+type sdkBackend struct {
+	client     files.Client
+	notify     files.Client
+	properties file_properties.Client
+	users      users.Client
+	// property groups asked for along with metadata, nil for none
+	include     *file_properties.TemplateFilterBase
+	includeLock sync.Mutex
+}
+
+// NewSDKBackend returns a Backend that talks to the Dropbox API v2 through the SDK.
+func NewSDKBackend(config dropbox.Config) Backend {
+	// Longpoll must not carry the Authorization header, so it gets its own
+	// client sharing the rest of the configuration.
+	notifyConfig := config
+	notifyConfig.Client = newNoAuthClient()
+	return &sdkBackend{
+		client:     files.New(config),
+		notify:     files.New(notifyConfig),
+		properties: file_properties.New(config),
+		users:      users.New(config),
+	}
+}
+
+func (b *sdkBackend) ListFolder(path string, recursive bool) (*files.ListFolderResult, error) {
+	input := files.NewListFolderArg(path)
+	input.Limit = listFolderLimit
+	input.Recursive = recursive
+	input.IncludePropertyGroups = b.included()
+	return b.client.ListFolder(input)
+}
+
+func (b *sdkBackend) ListFolderContinue(cursor string) (*files.ListFolderResult, error) {
+	return b.client.ListFolderContinue(files.NewListFolderContinueArg(cursor))
+}
+
+func (b *sdkBackend) GetLatestCursor(path string, recursive bool) (string, error) {
+	input := files.NewListFolderArg(path)
+	input.Limit = listFolderLimit
+	input.Recursive = recursive
+	input.IncludePropertyGroups = b.included()
+	output, err := b.client.ListFolderGetLatestCursor(input)
+	if err != nil {
+		return "", err
+	}
+	return output.Cursor, nil
+}
+
+func (b *sdkBackend) Longpoll(cursor string, timeout uint64) (*files.ListFolderLongpollResult, error) {
+	input := files.NewListFolderLongpollArg(cursor)
+	input.Timeout = timeout
+	return b.notify.ListFolderLongpoll(input)
+}
+
+func (b *sdkBackend) Download(path string, offset int64, length int64) (*files.FileMetadata, io.ReadCloser, error) {
+	arg := files.NewDownloadArg(path)
+	switch {
+	case length > 0:
+		arg.ExtraHeaders = map[string]string{"Range": fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)}
+	case offset > 0:
+		arg.ExtraHeaders = map[string]string{"Range": fmt.Sprintf("bytes=%d-", offset)}
+	}
+	return b.client.Download(arg)
+}
+
+func (b *sdkBackend) Upload(commit *files.CommitInfo, content io.Reader) (*files.FileMetadata, error) {
+	return b.client.Upload(commit, content)
+}
+
+func (b *sdkBackend) UploadSessionStart(content io.Reader) (string, error) {
+	output, err := b.client.UploadSessionStart(files.NewUploadSessionStartArg(), content)
+	if err != nil {
+		return "", err
+	}
+	return output.SessionId, nil
+}
+
+func (b *sdkBackend) UploadSessionAppend(sessionID string, offset uint64, content io.Reader) error {
+	arg := files.NewUploadSessionAppendArg(files.NewUploadSessionCursor(sessionID, offset))
+	return b.client.UploadSessionAppendV2(arg, content)
+}
+
+func (b *sdkBackend) UploadSessionFinish(sessionID string, offset uint64, commit *files.CommitInfo, content io.Reader) (*files.FileMetadata, error) {
+	arg := files.NewUploadSessionFinishArg(files.NewUploadSessionCursor(sessionID, offset), commit)
+	return b.client.UploadSessionFinish(arg, content)
+}
+
+func (b *sdkBackend) Move(fromPath string, toPath string) (files.IsMetadata, error) {
+	output, err := b.client.MoveV2(files.NewRelocationArg(fromPath, toPath))
+	if err != nil {
+		return nil, err
+	}
+	return output.Metadata, nil
+}
+
+func (b *sdkBackend) Delete(path string) (files.IsMetadata, error) {
+	output, err := b.client.DeleteV2(files.NewDeleteArg(path))
+	if err != nil {
+		return nil, err
+	}
+	return output.Metadata, nil
+}
+
+func (b *sdkBackend) Mkdir(path string) (*files.FolderMetadata, error) {
+	output, err := b.client.CreateFolderV2(files.NewCreateFolderArg(path))
+	if err != nil {
+		return nil, err
+	}
+	return output.Metadata, nil
+}
+
+func (b *sdkBackend) GetMetadata(path string) (files.IsMetadata, error) {
+	input := files.NewGetMetadataArg(path)
+	input.IncludePropertyGroups = b.included()
+	return b.client.GetMetadata(input)
+}
+
+func (b *sdkBackend) IncludeProperties(templateIDs []string) {
+	b.includeLock.Lock()
+	defer b.includeLock.Unlock()
+	b.include = &file_properties.TemplateFilterBase{
+		Tagged:     dropbox.Tagged{Tag: file_properties.TemplateFilterBaseFilterSome},
+		FilterSome: templateIDs,
+	}
+}
+
+func (b *sdkBackend) included() *file_properties.TemplateFilterBase {
+	b.includeLock.Lock()
+	defer b.includeLock.Unlock()
+	return b.include
+}
+
+func (b *sdkBackend) ListPropertyTemplates() ([]string, error) {
+	output, err := b.properties.TemplatesListForUser()
+	if err != nil {
+		return nil, err
+	}
+	return output.TemplateIds, nil
+}
+
+func (b *sdkBackend) GetPropertyTemplate(templateID string) (*file_properties.PropertyGroupTemplate, error) {
+	output, err := b.properties.TemplatesGetForUser(file_properties.NewGetTemplateArg(templateID))
+	if err != nil {
+		return nil, err
+	}
+	return &output.PropertyGroupTemplate, nil
+}
+
+func (b *sdkBackend) AddPropertyTemplate(template *file_properties.PropertyGroupTemplate) (string, error) {
+	output, err := b.properties.TemplatesAddForUser(&file_properties.AddTemplateArg{PropertyGroupTemplate: *template})
+	if err != nil {
+		return "", err
+	}
+	return output.TemplateId, nil
+}
+
+func (b *sdkBackend) UpdatePropertyTemplate(templateID string, fields []*file_properties.PropertyFieldTemplate) error {
+	input := file_properties.NewUpdateTemplateArg(templateID)
+	input.AddFields = fields
+	_, err := b.properties.TemplatesUpdateForUser(input)
+	return err
+}
+
+func (b *sdkBackend) SetProperties(path string, group *file_properties.PropertyGroup) error {
+	return b.properties.PropertiesOverwrite(file_properties.NewOverwritePropertyGroupArg(path, []*file_properties.PropertyGroup{group}))
+}
+
+func (b *sdkBackend) AddProperties(path string, group *file_properties.PropertyGroup) error {
+	return b.properties.PropertiesAdd(file_properties.NewAddPropertiesArg(path, []*file_properties.PropertyGroup{group}))
+}
+
+func (b *sdkBackend) UpdateProperties(path string, update *file_properties.PropertyGroupUpdate) error {
+	return b.properties.PropertiesUpdate(file_properties.NewUpdatePropertiesArg(path, []*file_properties.PropertyGroupUpdate{update}))
+}
+
+func (b *sdkBackend) RemoveProperties(path string, templateID string) error {
+	return b.properties.PropertiesRemove(file_properties.NewRemovePropertiesArg(path, []string{templateID}))
+}
+
+func (b *sdkBackend) SpaceUsage() (*users.SpaceUsage, error) {
+	return b.users.GetSpaceUsage()
+}
+
+func (b *sdkBackend) CurrentAccount() (string, error) {
+	account, err := b.users.GetCurrentAccount()
+	if err != nil {
+		return "", err
+	}
+	return account.AccountId, nil
+}
+
+// Credit: https://gist.github.com/unakatsuo/0dcab7898d092d87a77d684f3e71621b
+// Cursor api calls do not use auth headers because it's baked into the cursor itself.
+type noauthTransport struct {
+	http.Transport
+}
+
+func (t *noauthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req.Header.Del("Authorization")
+	return t.Transport.RoundTrip(req)
+}
+
+func newNoAuthClient() *http.Client {
+	return &http.Client{
+		Transport: &noauthTransport{},
+	}
+}
+
+// End credit
@@ -0,0 +1,94 @@
+package fuse
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"bazil.org/fuse"
+	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox/users"
+	"golang.org/x/net/context"
+)
+
+// How long the space usage from Dropbox is reported before asking again.
+const spaceTTL = 30 * time.Second
+
+// Block size statfs counts space in.
+const statfsBlockSize = 4096
+
+// Dropbox has no limit on the number of files, report plenty free.
+const statfsFiles = 1 << 32
+
+// space returns how many bytes the account may hold and how many of them are
+// free. A team member limited to part of the team's space gets whichever
+// runs out first.
+func space(usage *users.SpaceUsage) (uint64, uint64) {
+	var total, free uint64
+	a := usage.Allocation
+	switch {
+	case a == nil:
+	case a.Individual != nil:
+		total = a.Individual.Allocated
+		free = sub(total, usage.Used)
+	case a.Team != nil:
+		total = a.Team.Allocated
+		free = sub(total, a.Team.Used)
+		if limit := a.Team.UserWithinTeamSpaceAllocated; limit > 0 {
+			total = limit
+			if own := sub(limit, usage.Used); own < free {
+				free = own
+			}
+		}
+	}
+	return total, free
+}
+
+func sub(a uint64, b uint64) uint64 {
+	if b > a {
+		return 0
+	}
+	return a - b
+}
+
+// spaceUsage returns the space usage of the account, asking Dropbox at most
+// once every spaceTTL. Falls back to the last answer when Dropbox can't be
+// reached.
+func (db *Dropbox) spaceUsage() (*users.SpaceUsage, error) {
+	db.Lock()
+	usage, at := db.space, db.spaceAt
+	db.Unlock()
+	if usage != nil && time.Since(at) < spaceTTL {
+		return usage, nil
+	}
+	fresh, err := db.backend.SpaceUsage()
+	if err != nil {
+		if usage != nil {
+			log.Warnln("Unable to get space usage, reporting what it was at", at, err)
+			return usage, nil
+		}
+		return nil, err
+	}
+	db.Lock()
+	db.space, db.spaceAt = fresh, time.Now()
+	db.Unlock()
+	return fresh, nil
+}
+
+// Statfs reports the space left in the Dropbox account.
+func (db *Dropbox) Statfs(ctx context.Context, req *fuse.StatfsRequest, resp *fuse.StatfsResponse) error {
+	usage, err := db.spaceUsage()
+	if err != nil {
+		log.Errorln("Unable to get space usage", err)
+		return toErrno(err)
+	}
+	total, free := space(usage)
+	resp.Bsize = statfsBlockSize
+	resp.Frsize = statfsBlockSize
+	resp.Blocks = total / statfsBlockSize
+	resp.Bfree = free / statfsBlockSize
+	resp.Bavail = resp.Bfree
+	resp.Files = statfsFiles
+	resp.Ffree = statfsFiles
+	resp.Namelen = 255
+	return nil
+}
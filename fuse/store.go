@@ -0,0 +1,192 @@
+package fuse
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox/files"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	entriesBucket = []byte("entries") // lowercase path -> record
+	inodesBucket  = []byte("inodes")  // Dropbox ID -> inode number
+	stateBucket   = []byte("state")
+	cursorKey     = []byte("cursor")
+	nextInodeKey  = []byte("next_inode")
+	accountKey    = []byte("account") // ID of the account the cache is of
+)
+
+// rootKey stands in for the root folder, whose lowercase path is empty.
+const rootKey = "/"
+
+// record is how an entry of the tree is saved.
+type record struct {
+	File   *files.FileMetadata   `json:"file,omitempty"`
+	Folder *files.FolderMetadata `json:"folder,omitempty"`
+	Listed bool                  `json:"listed,omitempty"`
+}
+
+func (r *record) metadata() files.IsMetadata {
+	if r.File != nil {
+		return r.File
+	}
+	return r.Folder
+}
+
+// Store keeps the metadata tree and the cursor it is current with on disk, so
+// a restarted mount only needs to catch up on what changed while it was down.
+type Store struct {
+	db      *bolt.DB
+	closed  bool   // saves are dropped, the cursor brings them next time
+	account string // ID of the account claimed by, empty before Claim
+	sync.Mutex
+}
+
+// OpenStore opens the store in dir, creating it if needed.
+func OpenStore(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(filepath.Join(dir, "metadata.db"), 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{entriesBucket, inodesBucket, stateBucket} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Store{db: db}, nil
+}
+
+// Close closes the store once a save under way is done. Saves from then on
+// are dropped, the saved cursor stays in step with what was saved.
+func (s *Store) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	s.closed = true
+	return s.db.Close()
+}
+
+// Claim makes sure the cache the store is in is of the account b serves,
+// recording it the first time. A cache of another account is refused: its
+// metadata and queued uploads are no use to b, and must not go up to it.
+func (s *Store) Claim(b Backend) error {
+	account, err := b.CurrentAccount()
+	if err != nil {
+		return fmt.Errorf("unable to tell which account the cache is for: %v", err)
+	}
+	s.Lock()
+	defer s.Unlock()
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		state := tx.Bucket(stateBucket)
+		if saved := string(state.Get(accountKey)); saved != "" {
+			if saved != account {
+				return fmt.Errorf("cache in %v is of account %v rather than %v, use another cache directory", filepath.Dir(s.db.Path()), saved, account)
+			}
+			return nil
+		}
+		return state.Put(accountKey, []byte(account))
+	})
+	if err == nil {
+		s.account = account
+	}
+	return err
+}
+
+// load reads back the next inode number to hand out and the saved ones, then
+// the records, parents before their children, and the cursor they are
+// current with.
+func (s *Store) load(next func(ino uint64), inode func(id string, ino uint64), each func(key string, r *record)) (string, error) {
+	var cursor string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		state := tx.Bucket(stateBucket)
+		cursor = string(state.Get(cursorKey))
+		if ino, ok := decodeInode(state.Get(nextInodeKey)); ok {
+			next(ino)
+		}
+		err := tx.Bucket(inodesBucket).ForEach(func(k, v []byte) error {
+			if ino, ok := decodeInode(v); ok {
+				inode(string(k), ino)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		// Keys sort bytewise, so a folder comes before everything inside it
+		return tx.Bucket(entriesBucket).ForEach(func(k, v []byte) error {
+			r := &record{}
+			if err := json.Unmarshal(v, r); err != nil {
+				log.Warnln("Skipping unreadable cache entry", string(k), err)
+				return nil
+			}
+			each(string(k), r)
+			return nil
+		})
+	})
+	return cursor, err
+}
+
+// save writes out what changed in t since the last save. A non-empty cursor
+// is stored in the same transaction, so entries and cursor stay in step.
+func (s *Store) save(t *tree, cursor string) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.closed {
+		return nil
+	}
+	puts, deletes, inodes, next := t.takeChanges()
+	if len(puts) == 0 && len(deletes) == 0 && len(inodes) == 0 && cursor == "" {
+		return nil
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		entries := tx.Bucket(entriesBucket)
+		for _, k := range deletes {
+			if err := entries.Delete([]byte(k)); err != nil {
+				return err
+			}
+		}
+		for k, v := range puts {
+			if err := entries.Put([]byte(k), v); err != nil {
+				return err
+			}
+		}
+		numbers := tx.Bucket(inodesBucket)
+		for id, ino := range inodes {
+			var err error
+			if ino == 0 {
+				err = numbers.Delete([]byte(id))
+			} else {
+				err = numbers.Put([]byte(id), encodeInode(ino))
+			}
+			if err != nil {
+				return err
+			}
+		}
+		state := tx.Bucket(stateBucket)
+		if len(inodes) > 0 {
+			if err := state.Put(nextInodeKey, encodeInode(next)); err != nil {
+				return err
+			}
+		}
+		if cursor == "" {
+			return nil
+		}
+		return state.Put(cursorKey, []byte(cursor))
+	})
+}
@@ -0,0 +1,54 @@
+package fuse
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox/files"
+	"github.com/melinysh/dropboxfs/fakedropbox"
+)
+
+func TestStoreOfOtherAccountRefused(t *testing.T) {
+	first, second := fakedropbox.New(), fakedropbox.New()
+	defer first.Close()
+	defer second.Close()
+	dir, err := ioutil.TempDir("", "dropboxfs-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mount := func(server *fakedropbox.Server) error {
+		s, err := OpenStore(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		blocks, err := OpenBlockCache(dir, 4*blockSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		db := NewReadOnlyDropbox(NewSDKBackend(server.Config()), &Directory{Metadata: &files.FolderMetadata{}}, blocks)
+		defer db.Close()
+		return db.Restore(s)
+	}
+	if err := mount(first); err != nil {
+		t.Fatal(err)
+	}
+	// The same mountpoint with another account
+	if err := mount(second); err == nil {
+		t.Fatal("Restored the cache of another account")
+	}
+	s, err := OpenStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := s.Claim(NewSDKBackend(second.Config())); err == nil {
+		t.Fatal("Claimed the cache of another account")
+	}
+	if err := s.Claim(NewSDKBackend(first.Config())); err != nil {
+		t.Fatal("Refused the account the cache is of:", err)
+	}
+}
@@ -0,0 +1,206 @@
+package fuse
+
+import (
+	"errors"
+	"io"
+	"strings"
+
+	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox/file_properties"
+	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox/files"
+)
+
+// subfolderBackend serves a folder of another Backend as if it were the whole
+// account. Paths going in are put below root, and metadata coming back is
+// made relative to it, so listings and cursors only cover the folder.
+type subfolderBackend struct {
+	Backend
+	root  string // Dropbox path of the folder, without a trailing slash
+	lower string // root in lowercase, as it starts path_lower
+}
+
+// errOutsideRoot is returned when Dropbox answers with an item that isn't in
+// the folder served, which would otherwise be taken for the root.
+var errOutsideRoot = errors.New("dropbox answered with a path outside the mounted folder")
+
+// NewSubfolderBackend returns a Backend serving the folder at root of b as
+// its root. An empty root, or "/", serves all of b.
+func NewSubfolderBackend(b Backend, root string) Backend {
+	root = strings.TrimRight(root, "/")
+	if root == "" {
+		return b
+	}
+	if !strings.HasPrefix(root, "/") {
+		root = "/" + root
+	}
+	return &subfolderBackend{Backend: b, root: root, lower: strings.ToLower(root)}
+}
+
+// full returns the Dropbox path of p.
+func (b *subfolderBackend) full(p string) string {
+	return b.root + p
+}
+
+// relative strips root from the paths of m, in place. The root itself ends
+// up with empty paths, like the account root. Returns nil for anything
+// outside root.
+func (b *subfolderBackend) relative(m files.IsMetadata) files.IsMetadata {
+	var display, lower *string
+	switch v := m.(type) {
+	case *files.FileMetadata:
+		display, lower = &v.PathDisplay, &v.PathLower
+	case *files.FolderMetadata:
+		display, lower = &v.PathDisplay, &v.PathLower
+	case *files.DeletedMetadata:
+		display, lower = &v.PathDisplay, &v.PathLower
+	default:
+		return m
+	}
+	// Dropbox may spell root in another case
+	n := len(b.root)
+	if len(*display) < n || !strings.EqualFold((*display)[:n], b.root) || len(*display) > n && (*display)[n] != '/' {
+		return nil
+	}
+	*display = (*display)[n:]
+	if strings.HasPrefix(*lower, b.lower) {
+		*lower = (*lower)[len(b.lower):]
+	} else {
+		// Lowercased differently than we do, metadataPaths lowercases
+		// the display path instead
+		*lower = ""
+	}
+	return m
+}
+
+// mustRelative is relative for answers about items known to be in root,
+// failing with errOutsideRoot otherwise.
+func (b *subfolderBackend) mustRelative(m files.IsMetadata) (files.IsMetadata, error) {
+	if m = b.relative(m); m == nil {
+		return nil, errOutsideRoot
+	}
+	return m, nil
+}
+
+// relativeResult strips root from the entries of a listing.
+func (b *subfolderBackend) relativeResult(output *files.ListFolderResult) *files.ListFolderResult {
+	entries := output.Entries[:0]
+	for _, e := range output.Entries {
+		if e = b.relative(e); e == nil {
+			continue
+		}
+		// Recursive listings start with the folder itself
+		if display, _ := metadataPaths(e); display != "" {
+			entries = append(entries, e)
+		}
+	}
+	output.Entries = entries
+	return output
+}
+
+func (b *subfolderBackend) ListFolder(path string, recursive bool) (*files.ListFolderResult, error) {
+	output, err := b.Backend.ListFolder(b.full(path), recursive)
+	if err != nil {
+		return nil, err
+	}
+	return b.relativeResult(output), nil
+}
+
+func (b *subfolderBackend) ListFolderContinue(cursor string) (*files.ListFolderResult, error) {
+	output, err := b.Backend.ListFolderContinue(cursor)
+	if err != nil {
+		return nil, err
+	}
+	return b.relativeResult(output), nil
+}
+
+func (b *subfolderBackend) GetLatestCursor(path string, recursive bool) (string, error) {
+	return b.Backend.GetLatestCursor(b.full(path), recursive)
+}
+
+func (b *subfolderBackend) Download(path string, offset int64, length int64) (*files.FileMetadata, io.ReadCloser, error) {
+	m, content, err := b.Backend.Download(b.full(path), offset, length)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := b.mustRelative(m); err != nil {
+		content.Close()
+		return nil, nil, err
+	}
+	return m, content, nil
+}
+
+func (b *subfolderBackend) Upload(commit *files.CommitInfo, content io.Reader) (*files.FileMetadata, error) {
+	full := *commit
+	full.Path = b.full(commit.Path)
+	m, err := b.Backend.Upload(&full, content)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := b.mustRelative(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (b *subfolderBackend) UploadSessionFinish(sessionID string, offset uint64, commit *files.CommitInfo, content io.Reader) (*files.FileMetadata, error) {
+	full := *commit
+	full.Path = b.full(commit.Path)
+	m, err := b.Backend.UploadSessionFinish(sessionID, offset, &full, content)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := b.mustRelative(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (b *subfolderBackend) Move(fromPath string, toPath string) (files.IsMetadata, error) {
+	m, err := b.Backend.Move(b.full(fromPath), b.full(toPath))
+	if err != nil {
+		return nil, err
+	}
+	return b.mustRelative(m)
+}
+
+func (b *subfolderBackend) Delete(path string) (files.IsMetadata, error) {
+	m, err := b.Backend.Delete(b.full(path))
+	if err != nil {
+		return nil, err
+	}
+	return b.mustRelative(m)
+}
+
+func (b *subfolderBackend) Mkdir(path string) (*files.FolderMetadata, error) {
+	m, err := b.Backend.Mkdir(b.full(path))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := b.mustRelative(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (b *subfolderBackend) GetMetadata(path string) (files.IsMetadata, error) {
+	m, err := b.Backend.GetMetadata(b.full(path))
+	if err != nil {
+		return nil, err
+	}
+	return b.mustRelative(m)
+}
+
+func (b *subfolderBackend) SetProperties(path string, group *file_properties.PropertyGroup) error {
+	return b.Backend.SetProperties(b.full(path), group)
+}
+
+func (b *subfolderBackend) AddProperties(path string, group *file_properties.PropertyGroup) error {
+	return b.Backend.AddProperties(b.full(path), group)
+}
+
+func (b *subfolderBackend) UpdateProperties(path string, update *file_properties.PropertyGroupUpdate) error {
+	return b.Backend.UpdateProperties(b.full(path), update)
+}
+
+func (b *subfolderBackend) RemoveProperties(path string, templateID string) error {
+	return b.Backend.RemoveProperties(b.full(path), templateID)
+}
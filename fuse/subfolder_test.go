@@ -0,0 +1,43 @@
+package fuse
+
+import "testing"
+
+func TestSubfolderRelative(t *testing.T) {
+	b := NewSubfolderBackend(nil, "Team/Ünïcode/").(*subfolderBackend)
+	if b.root != "/Team/Ünïcode" {
+		t.Fatal("Root not normalized", b.root)
+	}
+	for _, test := range []struct {
+		display, lower string
+		wantDisplay    string
+		wantLower      string
+		outside        bool
+	}{
+		{"/Team/Ünïcode/a.txt", "/team/ünïcode/a.txt", "/a.txt", "/a.txt", false},
+		// Spelled in another case by Dropbox
+		{"/team/ÜNÏCODE/Sub/B.txt", "/team/ünïcode/sub/b.txt", "/Sub/B.txt", "/sub/b.txt", false},
+		{"/Team/Ünïcode", "/team/ünïcode", "", "", false},
+		{"/Team/other.txt", "/team/other.txt", "", "", true},
+		{"/Team/Ünïcodes/a.txt", "/team/ünïcodes/a.txt", "", "", true},
+	} {
+		m := fileAt(test.display, "id:a", "1")
+		m.PathLower = test.lower
+		got := b.relative(m)
+		if test.outside {
+			if got != nil {
+				t.Error(test.display, "taken as inside the root")
+			}
+			continue
+		}
+		if got == nil {
+			t.Error(test.display, "taken as outside the root")
+			continue
+		}
+		if display, lower := metadataPaths(got); display != test.wantDisplay || lower != test.wantLower {
+			t.Errorf("%s: got %q, %q", test.display, display, lower)
+		}
+	}
+	if _, err := b.mustRelative(fileAt("/elsewhere.txt", "id:b", "1")); err != errOutsideRoot {
+		t.Error("Expected errOutsideRoot, got", err)
+	}
+}
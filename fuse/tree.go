@@ -0,0 +1,525 @@
+package fuse
+
+import (
+	"encoding/json"
+	"path"
+	"strings"
+	"sync"
+
+	"bazil.org/fuse/fs"
+	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox/files"
+)
+
+// entry is a file or folder in the metadata tree.
+type entry struct {
+	metadata files.IsMetadata // *files.FileMetadata or *files.FolderMetadata
+	parent   *entry
+	children map[string]*entry // keyed by lowercase name, folders only
+	listed   bool              // children hold the complete folder listing
+	// Version of our own latest change, until the cursor catches up with it.
+	// Older changes coming in from the cursor must not undo it.
+	pending string
+	node    fs.Node // *File or *Directory handed to the kernel, made on demand
+}
+
+func (e *entry) isDir() bool {
+	_, isDir := e.metadata.(*files.FolderMetadata)
+	return isDir
+}
+
+// tree holds everything known about the Dropbox, indexed by lowercase path
+// and by Dropbox ID. Lock order: a Directory's lock, then the tree, then a
+// File's lock.
+type tree struct {
+	root   *entry
+	byPath map[string]*entry
+	byID   map[string]*entry
+	// What changed since the last save: entries to write out and the
+	// lowercase paths that no longer hold what was saved there.
+	dirty   map[*entry]bool
+	removed map[string]bool
+	// Inode numbers by Dropbox ID, and the ones not saved yet, 0 for items
+	// gone since. nextInode is never handed out before, so no number is
+	// used twice.
+	inodes    map[string]uint64
+	newInodes map[string]uint64
+	nextInode uint64
+	sync.Mutex
+}
+
+func newTree(root *Directory) *tree {
+	e := &entry{metadata: root.Metadata, children: map[string]*entry{}, node: root}
+	t := &tree{
+		root:      e,
+		byPath:    map[string]*entry{"": e},
+		byID:      map[string]*entry{},
+		inodes:    map[string]uint64{},
+		newInodes: map[string]uint64{},
+		nextInode: rootInode + 1,
+	}
+	t.clearChanges()
+	if root.Metadata.Id != "" {
+		t.byID[root.Metadata.Id] = e
+	}
+	return t
+}
+
+func metadataPaths(m files.IsMetadata) (string, string) {
+	switch v := m.(type) {
+	case *files.FileMetadata:
+		return v.PathDisplay, lowerPath(v.PathLower, v.PathDisplay)
+	case *files.FolderMetadata:
+		return v.PathDisplay, lowerPath(v.PathLower, v.PathDisplay)
+	case *files.DeletedMetadata:
+		return v.PathDisplay, lowerPath(v.PathLower, v.PathDisplay)
+	}
+	return "", ""
+}
+
+func lowerPath(pathLower, pathDisplay string) string {
+	if pathLower == "" {
+		pathLower = strings.ToLower(pathDisplay)
+	}
+	if pathLower == "/" {
+		return ""
+	}
+	return pathLower
+}
+
+// version tells apart the states of an item: the rev of a file, the ID of a
+// folder.
+func version(m files.IsMetadata) string {
+	if f, isFile := m.(*files.FileMetadata); isFile {
+		return f.Rev
+	}
+	return metadataID(m)
+}
+
+func metadataID(m files.IsMetadata) string {
+	switch v := m.(type) {
+	case *files.FileMetadata:
+		return v.Id
+	case *files.FolderMetadata:
+		return v.Id
+	}
+	return ""
+}
+
+func setMetadataPath(m files.IsMetadata, display string) {
+	switch v := m.(type) {
+	case *files.FileMetadata:
+		v.PathDisplay, v.PathLower, v.Name = display, strings.ToLower(display), path.Base(display)
+	case *files.FolderMetadata:
+		v.PathDisplay, v.PathLower, v.Name = display, strings.ToLower(display), path.Base(display)
+	}
+}
+
+func parentPath(lower string) string {
+	parent := path.Dir(lower)
+	if parent == "/" || parent == "." {
+		return ""
+	}
+	return parent
+}
+
+func (t *tree) get(p string) *entry {
+	t.Lock()
+	defer t.Unlock()
+	return t.byPath[lowerPath("", p)]
+}
+
+// file returns a copy of the metadata of the file at p, reporting whether p
+// is known. The copy is nil when the file has local changes.
+func (t *tree) file(p string) (*files.FileMetadata, bool, error) {
+	t.Lock()
+	defer t.Unlock()
+	e := t.byPath[lowerPath("", p)]
+	if e == nil {
+		return nil, false, nil
+	}
+	m, isFile := e.metadata.(*files.FileMetadata)
+	if !isFile {
+		return nil, true, errIsDir
+	}
+	if f, isFile := e.node.(*File); isFile {
+		f.Lock()
+		defer f.Unlock()
+		if f.NeedsUpload {
+			return nil, true, nil
+		}
+	}
+	copied := *m
+	return &copied, true, nil
+}
+
+// child finds name in the folder at dir, ignoring case like Dropbox does.
+func (t *tree) child(dir, name string) *entry {
+	t.Lock()
+	defer t.Unlock()
+	d := t.byPath[lowerPath("", dir)]
+	if d == nil {
+		return nil
+	}
+	return d.children[strings.ToLower(name)]
+}
+
+// children returns what is known to be in the folder at dir and whether that
+// is its complete listing.
+func (t *tree) children(dir string) ([]*entry, bool) {
+	t.Lock()
+	defer t.Unlock()
+	d := t.byPath[lowerPath("", dir)]
+	if d == nil {
+		return nil, false
+	}
+	out := make([]*entry, 0, len(d.children))
+	for _, c := range d.children {
+		out = append(out, c)
+	}
+	return out, d.listed
+}
+
+func (t *tree) isListed(dir string) bool {
+	t.Lock()
+	defer t.Unlock()
+	d := t.byPath[lowerPath("", dir)]
+	return d != nil && d.listed
+}
+
+// unlist makes the next lookup in the folder at dir fetch its listing again.
+func (t *tree) unlist(dir string) {
+	t.Lock()
+	defer t.Unlock()
+	if d := t.byPath[lowerPath("", dir)]; d != nil {
+		d.listed = false
+		t.dirty[d] = true
+	}
+}
+
+// markListed records that e holds the complete listing of its folder.
+func (t *tree) markListed(e *entry) {
+	t.Lock()
+	defer t.Unlock()
+	e.listed = true
+	t.dirty[e] = true
+}
+
+// merge adds or updates the file or folder described by m. local marks
+// results of our own changes. Returns nil when the parent folder isn't known,
+// or m is nil.
+func (t *tree) merge(m files.IsMetadata, local bool) *entry {
+	t.Lock()
+	defer t.Unlock()
+	return t.mergeLocked(m, local)
+}
+
+// replace merges m, the current state of an item as fetched from Dropbox,
+// which is newer than any change of ours the cursor hasn't caught up with.
+func (t *tree) replace(m files.IsMetadata) *entry {
+	t.Lock()
+	defer t.Unlock()
+	_, lower := metadataPaths(m)
+	for _, e := range []*entry{t.byID[metadataID(m)], t.byPath[lower]} {
+		if e != nil {
+			e.pending = ""
+		}
+	}
+	return t.mergeLocked(m, false)
+}
+
+// lock assumed
+func (t *tree) mergeLocked(m files.IsMetadata, local bool) *entry {
+	if m == nil {
+		// Would be taken for the root
+		return nil
+	}
+	display, lower := metadataPaths(m)
+	if lower == "" {
+		return t.root
+	}
+	parent := t.byPath[parentPath(lower)]
+	if parent == nil || !parent.isDir() {
+		return nil
+	}
+	id := metadataID(m)
+	e := t.byID[id]
+	existing := t.byPath[lower]
+	if !local {
+		for _, p := range []*entry{e, existing} {
+			if p == nil || p.pending == "" {
+				continue
+			}
+			if p.pending != version(m) {
+				return p
+			}
+			p.pending = ""
+		}
+	}
+	_, isDir := m.(*files.FolderMetadata)
+	if existing != nil && existing != e {
+		if e == nil && existing.isDir() == isDir {
+			// Replaced by a new item of the same kind, keep the node
+			if old := metadataID(existing.metadata); t.byID[old] == existing {
+				delete(t.byID, old)
+				t.forgetInode(old)
+			}
+			e = existing
+		} else {
+			t.drop(existing)
+		}
+	}
+	if e != nil && e.isDir() != isDir {
+		t.drop(e)
+		e = nil
+	}
+	if e == nil {
+		e = &entry{parent: parent}
+		if isDir {
+			e.children = map[string]*entry{}
+		}
+	} else if oldDisplay, oldLower := metadataPaths(e.metadata); oldDisplay != display {
+		if e.parent != nil {
+			delete(e.parent.children, path.Base(oldLower))
+		}
+		e.parent = parent
+		t.repath(e, oldLower, display)
+	}
+	if local {
+		e.pending = version(m)
+		if e.metadata != nil && propertyGroups(m) == nil {
+			// Answers to our changes come without properties, they stay
+			setPropertyGroups(m, propertyGroups(e.metadata))
+		}
+	}
+	e.metadata = m
+	parent.children[path.Base(lower)] = e
+	t.byPath[lower] = e
+	if id != "" {
+		t.byID[id] = e
+		// Numbered now, so the number is saved along with the entry
+		t.inodeLocked(id)
+	}
+	t.dirty[e] = true
+	t.updateNode(e, local)
+	return e
+}
+
+// repath moves e and everything below it from oldLower to display.
+// lock assumed
+func (t *tree) repath(e *entry, oldLower string, display string) {
+	if t.byPath[oldLower] == e {
+		delete(t.byPath, oldLower)
+		t.removed[oldLower] = true
+	}
+	setMetadataPath(e.metadata, display)
+	t.byPath[strings.ToLower(display)] = e
+	t.dirty[e] = true
+	for _, c := range e.children {
+		childDisplay, childLower := metadataPaths(c.metadata)
+		t.repath(c, childLower, display+"/"+path.Base(childDisplay))
+	}
+	if f, isFile := e.node.(*File); isFile {
+		// Moved files get a rev we don't know yet, local changes to them
+		// overwrite rather than conflict
+		f.Lock()
+		f.base = ""
+		f.Unlock()
+	}
+	t.updateNode(e, false)
+}
+
+// updateNode points the kernel's node at the latest metadata for e. Local
+// changes to a file apply to the metadata of our own changes.
+// lock assumed
+func (t *tree) updateNode(e *entry, local bool) {
+	switch n := e.node.(type) {
+	case *File:
+		m := e.metadata.(*files.FileMetadata)
+		// Contents are cached by content_hash, new contents miss by themselves
+		n.Lock()
+		if n.NeedsUpload {
+			// Keep the size and time of the local changes
+			m.Size, m.ClientModified = n.Metadata.Size, n.Metadata.ClientModified
+		}
+		if local && n.local != nil {
+			// Our own change, the local changes now apply to it
+			n.base = m.Rev
+		}
+		n.Metadata = m
+		n.Unlock()
+	case *Directory:
+		n.Metadata = e.metadata.(*files.FolderMetadata)
+	}
+}
+
+// remove forgets the item at p and everything below it, after we deleted it.
+func (t *tree) remove(p string) {
+	t.Lock()
+	defer t.Unlock()
+	if e := t.byPath[lowerPath("", p)]; e != nil && e != t.root {
+		t.drop(e)
+		markRemoved(e)
+	}
+}
+
+// markRemoved keeps files still open below e from uploading their changes
+// back once closed.
+// lock assumed
+func markRemoved(e *entry) {
+	if f, isFile := e.node.(*File); isFile {
+		f.Lock()
+		f.removed = true
+		f.Unlock()
+	}
+	for _, c := range e.children {
+		markRemoved(c)
+	}
+}
+
+// lock assumed
+func (t *tree) drop(e *entry) {
+	_, lower := metadataPaths(e.metadata)
+	if e.parent != nil && e.parent.children[path.Base(lower)] == e {
+		delete(e.parent.children, path.Base(lower))
+	}
+	t.unindex(e)
+}
+
+// lock assumed
+func (t *tree) unindex(e *entry) {
+	_, lower := metadataPaths(e.metadata)
+	if t.byPath[lower] == e {
+		delete(t.byPath, lower)
+		t.removed[lower] = true
+	}
+	delete(t.dirty, e)
+	if id := metadataID(e.metadata); t.byID[id] == e {
+		delete(t.byID, id)
+		t.forgetInode(id)
+	}
+	for _, c := range e.children {
+		t.unindex(c)
+	}
+}
+
+// setListing replaces what is known about the folder at dir with a complete
+// listing of it.
+func (t *tree) setListing(dir string, entries []files.IsMetadata) {
+	t.Lock()
+	defer t.Unlock()
+	d := t.byPath[lowerPath("", dir)]
+	if d == nil || !d.isDir() {
+		return
+	}
+	seen := map[*entry]bool{}
+	for _, m := range entries {
+		if e := t.mergeLocked(m, false); e != nil {
+			seen[e] = true
+		}
+	}
+	for _, c := range d.children {
+		// The listing may have started before our latest changes
+		if !seen[c] && c.pending == "" {
+			t.drop(c)
+		}
+	}
+	d.listed = true
+	t.dirty[d] = true
+}
+
+// apply merges a batch of changes from the cursor. A delete followed by an
+// add of the same ID is a rename, so the entry and its node are kept.
+func (t *tree) apply(changes []files.IsMetadata) {
+	t.Lock()
+	defer t.Unlock()
+	added := map[string]bool{}
+	for _, m := range changes {
+		if id := metadataID(m); id != "" {
+			added[id] = true
+		}
+	}
+	for _, m := range changes {
+		if _, isDeleted := m.(*files.DeletedMetadata); !isDeleted {
+			t.mergeLocked(m, false)
+			continue
+		}
+		_, lower := metadataPaths(m)
+		e := t.byPath[lower]
+		if e == nil || e == t.root || e.pending != "" || added[metadataID(e.metadata)] {
+			continue
+		}
+		t.drop(e)
+	}
+}
+
+// key is where e is saved in a Store.
+func key(e *entry) string {
+	if _, lower := metadataPaths(e.metadata); lower != "" {
+		return lower
+	}
+	return rootKey
+}
+
+// takeChanges returns the records to write out, the keys to delete, the
+// inode numbers handed out or dropped (as 0) since the last call and the
+// next number to hand out. Deletes go first, a key may be in both.
+func (t *tree) takeChanges() (map[string][]byte, []string, map[string]uint64, uint64) {
+	t.Lock()
+	defer t.Unlock()
+	puts := make(map[string][]byte, len(t.dirty))
+	for e := range t.dirty {
+		r := &record{Listed: e.listed}
+		switch m := e.metadata.(type) {
+		case *files.FileMetadata:
+			r.File = m
+		case *files.FolderMetadata:
+			r.Folder = m
+		}
+		data, err := json.Marshal(r)
+		if err != nil {
+			continue
+		}
+		puts[key(e)] = data
+	}
+	deletes := make([]string, 0, len(t.removed))
+	for k := range t.removed {
+		deletes = append(deletes, k)
+	}
+	inodes := t.newInodes
+	t.newInodes = map[string]uint64{}
+	t.clearChanges()
+	return puts, deletes, inodes, t.nextInode
+}
+
+// lock assumed
+func (t *tree) clearChanges() {
+	t.dirty = map[*entry]bool{}
+	t.removed = map[string]bool{}
+}
+
+// load adds back an entry saved under k. Parents must be loaded first.
+// lock assumed
+func (t *tree) load(k string, r *record) {
+	if k == rootKey {
+		t.root.listed = r.Listed
+		return
+	}
+	if m := r.metadata(); m != nil {
+		if e := t.mergeLocked(m, false); e != nil {
+			e.listed = r.Listed
+		}
+	}
+}
+
+// unlistAll makes every folder fetch its listing again on next lookup. The
+// entries stay, so nodes the kernel holds on to keep working.
+func (t *tree) unlistAll() {
+	t.Lock()
+	defer t.Unlock()
+	for _, e := range t.byPath {
+		if e.listed {
+			e.listed = false
+			t.dirty[e] = true
+		}
+	}
+}
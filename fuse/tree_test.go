@@ -0,0 +1,236 @@
+package fuse
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox/files"
+)
+
+func testTree() *tree {
+	return newTree(&Directory{Metadata: &files.FolderMetadata{}})
+}
+
+func fileAt(p string, id string, rev string) *files.FileMetadata {
+	m := files.NewFileMetadata(path.Base(p), id, time.Time{}, time.Time{}, rev, 0)
+	m.PathDisplay, m.PathLower = p, strings.ToLower(p)
+	return m
+}
+
+func folderAt(p string, id string) *files.FolderMetadata {
+	m := files.NewFolderMetadata(path.Base(p), id)
+	m.PathDisplay, m.PathLower = p, strings.ToLower(p)
+	return m
+}
+
+func deletedAt(p string) *files.DeletedMetadata {
+	m := files.NewDeletedMetadata(path.Base(p))
+	m.PathDisplay, m.PathLower = p, strings.ToLower(p)
+	return m
+}
+
+// names lists the names in the folder at dir, sorted.
+func names(tr *tree, dir string) []string {
+	entries, _ := tr.children(dir)
+	out := []string{}
+	for _, e := range entries {
+		display, _ := metadataPaths(e.metadata)
+		out = append(out, path.Base(display))
+	}
+	sort.Strings(out)
+	return out
+}
+
+func sameNames(got []string, want ...string) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestTreeChildIgnoresCase(t *testing.T) {
+	tr := testTree()
+	tr.merge(folderAt("/Docs", "id:docs"), false)
+	report := tr.merge(fileAt("/Docs/Report.TXT", "id:report", "1"), false)
+	for _, dir := range []string{"/Docs", "/docs", "/DOCS"} {
+		for _, name := range []string{"Report.TXT", "report.txt", "REPORT.txt"} {
+			if e := tr.child(dir, name); e != report {
+				t.Errorf("child(%q, %q) found %v", dir, name, e)
+			}
+		}
+	}
+	if e := tr.child("/Docs", "other.txt"); e != nil {
+		t.Error("Found missing file", e.metadata)
+	}
+	if e := tr.child("/Missing", "report.txt"); e != nil {
+		t.Error("Found file in missing folder", e.metadata)
+	}
+}
+
+func TestTreeApplyRename(t *testing.T) {
+	tr := testTree()
+	a := tr.merge(fileAt("/a.txt", "id:a", "1"), false)
+	node := &File{Metadata: a.metadata.(*files.FileMetadata)}
+	a.node = node
+	dir := tr.merge(folderAt("/dir", "id:dir"), false)
+	inner := tr.merge(fileAt("/dir/x.txt", "id:x", "1"), false)
+
+	// How the cursor reports moves: the old path deleted, the new one added
+	tr.apply([]files.IsMetadata{
+		deletedAt("/a.txt"),
+		fileAt("/B.txt", "id:a", "2"),
+		deletedAt("/dir"),
+		folderAt("/moved", "id:dir"),
+		fileAt("/moved/x.txt", "id:x", "2"),
+	})
+	if e := tr.get("/a.txt"); e != nil {
+		t.Error("Old path still there")
+	}
+	if e := tr.get("/b.txt"); e != a || e.node != node {
+		t.Error("Renamed file lost its entry or node")
+	}
+	if node.Metadata.PathDisplay != "/B.txt" || node.Metadata.Rev != "2" {
+		t.Error("Node not updated", node.Metadata.PathDisplay, node.Metadata.Rev)
+	}
+	if e := tr.get("/moved"); e != dir {
+		t.Error("Renamed folder lost its entry")
+	}
+	if e := tr.get("/moved/x.txt"); e != inner {
+		t.Error("File in renamed folder lost its entry")
+	}
+	if e := tr.get("/dir/x.txt"); e != nil {
+		t.Error("Old path below renamed folder still there")
+	}
+	if got := names(tr, ""); !sameNames(got, "B.txt", "moved") {
+		t.Error("Unexpected listing", got)
+	}
+
+	tr.apply([]files.IsMetadata{deletedAt("/b.txt")})
+	if e := tr.get("/b.txt"); e != nil {
+		t.Error("Deleted file still there")
+	}
+}
+
+func TestTreePendingSurvivesStaleListing(t *testing.T) {
+	tr := testTree()
+	tr.setListing("", nil)
+	// Our own upload, the cursor and listings haven't seen it yet
+	tr.merge(fileAt("/a.txt", "id:a", "2"), true)
+
+	// A listing that started before the upload
+	tr.setListing("", []files.IsMetadata{fileAt("/a.txt", "id:a", "1")})
+	if m, _, _ := tr.file("/a.txt"); m == nil || m.Rev != "2" {
+		t.Fatal("Stale listing undid our change", m)
+	}
+	tr.setListing("", nil)
+	if tr.get("/a.txt") == nil {
+		t.Fatal("Stale listing dropped our new file")
+	}
+	tr.apply([]files.IsMetadata{fileAt("/a.txt", "id:a", "1")})
+	if m, _, _ := tr.file("/a.txt"); m == nil || m.Rev != "2" {
+		t.Fatal("Older change from the cursor undid ours", m)
+	}
+
+	// Once the cursor catches up, it is like any other file
+	tr.apply([]files.IsMetadata{fileAt("/a.txt", "id:a", "2")})
+	tr.setListing("", nil)
+	if tr.get("/a.txt") != nil {
+		t.Fatal("File gone from the listing still there")
+	}
+}
+
+func TestTreeSetListing(t *testing.T) {
+	tr := testTree()
+	tr.merge(folderAt("/dir", "id:dir"), false)
+	if tr.isListed("") || tr.isListed("/dir") {
+		t.Fatal("Listed before any listing")
+	}
+	tr.setListing("/Dir", []files.IsMetadata{
+		fileAt("/dir/a.txt", "id:a", "1"),
+		fileAt("/dir/b.txt", "id:b", "1"),
+	})
+	if !tr.isListed("/dir") || tr.isListed("") {
+		t.Fatal("Wrong folders listed")
+	}
+	if got, complete := tr.children("/dir"); len(got) != 2 || !complete {
+		t.Fatal("Unexpected children", len(got), complete)
+	}
+	tr.setListing("/dir", []files.IsMetadata{fileAt("/dir/a.txt", "id:a", "1")})
+	if got := names(tr, "/dir"); !sameNames(got, "a.txt") {
+		t.Fatal("Unexpected listing", got)
+	}
+	tr.unlist("/dir")
+	if tr.isListed("/dir") {
+		t.Fatal("Still listed")
+	}
+	tr.merge(folderAt("/other", "id:other"), false)
+	tr.setListing("/other", nil)
+	tr.unlistAll()
+	if tr.isListed("/dir") || tr.isListed("/other") {
+		t.Fatal("Still listed after unlisting all")
+	}
+	// Entries stay for the nodes the kernel holds
+	if tr.get("/dir/a.txt") == nil {
+		t.Fatal("Unlisting dropped entries")
+	}
+}
+
+func TestTreeInodesOfDeletedItems(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dropboxfs-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := OpenStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	tr := testTree()
+	tr.merge(fileAt("/a.txt", "id:a", "1"), false)
+	tr.merge(fileAt("/b.txt", "id:b", "1"), false)
+	a, b := tr.inode("id:a"), tr.inode("id:b")
+	if err := s.save(tr, "cursor"); err != nil {
+		t.Fatal(err)
+	}
+	tr.apply([]files.IsMetadata{deletedAt("/b.txt")})
+	if _, found := tr.inodes["id:b"]; found {
+		t.Fatal("Kept the number of a deleted item")
+	}
+	if err := s.save(tr, "cursor"); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := testTree()
+	if _, err := s.load(restored.loadNextInode, restored.loadInode, restored.load); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := restored.inodes["id:b"]; found {
+		t.Fatal("Deleted item's number saved")
+	}
+	if got := restored.inode("id:a"); got != a {
+		t.Fatal("Number changed across restarts", a, got)
+	}
+	// b had the last number handed out, which isn't handed out again
+	if got := restored.inode("id:c"); got <= b {
+		t.Fatal("Number handed out again", got)
+	}
+}
+
+func TestTreeMergeNil(t *testing.T) {
+	// What the subfolder backend makes of items outside its root
+	if e := testTree().merge(nil, false); e != nil {
+		t.Fatal("Merged nil as", e)
+	}
+}
@@ -0,0 +1,371 @@
+package fuse
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox/file_properties"
+	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox/files"
+	"golang.org/x/net/context"
+
+	"bazil.org/fuse"
+)
+
+// Namespace of the extended attributes holding Dropbox metadata.
+const xattrPrefix = "user.dropbox."
+
+// Namespace of the extended attributes kept in file properties, under
+// xattrTemplateName.
+const userXattrPrefix = "user."
+
+// Longest value Dropbox keeps in a property field.
+const maxXattrValue = 1024
+
+// Flags of setxattr(2).
+const (
+	xattrCreate  = 0x1
+	xattrReplace = 0x2
+)
+
+// fileXattrs returns the metadata of a file as extended attributes, leaving
+// out what Dropbox didn't send. Without clean, the contents differ from the
+// ones Dropbox has, so there is no content hash.
+func fileXattrs(m *files.FileMetadata, clean bool) map[string]string {
+	attrs := map[string]string{
+		"id":              m.Id,
+		"rev":             m.Rev,
+		"path":            m.PathDisplay,
+		"server_modified": formatTime(m.ServerModified),
+		"client_modified": formatTime(m.ClientModified),
+	}
+	if clean {
+		attrs["content_hash"] = m.ContentHash
+	}
+	if s := m.SharingInfo; s != nil {
+		attrs["read_only"] = strconv.FormatBool(s.ReadOnly)
+		attrs["parent_shared_folder_id"] = s.ParentSharedFolderId
+		attrs["modified_by"] = s.ModifiedBy
+	}
+	return withPrefix(attrs)
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// folderXattrs returns the metadata of a folder as extended attributes.
+func folderXattrs(m *files.FolderMetadata) map[string]string {
+	attrs := map[string]string{
+		"id":               m.Id,
+		"path":             m.PathDisplay,
+		"shared_folder_id": m.SharedFolderId,
+	}
+	if s := m.SharingInfo; s != nil {
+		attrs["read_only"] = strconv.FormatBool(s.ReadOnly)
+		attrs["parent_shared_folder_id"] = s.ParentSharedFolderId
+		if s.SharedFolderId != "" {
+			attrs["shared_folder_id"] = s.SharedFolderId
+		}
+	}
+	return withPrefix(attrs)
+}
+
+// withPrefix names metadata attrs in the xattrPrefix namespace, dropping
+// empty ones.
+func withPrefix(attrs map[string]string) map[string]string {
+	named := map[string]string{}
+	for name, value := range attrs {
+		if value != "" {
+			named[xattrPrefix+name] = value
+		}
+	}
+	return named
+}
+
+// userXattrs adds the user xattrs kept among groups to attrs.
+func (db *Dropbox) userXattrs(attrs map[string]string, groups []*file_properties.PropertyGroup) map[string]string {
+	if g, _ := db.xattrGroup(groups); g != nil {
+		for _, f := range g.Fields {
+			attrs[userXattrPrefix+f.Name] = f.Value
+		}
+	}
+	return attrs
+}
+
+func getxattr(attrs map[string]string, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	value, found := attrs[req.Name]
+	if !found {
+		return fuse.ErrNoXattr
+	}
+	resp.Xattr = []byte(value)
+	return nil
+}
+
+func listxattr(attrs map[string]string, resp *fuse.ListxattrResponse) {
+	var names []string
+	for name := range attrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	resp.Append(names...)
+}
+
+// xattrField returns the property field keeping the xattr name. Only user
+// xattrs outside xattrPrefix can be set.
+func xattrField(name string) (string, error) {
+	if strings.HasPrefix(name, xattrPrefix) {
+		return "", fuse.EPERM
+	}
+	if !strings.HasPrefix(name, userXattrPrefix) || name == userXattrPrefix {
+		return "", errNotSupported
+	}
+	return strings.TrimPrefix(name, userXattrPrefix), nil
+}
+
+// xattrGroup returns the group of user xattrs among groups, nil if there is
+// none, along with the ID of their template.
+func (db *Dropbox) xattrGroup(groups []*file_properties.PropertyGroup) (*file_properties.PropertyGroup, string) {
+	db.xattrLock.Lock()
+	templateID := db.xattrTemplate
+	db.xattrLock.Unlock()
+	for _, g := range groups {
+		if templateID != "" && g.TemplateId == templateID {
+			return g, templateID
+		}
+	}
+	return nil, templateID
+}
+
+func hasField(g *file_properties.PropertyGroup, field string) bool {
+	if g == nil {
+		return false
+	}
+	for _, f := range g.Fields {
+		if f.Name == field {
+			return true
+		}
+	}
+	return false
+}
+
+// setXattrFields notes the fields of the user xattrs template t.
+// lock assumed on xattrLock, or not serving yet
+func (db *Dropbox) setXattrFields(t *file_properties.PropertyGroupTemplate) {
+	db.xattrFields = map[string]bool{}
+	for _, f := range t.Fields {
+		db.xattrFields[f.Name] = true
+	}
+}
+
+// addXattrField makes sure the user xattrs template has field, creating the
+// template the first time, and returns the template's ID.
+func (db *Dropbox) addXattrField(field string) (string, error) {
+	db.xattrLock.Lock()
+	defer db.xattrLock.Unlock()
+	if db.xattrFields[field] {
+		return db.xattrTemplate, nil
+	}
+	fields := []*file_properties.PropertyFieldTemplate{
+		file_properties.NewPropertyFieldTemplate(field, "Extended attribute "+userXattrPrefix+field, stringProperty()),
+	}
+	if db.xattrTemplate == "" {
+		// Another mount may have created it since we looked
+		id, t, err := db.templateNamed(xattrTemplateName)
+		if err != nil {
+			return "", err
+		}
+		if id == "" {
+			t = file_properties.NewPropertyGroupTemplate(xattrTemplateName, "Extended attributes set through dropboxfs", fields)
+			if id, err = db.backend.AddPropertyTemplate(t); err != nil {
+				return "", err
+			}
+			log.Infoln("Created property template", id, "for extended attributes")
+		}
+		db.xattrTemplate = id
+		db.setXattrFields(t)
+		db.includeProperties()
+	} else if t, err := db.backend.GetPropertyTemplate(db.xattrTemplate); err == nil {
+		// Another mount may have added the field since
+		db.setXattrFields(t)
+	}
+	if db.xattrFields[field] {
+		return db.xattrTemplate, nil
+	}
+	if err := db.backend.UpdatePropertyTemplate(db.xattrTemplate, fields); err != nil {
+		return "", err
+	}
+	db.xattrFields[field] = true
+	return db.xattrTemplate, nil
+}
+
+// setXattr keeps value as the user xattr name of the item at p, whose
+// property groups are groups.
+func (db *Dropbox) setXattr(p string, groups []*file_properties.PropertyGroup, name string, value []byte, flags uint32) error {
+	field, err := xattrField(name)
+	if err != nil {
+		return err
+	}
+	if !utf8.Valid(value) {
+		// Property fields hold strings
+		return errInvalid
+	}
+	if len(value) > maxXattrValue {
+		return fuse.ERANGE
+	}
+	old, _ := db.xattrGroup(groups)
+	found := hasField(old, field)
+	if flags&xattrCreate != 0 && found {
+		return fuse.EEXIST
+	}
+	if flags&xattrReplace != 0 && !found {
+		return fuse.ErrNoXattr
+	}
+	templateID, err := db.addXattrField(field)
+	if err != nil {
+		return err
+	}
+	set := file_properties.NewPropertyField(field, string(value))
+	if old == nil {
+		err = db.backend.AddProperties(p, file_properties.NewPropertyGroup(templateID, []*file_properties.PropertyField{set}))
+	}
+	if old != nil || isGroupExists(err) {
+		// Set elsewhere since we got the metadata, if old is nil
+		update := file_properties.NewPropertyGroupUpdate(templateID)
+		update.AddOrUpdateFields = []*file_properties.PropertyField{set}
+		err = db.backend.UpdateProperties(p, update)
+	}
+	if err != nil {
+		return err
+	}
+	fields := append(otherFields(groups, templateID, field), set)
+	db.tree.setProperties(p, file_properties.NewPropertyGroup(templateID, fields))
+	db.save("")
+	return nil
+}
+
+// removeXattr drops the user xattr name of the item at p, whose property
+// groups are groups.
+func (db *Dropbox) removeXattr(p string, groups []*file_properties.PropertyGroup, name string) error {
+	field, err := xattrField(name)
+	if err != nil {
+		return err
+	}
+	old, templateID := db.xattrGroup(groups)
+	if !hasField(old, field) {
+		return fuse.ErrNoXattr
+	}
+	fields := otherFields(groups, templateID, field)
+	if len(fields) == 0 {
+		err = db.backend.RemoveProperties(p, templateID)
+	} else {
+		update := file_properties.NewPropertyGroupUpdate(templateID)
+		update.RemoveFields = []string{field}
+		err = db.backend.UpdateProperties(p, update)
+	}
+	if err != nil {
+		return err
+	}
+	db.tree.setProperties(p, file_properties.NewPropertyGroup(templateID, fields))
+	db.save("")
+	return nil
+}
+
+func (f *File) xattrs() map[string]string {
+	f.Lock()
+	defer f.Unlock()
+	return f.Client.userXattrs(fileXattrs(f.Metadata, !f.NeedsUpload), f.Metadata.PropertyGroups)
+}
+
+func (f *File) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	log.Debugln("Getxattr", req.Name, "on file", f.Metadata.PathDisplay)
+	return getxattr(f.xattrs(), req, resp)
+}
+
+func (f *File) Listxattr(ctx context.Context, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
+	log.Debugln("Listxattr on file", f.Metadata.PathDisplay)
+	listxattr(f.xattrs(), resp)
+	return nil
+}
+
+func (f *File) Setxattr(ctx context.Context, req *fuse.SetxattrRequest) error {
+	f.Lock()
+	p, groups := f.Metadata.PathDisplay, f.Metadata.PropertyGroups
+	f.Unlock()
+	log.Infoln("Setxattr", req.Name, "on file", p)
+	if f.Client.readOnly {
+		return errReadOnly
+	}
+	// Takes the tree's lock, which comes before ours
+	if err := f.Client.setXattr(p, groups, req.Name, req.Xattr, req.Flags); err != nil {
+		log.Errorln("Unable to set", req.Name, "of", p, err)
+		return toErrno(err)
+	}
+	return nil
+}
+
+func (f *File) Removexattr(ctx context.Context, req *fuse.RemovexattrRequest) error {
+	f.Lock()
+	p, groups := f.Metadata.PathDisplay, f.Metadata.PropertyGroups
+	f.Unlock()
+	log.Infoln("Removexattr", req.Name, "on file", p)
+	if f.Client.readOnly {
+		return errReadOnly
+	}
+	// Takes the tree's lock, which comes before ours
+	if err := f.Client.removeXattr(p, groups, req.Name); err != nil {
+		log.Errorln("Unable to remove", req.Name, "of", p, err)
+		return toErrno(err)
+	}
+	return nil
+}
+
+func (d *Directory) xattrs() map[string]string {
+	return d.Client.userXattrs(folderXattrs(d.Metadata), d.Metadata.PropertyGroups)
+}
+
+func (d *Directory) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	log.Debugln("Getxattr", req.Name, "on directory", d.Metadata.PathDisplay)
+	return getxattr(d.xattrs(), req, resp)
+}
+
+func (d *Directory) Listxattr(ctx context.Context, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
+	log.Debugln("Listxattr on directory", d.Metadata.PathDisplay)
+	listxattr(d.xattrs(), resp)
+	return nil
+}
+
+func (d *Directory) Setxattr(ctx context.Context, req *fuse.SetxattrRequest) error {
+	log.Infoln("Setxattr", req.Name, "on directory", d.Metadata.PathDisplay)
+	if d.Client.readOnly {
+		return errReadOnly
+	}
+	if d.Metadata.PathDisplay == "" {
+		// Dropbox keeps no properties on the root
+		return fuse.EPERM
+	}
+	if err := d.Client.setXattr(d.Metadata.PathDisplay, d.Metadata.PropertyGroups, req.Name, req.Xattr, req.Flags); err != nil {
+		log.Errorln("Unable to set", req.Name, "of", d.Metadata.PathDisplay, err)
+		return toErrno(err)
+	}
+	return nil
+}
+
+func (d *Directory) Removexattr(ctx context.Context, req *fuse.RemovexattrRequest) error {
+	log.Infoln("Removexattr", req.Name, "on directory", d.Metadata.PathDisplay)
+	if d.Client.readOnly {
+		return errReadOnly
+	}
+	if err := d.Client.removeXattr(d.Metadata.PathDisplay, d.Metadata.PropertyGroups, req.Name); err != nil {
+		log.Errorln("Unable to remove", req.Name, "of", d.Metadata.PathDisplay, err)
+		return toErrno(err)
+	}
+	return nil
+}
@@ -1,13 +1,23 @@
 module github.com/melinysh/dropboxfs
 
-go 1.12
+go 1.17
 
 require (
 	bazil.org/fuse v0.0.0-20180421153158-65cc252bf669
+	github.com/BurntSushi/toml v0.3.1
 	github.com/cenkalti/backoff v2.2.1+incompatible
 	github.com/dropbox/dropbox-sdk-go-unofficial v5.4.0+incompatible
-	github.com/orcaman/concurrent-map v0.0.0-20190314100340-2693aad1ed75
 	github.com/sirupsen/logrus v1.4.2
-	golang.org/x/net v0.0.0-20190619014844-b5b0513f8c1b
-	golang.org/x/oauth2 v0.0.0-20190604053449-0f29369cfe45 // indirect
+	go.etcd.io/bbolt v1.3.5
+	golang.org/x/crypto v0.0.0-20211117183948-ae814b36b871
+	golang.org/x/net v0.0.0-20211112202133-69e39bad7dc2
+	golang.org/x/oauth2 v0.0.0-20190604053449-0f29369cfe45
+	golang.org/x/term v0.0.0-20201126162022-7de9c90e9dd1
+)
+
+require (
+	github.com/golang/protobuf v1.2.0 // indirect
+	github.com/konsorten/go-windows-terminal-sequences v1.0.1 // indirect
+	golang.org/x/sys v0.10.0 // indirect
+	google.golang.org/appengine v1.4.0 // indirect
 )
@@ -0,0 +1,4 @@
+// Package integration mounts dropboxfs on a temporary mountpoint against the
+// in-memory fake Dropbox server and exercises it through the kernel with
+// ordinary file operations. The tests skip when FUSE is not available.
+package integration
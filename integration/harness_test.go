@@ -0,0 +1,343 @@
+package integration
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	bazil "bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox/files"
+	"github.com/melinysh/dropboxfs/fakedropbox"
+	"github.com/melinysh/dropboxfs/fuse"
+)
+
+// How long to wait for background uploads and remote changes to land.
+const settleTimeout = 15 * time.Second
+
+// Small enough for the large file tests to evict blocks.
+const cacheSize = 16 * 1024 * 1024
+
+type harness struct {
+	t      *testing.T
+	server *fakedropbox.Server
+	cache  string // metadata cache directory, kept across remounts
+	db     *fuse.Dropbox
+	store  *fuse.Store
+	mnt    string
+	conn   *bazil.Conn
+	served chan error
+
+	readOnly bool         // serve with NewReadOnlyDropbox, for remounts to keep
+	root     string       // Dropbox folder mounted, empty for the whole account
+	umask    *os.FileMode // given to SetUmask before serving
+}
+
+// option sets up how a harness serves before it first mounts.
+type option func(h *harness)
+
+// withUmask serves with the umask option.
+func withUmask(umask os.FileMode) option {
+	return func(h *harness) {
+		h.umask = &umask
+	}
+}
+
+func requireFUSE(t *testing.T) {
+	if _, err := os.Stat("/dev/fuse"); err != nil {
+		t.Skip("FUSE is not available:", err)
+	}
+	if _, err := exec.LookPath("fusermount"); err != nil {
+		t.Skip("fusermount is not available:", err)
+	}
+}
+
+// mount serves a fresh dropboxfs backed by a fake account on a temporary
+// mountpoint. seed runs against the fake server before the mount comes up.
+func mount(t *testing.T, seed func(s *fakedropbox.Server), options ...option) *harness {
+	return mountFolder(t, "", seed, options...)
+}
+
+// mountFolder is mount serving the Dropbox folder root instead of the whole
+// account.
+func mountFolder(t *testing.T, root string, seed func(s *fakedropbox.Server), options ...option) *harness {
+	requireFUSE(t)
+	server := fakedropbox.New()
+	if seed != nil {
+		seed(server)
+	}
+	cache, err := ioutil.TempDir("", "dropboxfs-cache")
+	if err != nil {
+		server.Close()
+		t.Fatal(err)
+	}
+	h := &harness{t: t, server: server, cache: cache, root: root}
+	for _, o := range options {
+		o(h)
+	}
+	t.Cleanup(func() {
+		h.unmount()
+		server.Close()
+		os.RemoveAll(cache)
+	})
+	h.start()
+	return h
+}
+
+// nodes serves a fresh dropboxfs backed by a fake account without mounting
+// it, returning its root for tests that call the nodes the way the kernel
+// would. Needs no FUSE.
+func nodes(t *testing.T, seed func(s *fakedropbox.Server)) (*fakedropbox.Server, *fuse.Directory) {
+	server := fakedropbox.New()
+	if seed != nil {
+		seed(server)
+	}
+	cache, err := ioutil.TempDir("", "dropboxfs-cache")
+	if err != nil {
+		server.Close()
+		t.Fatal(err)
+	}
+	blocks, err := fuse.OpenBlockCache(cache, cacheSize)
+	if err != nil {
+		t.Fatal("Unable to open block cache:", err)
+	}
+	root := &fuse.Directory{Metadata: &files.FolderMetadata{}}
+	db := fuse.NewDropbox(fuse.NewSDKBackend(server.Config()), root, blocks)
+	t.Cleanup(func() {
+		db.Close()
+		server.Close()
+		os.RemoveAll(cache)
+	})
+	return server, root
+}
+
+// start mounts dropboxfs, picking up the metadata cache of earlier mounts.
+func (h *harness) start() {
+	t := h.t
+	mnt, err := ioutil.TempDir("", "dropboxfs-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := bazil.Mount(mnt)
+	if err != nil {
+		os.Remove(mnt)
+		t.Skip("Unable to mount:", err)
+	}
+	<-c.Ready
+	if err := c.MountError; err != nil {
+		os.Remove(mnt)
+		t.Fatal("Error from mount point:", err)
+	}
+	h.mnt, h.conn, h.served = mnt, c, make(chan error, 1)
+
+	store, err := fuse.OpenStore(h.cache)
+	if err != nil {
+		t.Fatal("Unable to open metadata cache:", err)
+	}
+	h.store = store
+	blocks, err := fuse.OpenBlockCache(h.cache, cacheSize)
+	if err != nil {
+		t.Fatal("Unable to open block cache:", err)
+	}
+	// Mounted writable either way, so the nodes are what refuses changes
+	newDropbox := fuse.NewDropbox
+	if h.readOnly {
+		newDropbox = fuse.NewReadOnlyDropbox
+	}
+	backend := fuse.NewSubfolderBackend(fuse.NewSDKBackend(h.server.Config()), h.root)
+	db := newDropbox(backend, &fuse.Directory{
+		Metadata: &files.FolderMetadata{},
+	}, blocks)
+	if h.umask != nil {
+		db.SetUmask(*h.umask)
+	}
+	if err := db.Restore(store); err != nil {
+		t.Fatal("Unable to restore metadata cache:", err)
+	}
+	db.StartPolling()
+	h.db = db
+	go func(served chan error) {
+		served <- fs.New(c, nil).Serve(db)
+	}(h.served)
+}
+
+// unmount stops serving the mount. The fake account stays up.
+func (h *harness) unmount() {
+	if h.conn == nil {
+		return
+	}
+	if err := bazil.Unmount(h.mnt); err != nil {
+		h.t.Error("Unable to unmount:", err)
+	}
+	select {
+	case err := <-h.served:
+		if err != nil {
+			h.t.Error("Serve failed:", err)
+		}
+	case <-time.After(settleTimeout):
+		h.t.Error("Serve did not return after unmount")
+	}
+	h.conn.Close()
+	h.conn = nil
+	h.db.Close()
+	h.store.Close()
+	os.Remove(h.mnt)
+}
+
+// path joins elements onto the mountpoint.
+func (h *harness) path(elem ...string) string {
+	return filepath.Join(append([]string{h.mnt}, elem...)...)
+}
+
+func (h *harness) mkdir(elem ...string) {
+	h.t.Helper()
+	if err := os.Mkdir(h.path(elem...), 0700); err != nil {
+		h.t.Fatal(err)
+	}
+}
+
+// openFile opens a file on the mount without registering it with the Go
+// netpoller. Registering polls the file, and the kernel forwards that to this
+// same process while the registering thread holds on to its P, which can stall
+// a garbage collection and with it the goroutines serving the mount.
+func openFile(name string, flag int) (*os.File, error) {
+	fd, err := syscall.Open(name, flag|syscall.O_CLOEXEC, 0600)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	return os.NewFile(uintptr(fd), name), nil
+}
+
+func writeFile(name string, data []byte) error {
+	f, err := openFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func readFile(name string) ([]byte, error) {
+	f, err := openFile(name, os.O_RDONLY)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+func (h *harness) write(data []byte, elem ...string) {
+	h.t.Helper()
+	if err := writeFile(h.path(elem...), data); err != nil {
+		h.t.Fatal(err)
+	}
+}
+
+func (h *harness) read(elem ...string) []byte {
+	h.t.Helper()
+	data, err := readFile(h.path(elem...))
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	return data
+}
+
+// ls lists the names in a directory of the mount, sorted.
+func (h *harness) ls(elem ...string) []string {
+	h.t.Helper()
+	entries, err := ioutil.ReadDir(h.path(elem...))
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	names := []string{}
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names
+}
+
+// eventually retries check until it passes or settleTimeout runs out.
+func (h *harness) eventually(what string, check func() bool) {
+	h.t.Helper()
+	deadline := time.Now().Add(settleTimeout)
+	for !check() {
+		if time.Now().After(deadline) {
+			h.t.Fatal("Timed out waiting for", what)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// waitPolling waits until the mount is watching the account for changes.
+func (h *harness) waitPolling() {
+	h.t.Helper()
+	h.eventually("longpoll", func() bool {
+		return h.server.Calls("files/list_folder/longpoll") > 0
+	})
+}
+
+// waitRemote waits until the fake account holds data at p.
+func (h *harness) waitRemote(p string, data []byte) {
+	h.t.Helper()
+	h.eventually("upload of "+p, func() bool {
+		remote, found := h.server.ReadFile(p)
+		return found && bytes.Equal(remote, data)
+	})
+}
+
+// waitRemoteGone waits until nothing exists at p in the fake account.
+func (h *harness) waitRemoteGone(p string) {
+	h.t.Helper()
+	h.eventually("removal of "+p, func() bool {
+		_, found := h.server.Stat(p)
+		return !found
+	})
+}
+
+// pending lists the uploads queued in the cache.
+func (h *harness) pending() []*fuse.Upload {
+	h.t.Helper()
+	pending, err := fuse.PendingUploads(h.cache)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	return pending
+}
+
+// waitUploaded waits until nothing is left queued for upload.
+func (h *harness) waitUploaded() {
+	h.t.Helper()
+	h.eventually("upload queue to drain", func() bool {
+		return len(h.pending()) == 0
+	})
+}
+
+// xattr returns the extended attribute name of the item at elem.
+func (h *harness) xattr(name string, elem ...string) (string, error) {
+	buf := make([]byte, 1024)
+	n, err := syscall.Getxattr(h.path(elem...), name, buf)
+	if err != nil {
+		return "", err
+	}
+	return string(buf[:n]), nil
+}
+
+func equal(a []string, b ...string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,1528 @@
+package integration
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	bazil "bazil.org/fuse"
+	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox/files"
+	"github.com/melinysh/dropboxfs/fakedropbox"
+	"github.com/melinysh/dropboxfs/fuse"
+	"github.com/melinysh/dropboxfs/oauth"
+)
+
+var testData = []byte("this is a test\n")
+
+func TestMkdir(t *testing.T) {
+	h := mount(t, nil)
+	h.mkdir("testing")
+	if names := h.ls(); !equal(names, "testing") {
+		t.Fatal("Unexpected root listing", names)
+	}
+	if names := h.ls("testing"); !equal(names) {
+		t.Fatal("New directory is not empty", names)
+	}
+	if m, found := h.server.Stat("/testing"); !found || m == nil {
+		t.Fatal("Directory was not created remotely")
+	}
+}
+
+func TestCreateAndRead(t *testing.T) {
+	h := mount(t, nil)
+	h.mkdir("testing")
+	h.write(testData, "testing", "test.txt")
+	if names := h.ls("testing"); !equal(names, "test.txt") {
+		t.Fatal("Unexpected listing", names)
+	}
+	if data := h.read("testing", "test.txt"); !bytes.Equal(data, testData) {
+		t.Fatalf("Read back %q", data)
+	}
+	h.waitRemote("/testing/test.txt", testData)
+}
+
+func TestReadRemoteFile(t *testing.T) {
+	h := mount(t, func(s *fakedropbox.Server) {
+		s.WriteFile("/Docs/readme.md", testData)
+	})
+	if names := h.ls("Docs"); !equal(names, "readme.md") {
+		t.Fatal("Unexpected listing", names)
+	}
+	if data := h.read("Docs", "readme.md"); !bytes.Equal(data, testData) {
+		t.Fatalf("Read back %q", data)
+	}
+	info, err := os.Stat(h.path("Docs", "readme.md"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != int64(len(testData)) {
+		t.Fatal("Unexpected size", info.Size())
+	}
+}
+
+func TestCopy(t *testing.T) {
+	h := mount(t, nil)
+	h.mkdir("testing")
+	h.write(testData, "testing", "test.txt")
+	h.write(h.read("testing", "test.txt"), "testing", "test-copied.txt")
+	if names := h.ls("testing"); !equal(names, "test-copied.txt", "test.txt") {
+		t.Fatal("Unexpected listing", names)
+	}
+	if data := h.read("testing", "test-copied.txt"); !bytes.Equal(data, testData) {
+		t.Fatalf("Read back %q", data)
+	}
+	h.waitRemote("/testing/test-copied.txt", testData)
+}
+
+func TestRenameInDirectory(t *testing.T) {
+	h := mount(t, nil)
+	h.mkdir("testing")
+	h.write(testData, "testing", "test.txt")
+	h.write(testData, "testing", "test-copied.txt")
+	h.waitRemote("/testing/test-copied.txt", testData)
+	if err := os.Rename(h.path("testing", "test-copied.txt"), h.path("testing", "test-moved.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if names := h.ls("testing"); !equal(names, "test-moved.txt", "test.txt") {
+		t.Fatal("Unexpected listing", names)
+	}
+	if data := h.read("testing", "test-moved.txt"); !bytes.Equal(data, testData) {
+		t.Fatalf("Read back moved file %q", data)
+	}
+	if data := h.read("testing", "test.txt"); !bytes.Equal(data, testData) {
+		t.Fatalf("Read back original file %q", data)
+	}
+	h.waitRemote("/testing/test-moved.txt", testData)
+	h.waitRemoteGone("/testing/test-copied.txt")
+}
+
+func TestRenameAcrossLevels(t *testing.T) {
+	h := mount(t, nil)
+	h.mkdir("testing")
+	h.write(testData, "testing", "test.txt")
+	h.mkdir("testing", "subdir")
+	h.write(h.read("testing", "test.txt"), "testing", "subdir", "sub.txt")
+	if names := h.ls("testing", "subdir"); !equal(names, "sub.txt") {
+		t.Fatal("Unexpected subdir listing", names)
+	}
+	if data := h.read("testing", "subdir", "sub.txt"); !bytes.Equal(data, testData) {
+		t.Fatalf("Read back copied file %q", data)
+	}
+	h.waitRemote("/testing/subdir/sub.txt", testData)
+
+	// Up a level
+	if err := os.Rename(h.path("testing", "subdir", "sub.txt"), h.path("testing", "super.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if data := h.read("testing", "super.txt"); !bytes.Equal(data, testData) {
+		t.Fatalf("Read back moved file %q", data)
+	}
+	if names := h.ls("testing", "subdir"); !equal(names) {
+		t.Fatal("Moved file still in subdir", names)
+	}
+	h.waitRemote("/testing/super.txt", testData)
+
+	// And back down again
+	if err := os.Rename(h.path("testing", "super.txt"), h.path("testing", "subdir", "down.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if names := h.ls("testing", "subdir"); !equal(names, "down.txt") {
+		t.Fatal("Unexpected subdir listing", names)
+	}
+	h.waitRemote("/testing/subdir/down.txt", testData)
+	h.waitRemoteGone("/testing/super.txt")
+}
+
+func TestRenameDirectory(t *testing.T) {
+	h := mount(t, nil)
+	h.mkdir("testing")
+	h.mkdir("testing", "before")
+	h.write(testData, "testing", "before", "inner.txt")
+	h.waitRemote("/testing/before/inner.txt", testData)
+	if err := os.Rename(h.path("testing", "before"), h.path("testing", "after")); err != nil {
+		t.Fatal(err)
+	}
+	if names := h.ls("testing"); !equal(names, "after") {
+		t.Fatal("Unexpected listing", names)
+	}
+	if data := h.read("testing", "after", "inner.txt"); !bytes.Equal(data, testData) {
+		t.Fatalf("Read back %q", data)
+	}
+	h.waitRemote("/testing/after/inner.txt", testData)
+	h.waitRemoteGone("/testing/before")
+}
+
+func TestRemove(t *testing.T) {
+	h := mount(t, nil)
+	h.mkdir("testing")
+	h.write(testData, "testing", "test.txt")
+	h.write(testData, "testing", "test-moved.txt")
+	h.waitRemote("/testing/test-moved.txt", testData)
+	if err := os.Remove(h.path("testing", "test-moved.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if names := h.ls("testing"); !equal(names, "test.txt") {
+		t.Fatal("Unexpected listing", names)
+	}
+	h.waitRemoteGone("/testing/test-moved.txt")
+	if err := os.Remove(h.path("testing", "test.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if names := h.ls("testing"); !equal(names) {
+		t.Fatal("Unexpected listing", names)
+	}
+}
+
+func TestRmdir(t *testing.T) {
+	h := mount(t, nil)
+	h.mkdir("testing")
+	h.mkdir("testing", "subdir")
+	if err := os.Remove(h.path("testing", "subdir")); err != nil {
+		t.Fatal(err)
+	}
+	if names := h.ls("testing"); !equal(names) {
+		t.Fatal("Unexpected listing", names)
+	}
+	if err := os.Remove(h.path("testing")); err != nil {
+		t.Fatal(err)
+	}
+	if names := h.ls(); !equal(names) {
+		t.Fatal("Unexpected root listing", names)
+	}
+	h.waitRemoteGone("/testing")
+}
+
+func TestConcurrentWriters(t *testing.T) {
+	h := mount(t, nil)
+	h.mkdir("testing")
+	const writers = 8
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name := h.path("testing", fmt.Sprintf("writer-%d.txt", i))
+			data := bytes.Repeat([]byte(fmt.Sprintf("writer %d\n", i)), 1000)
+			if err := writeFile(name, data); err != nil {
+				errs <- err
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	if names := h.ls("testing"); len(names) != writers {
+		t.Fatal("Unexpected listing", names)
+	}
+	for i := 0; i < writers; i++ {
+		name := fmt.Sprintf("writer-%d.txt", i)
+		data := bytes.Repeat([]byte(fmt.Sprintf("writer %d\n", i)), 1000)
+		if got := h.read("testing", name); !bytes.Equal(got, data) {
+			t.Fatal("Wrong contents for", name)
+		}
+		h.waitRemote("/testing/"+name, data)
+	}
+}
+
+func TestRenameOverExisting(t *testing.T) {
+	h := mount(t, nil)
+	h.mkdir("testing")
+	h.write([]byte("old\n"), "testing", "target.txt")
+	h.write([]byte("new\n"), "testing", "source.txt")
+	h.waitRemote("/testing/target.txt", []byte("old\n"))
+	h.waitRemote("/testing/source.txt", []byte("new\n"))
+	if err := os.Rename(h.path("testing", "source.txt"), h.path("testing", "target.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if names := h.ls("testing"); !equal(names, "target.txt") {
+		t.Fatal("Unexpected listing", names)
+	}
+	if data := h.read("testing", "target.txt"); string(data) != "new\n" {
+		t.Fatalf("Read back %q", data)
+	}
+	h.waitRemote("/testing/target.txt", []byte("new\n"))
+	h.waitRemoteGone("/testing/source.txt")
+}
+
+func TestRenameCaseOnly(t *testing.T) {
+	server, root := nodes(t, func(s *fakedropbox.Server) {
+		s.WriteFile("/foo.txt", testData)
+	})
+	ctx := context.Background()
+	// The kernel looks up both names first, ignoring case both find foo.txt
+	for _, name := range []string{"foo.txt", "Foo.txt"} {
+		if _, err := root.Lookup(ctx, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := root.Rename(ctx, &bazil.RenameRequest{OldName: "foo.txt", NewName: "Foo.txt"}, root); err != nil {
+		t.Fatal(err)
+	}
+	if names := server.List(""); !equal(names, "/Foo.txt") {
+		t.Fatal("Unexpected remote listing", names)
+	}
+	if data, _ := server.ReadFile("/Foo.txt"); !bytes.Equal(data, testData) {
+		t.Fatalf("Remote has %q", data)
+	}
+}
+
+func TestRenameFailureKeepsTarget(t *testing.T) {
+	server, root := nodes(t, func(s *fakedropbox.Server) {
+		s.WriteFile("/source.txt", []byte("new\n"))
+		s.WriteFile("/target.txt", []byte("old\n"))
+	})
+	ctx := context.Background()
+	for _, name := range []string{"source.txt", "target.txt"} {
+		if _, err := root.Lookup(ctx, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Gone by the time it is moved, so the move fails after the target
+	// made way
+	server.Remove("/source.txt")
+	if err := root.Rename(ctx, &bazil.RenameRequest{OldName: "source.txt", NewName: "target.txt"}, root); err != bazil.ENOENT {
+		t.Fatal("Expected ENOENT, got", err)
+	}
+	if names := server.List(""); !equal(names, "/target.txt") {
+		t.Fatal("Unexpected remote listing", names)
+	}
+	if data, _ := server.ReadFile("/target.txt"); string(data) != "old\n" {
+		t.Fatalf("Remote has %q", data)
+	}
+}
+
+func TestRenameFileOverDirectory(t *testing.T) {
+	server, root := nodes(t, func(s *fakedropbox.Server) {
+		s.WriteFile("/file.txt", testData)
+		s.Mkdir("/dir")
+	})
+	ctx := context.Background()
+	for _, name := range []string{"file.txt", "dir"} {
+		if _, err := root.Lookup(ctx, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := root.Rename(ctx, &bazil.RenameRequest{OldName: "file.txt", NewName: "dir"}, root); err != bazil.Errno(syscall.EISDIR) {
+		t.Fatal("Expected EISDIR, got", err)
+	}
+	if err := root.Rename(ctx, &bazil.RenameRequest{OldName: "dir", NewName: "file.txt"}, root); err != bazil.Errno(syscall.ENOTDIR) {
+		t.Fatal("Expected ENOTDIR, got", err)
+	}
+	if names := server.List(""); !equal(names, "/dir", "/file.txt") {
+		t.Fatal("Unexpected remote listing", names)
+	}
+}
+
+func TestRemoveChangedKind(t *testing.T) {
+	// What the kernel looked up as a folder is now a file, and the other
+	// way round
+	server, root := nodes(t, func(s *fakedropbox.Server) {
+		s.WriteFile("/was-dir", testData)
+		s.Mkdir("/was-file")
+	})
+	ctx := context.Background()
+	for _, name := range []string{"was-dir", "was-file"} {
+		if _, err := root.Lookup(ctx, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := root.Remove(ctx, &bazil.RemoveRequest{Name: "was-dir", Dir: true}); err != bazil.Errno(syscall.ENOTDIR) {
+		t.Fatal("Expected ENOTDIR, got", err)
+	}
+	if err := root.Remove(ctx, &bazil.RemoveRequest{Name: "was-file"}); err != bazil.Errno(syscall.EISDIR) {
+		t.Fatal("Expected EISDIR, got", err)
+	}
+	if names := server.List(""); !equal(names, "/was-dir", "/was-file") {
+		t.Fatal("Unexpected remote listing", names)
+	}
+}
+
+func TestDeepTree(t *testing.T) {
+	h := mount(t, nil)
+	levels := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+	if err := os.MkdirAll(h.path(levels...), 0700); err != nil {
+		t.Fatal(err)
+	}
+	h.write(testData, append(levels, "leaf.txt")...)
+	found := []string{}
+	err := filepath.Walk(h.path(), func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			found = append(found, strings.TrimPrefix(p, h.mnt))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf := "/" + strings.Join(levels, "/") + "/leaf.txt"
+	if !equal(found, leaf) {
+		t.Fatal("Unexpected walk", found)
+	}
+	h.waitRemote(leaf, testData)
+	if err := os.Remove(h.path(append(levels, "leaf.txt")...)); err != nil {
+		t.Fatal(err)
+	}
+	for i := len(levels); i > 0; i-- {
+		if err := os.Remove(h.path(levels[:i]...)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h.waitRemoteGone("/a")
+}
+
+func TestLargeFile(t *testing.T) {
+	h := mount(t, nil)
+	// Larger than a single upload chunk and a single content hash block.
+	data := make([]byte, 9*1024*1024+123)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	h.write(data, "large.bin")
+	if got := h.read("large.bin"); !bytes.Equal(got, data) {
+		t.Fatal("Large file read back differently")
+	}
+	h.waitRemote("/large.bin", data)
+}
+
+func TestDownloadRetriesOnRateLimit(t *testing.T) {
+	h := mount(t, func(s *fakedropbox.Server) {
+		s.WriteFile("/limited.txt", testData)
+	})
+	h.server.RateLimitNext("files/download", 2, 0)
+	if data := h.read("limited.txt"); !bytes.Equal(data, testData) {
+		t.Fatalf("Read back %q", data)
+	}
+	if calls := h.server.Calls("files/download"); calls < 3 {
+		t.Fatal("Expected retried downloads, got", calls)
+	}
+}
+
+func TestUploadRetriesOnServerError(t *testing.T) {
+	h := mount(t, nil)
+	h.write([]byte("first\n"), "retry.txt")
+	h.waitRemote("/retry.txt", []byte("first\n"))
+	h.server.FailNext("files/upload", 2, http.StatusInternalServerError, "internal_error")
+	h.write(testData, "retry.txt")
+	h.waitRemote("/retry.txt", testData)
+}
+
+func TestDrainUploadsQueuedChanges(t *testing.T) {
+	h := mount(t, nil)
+	h.db.SetSyncPolicy(fuse.SyncAsync)
+	h.server.FailNext("files/upload", 2, http.StatusInternalServerError, "internal_error")
+	h.write(testData, "drained.txt")
+	ctx, cancel := context.WithTimeout(context.Background(), settleTimeout)
+	defer cancel()
+	if left := h.db.Drain(ctx); left != 0 {
+		t.Fatal("Drain left", left, "uploads queued")
+	}
+	if remote, _ := h.server.ReadFile("/drained.txt"); !bytes.Equal(remote, testData) {
+		t.Fatalf("Uploaded %q", remote)
+	}
+
+	// Gives up when out of time, leaving the rest queued
+	h.server.FailNext("files/upload", 1000, http.StatusInternalServerError, "internal_error")
+	h.write([]byte("stuck\n"), "stuck.txt")
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if left := h.db.Drain(ctx); left != 1 {
+		t.Fatal("Expected one upload left, got", left)
+	}
+	if pending := h.pending(); len(pending) != 1 || pending[0].Path != "/stuck.txt" {
+		t.Fatal("Unexpected upload queue", pending)
+	}
+}
+
+func TestRmdirNotEmpty(t *testing.T) {
+	h := mount(t, nil)
+	h.mkdir("testing")
+	h.write(testData, "testing", "test.txt")
+	if err := os.Remove(h.path("testing")); !errors.Is(err, syscall.ENOTEMPTY) {
+		t.Fatal("Expected ENOTEMPTY, got", err)
+	}
+	if names := h.ls("testing"); !equal(names, "test.txt") {
+		t.Fatal("Unexpected listing", names)
+	}
+	if _, found := h.server.Stat("/testing/test.txt"); !found {
+		t.Fatal("Folder contents were deleted remotely")
+	}
+}
+
+func TestRenameOverNonEmptyDirectory(t *testing.T) {
+	h := mount(t, nil)
+	h.mkdir("source")
+	h.mkdir("target")
+	h.write(testData, "target", "keep.txt")
+	// os.Rename refuses directory targets itself
+	if err := syscall.Rename(h.path("source"), h.path("target")); err != syscall.ENOTEMPTY {
+		t.Fatal("Expected ENOTEMPTY, got", err)
+	}
+	if data := h.read("target", "keep.txt"); !bytes.Equal(data, testData) {
+		t.Fatalf("Read back %q", data)
+	}
+}
+
+func TestCreateWithoutSpace(t *testing.T) {
+	h := mount(t, nil)
+	h.server.FailNext("files/upload", 1, http.StatusConflict, "path/insufficient_space/")
+	if err := writeFile(h.path("full.txt"), testData); !errors.Is(err, syscall.ENOSPC) {
+		t.Fatal("Expected ENOSPC, got", err)
+	}
+	// Still serving
+	h.write(testData, "after.txt")
+	h.waitRemote("/after.txt", testData)
+}
+
+func TestMkdirConflict(t *testing.T) {
+	h := mount(t, nil)
+	h.server.FailNext("files/create_folder_v2", 1, http.StatusConflict, "path/conflict/folder/")
+	if err := os.Mkdir(h.path("taken"), 0700); !errors.Is(err, syscall.EEXIST) {
+		t.Fatal("Expected EEXIST, got", err)
+	}
+}
+
+func TestRemoveRateLimited(t *testing.T) {
+	h := mount(t, nil)
+	h.write(testData, "busy.txt")
+	h.waitRemote("/busy.txt", testData)
+	h.server.FailNext("files/delete_v2", 1, http.StatusConflict, "too_many_write_operations/")
+	if err := os.Remove(h.path("busy.txt")); !errors.Is(err, syscall.EAGAIN) {
+		t.Fatal("Expected EAGAIN, got", err)
+	}
+	if err := os.Remove(h.path("busy.txt")); err != nil {
+		t.Fatal(err)
+	}
+	h.waitRemoteGone("/busy.txt")
+}
+
+func TestListUnauthorized(t *testing.T) {
+	h := mount(t, func(s *fakedropbox.Server) {
+		s.WriteFile("/Private/secret.txt", testData)
+	})
+	if names := h.ls(); !equal(names, "Private") {
+		t.Fatal("Unexpected listing", names)
+	}
+	h.server.SetToken("revoked")
+	if _, err := ioutil.ReadDir(h.path("Private")); !errors.Is(err, syscall.EACCES) {
+		t.Fatal("Expected EACCES, got", err)
+	}
+	h.server.SetToken(fakedropbox.Token)
+	if names := h.ls("Private"); !equal(names, "secret.txt") {
+		t.Fatal("Unexpected listing", names)
+	}
+}
+
+func TestRemoteChangesMergedInPlace(t *testing.T) {
+	h := mount(t, func(s *fakedropbox.Server) {
+		s.WriteFile("/Shared/edited.txt", []byte("old contents\n"))
+		s.WriteFile("/Shared/moved.txt", testData)
+		s.WriteFile("/Shared/gone.txt", testData)
+	})
+	if names := h.ls("Shared"); !equal(names, "edited.txt", "gone.txt", "moved.txt") {
+		t.Fatal("Unexpected listing", names)
+	}
+	if data := h.read("Shared", "edited.txt"); string(data) != "old contents\n" {
+		t.Fatalf("Read back %q", data)
+	}
+	h.waitPolling()
+	listings := h.server.Calls("files/list_folder")
+
+	h.server.WriteFile("/Shared/added.txt", testData)
+	h.server.WriteFile("/Shared/edited.txt", []byte("new contents\n"))
+	h.server.Rename("/Shared/moved.txt", "/Shared/renamed.txt")
+	h.server.Remove("/Shared/gone.txt")
+
+	h.eventually("remote changes", func() bool {
+		return equal(h.ls("Shared"), "added.txt", "edited.txt", "renamed.txt")
+	})
+	if data := h.read("Shared", "edited.txt"); string(data) != "new contents\n" {
+		t.Fatalf("Read back %q", data)
+	}
+	if data := h.read("Shared", "renamed.txt"); !bytes.Equal(data, testData) {
+		t.Fatalf("Read back %q", data)
+	}
+	if calls := h.server.Calls("files/list_folder"); calls != listings {
+		t.Fatal("Folder was listed again after remote changes:", calls-listings, "calls")
+	}
+}
+
+func TestRemoteDirectoryRename(t *testing.T) {
+	h := mount(t, func(s *fakedropbox.Server) {
+		s.WriteFile("/Old/inner/deep.txt", testData)
+	})
+	if names := h.ls("Old", "inner"); !equal(names, "deep.txt") {
+		t.Fatal("Unexpected listing", names)
+	}
+	h.waitPolling()
+	h.server.Rename("/Old", "/New")
+	h.eventually("remote rename", func() bool {
+		return equal(h.ls(), "New")
+	})
+	if names := h.ls("New", "inner"); !equal(names, "deep.txt") {
+		t.Fatal("Unexpected listing", names)
+	}
+	if data := h.read("New", "inner", "deep.txt"); !bytes.Equal(data, testData) {
+		t.Fatalf("Read back %q", data)
+	}
+}
+
+func TestRestartCatchesUpFromCache(t *testing.T) {
+	h := mount(t, func(s *fakedropbox.Server) {
+		s.WriteFile("/Docs/kept.txt", testData)
+		s.WriteFile("/Docs/gone.txt", testData)
+	})
+	if names := h.ls("Docs"); !equal(names, "gone.txt", "kept.txt") {
+		t.Fatal("Unexpected listing", names)
+	}
+	h.waitPolling()
+	h.unmount()
+
+	h.server.WriteFile("/Docs/added.txt", testData)
+	h.server.Remove("/Docs/gone.txt")
+	listings := h.server.Calls("files/list_folder")
+	h.start()
+
+	if names := h.ls(); !equal(names, "Docs") {
+		t.Fatal("Unexpected root listing", names)
+	}
+	if names := h.ls("Docs"); !equal(names, "added.txt", "kept.txt") {
+		t.Fatal("Unexpected listing", names)
+	}
+	if calls := h.server.Calls("files/list_folder"); calls != listings {
+		t.Fatal("Folders were listed again after restart:", calls-listings, "calls")
+	}
+	if data := h.read("Docs", "added.txt"); !bytes.Equal(data, testData) {
+		t.Fatalf("Read back %q", data)
+	}
+}
+
+func TestRestartAfterCursorReset(t *testing.T) {
+	h := mount(t, func(s *fakedropbox.Server) {
+		s.WriteFile("/Docs/kept.txt", testData)
+	})
+	if names := h.ls("Docs"); !equal(names, "kept.txt") {
+		t.Fatal("Unexpected listing", names)
+	}
+	h.waitPolling()
+	h.unmount()
+
+	h.server.WriteFile("/Docs/added.txt", testData)
+	h.server.ResetCursors()
+	h.start()
+
+	if names := h.ls("Docs"); !equal(names, "added.txt", "kept.txt") {
+		t.Fatal("Unexpected listing", names)
+	}
+	// Polling carries on with the new cursor
+	h.server.WriteFile("/Docs/later.txt", testData)
+	h.eventually("remote change", func() bool {
+		return equal(h.ls("Docs"), "added.txt", "kept.txt", "later.txt")
+	})
+}
+
+func TestRereadFromBlockCache(t *testing.T) {
+	h := mount(t, func(s *fakedropbox.Server) {
+		s.WriteFile("/cached.txt", testData)
+	})
+	for i := 0; i < 3; i++ {
+		if data := h.read("cached.txt"); !bytes.Equal(data, testData) {
+			t.Fatalf("Read back %q", data)
+		}
+	}
+	// Cached blocks outlive the mount
+	h.unmount()
+	h.start()
+	if data := h.read("cached.txt"); !bytes.Equal(data, testData) {
+		t.Fatalf("Read back %q", data)
+	}
+	if calls := h.server.Calls("files/download"); calls != 1 {
+		t.Fatal("Expected a single download, got", calls)
+	}
+}
+
+func TestPinnedFilesStayCached(t *testing.T) {
+	pinned := bytes.Repeat([]byte("pinned\n"), 8*1024*1024/7)
+	other := bytes.Repeat([]byte("other\n"), 2*cacheSize/6)
+	h := mount(t, func(s *fakedropbox.Server) {
+		s.WriteFile("/Docs/pinned.bin", pinned)
+		s.WriteFile("/other.bin", other)
+	})
+	if err := fuse.SetPinned(h.cache, "/Docs/pinned.bin", true); err != nil {
+		t.Fatal(err)
+	}
+	// Picked up right away by the next mount
+	h.unmount()
+	h.start()
+	h.eventually("pinned file to download", func() bool {
+		size, err := fuse.CacheUsage(h.cache)
+		return err == nil && size >= int64(len(pinned))
+	})
+	// More than the whole cache, evicting everything it can
+	if data := h.read("other.bin"); !bytes.Equal(data, other) {
+		t.Fatal("Unexpected contents of other.bin")
+	}
+	downloads := h.server.Calls("files/download")
+	if data := h.read("Docs", "pinned.bin"); !bytes.Equal(data, pinned) {
+		t.Fatal("Unexpected contents of pinned.bin")
+	}
+	if calls := h.server.Calls("files/download"); calls != downloads {
+		t.Error("Pinned file was evicted, downloaded it", calls-downloads, "more times")
+	}
+	if pins, err := fuse.Pins(h.cache); err != nil || !equal(pins, "/Docs/pinned.bin") {
+		t.Error("Unexpected pins", pins, err)
+	}
+}
+
+func TestDownloadContentHashMismatch(t *testing.T) {
+	h := mount(t, func(s *fakedropbox.Server) {
+		s.WriteFile("/checked.txt", testData)
+	})
+	// The kernel retries a failed read once by itself
+	h.server.CorruptNextDownloads(2)
+	if _, err := readFile(h.path("checked.txt")); !errors.Is(err, syscall.EIO) {
+		t.Fatal("Expected EIO, got", err)
+	}
+	if data := h.read("checked.txt"); !bytes.Equal(data, testData) {
+		t.Fatalf("Read back %q", data)
+	}
+}
+
+func TestReadLargerThanBlockCache(t *testing.T) {
+	data := make([]byte, 3*cacheSize+123)
+	for i := range data {
+		data[i] = byte(i * 13)
+	}
+	h := mount(t, func(s *fakedropbox.Server) {
+		s.WriteFile("/video.bin", data)
+	})
+	if got := h.read("video.bin"); !bytes.Equal(got, data) {
+		t.Fatal("Large file read back differently")
+	}
+	var cached int64
+	filepath.Walk(filepath.Join(h.cache, "blocks"), func(p string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			cached += info.Size()
+		}
+		return nil
+	})
+	if cached > cacheSize {
+		t.Fatal("Block cache grew to", cached, "bytes")
+	}
+}
+
+// Size of the blocks dropboxfs downloads and caches.
+const blockSize = 4 * 1024 * 1024
+
+func largeData(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i * 13)
+	}
+	return data
+}
+
+// readAt reads size bytes at off of a file on the mount.
+func (h *harness) readAt(off int64, size int, elem ...string) []byte {
+	h.t.Helper()
+	f, err := openFile(h.path(elem...), os.O_RDONLY)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	defer f.Close()
+	buf := make([]byte, size)
+	n, err := f.ReadAt(buf, off)
+	if err != nil && n != size {
+		h.t.Fatal(err)
+	}
+	return buf
+}
+
+func TestReadHeadOfLargeFile(t *testing.T) {
+	data := largeData(10 * blockSize)
+	h := mount(t, func(s *fakedropbox.Server) {
+		s.WriteFile("/big.iso", data)
+	})
+	if got := h.readAt(0, 100, "big.iso"); !bytes.Equal(got, data[:100]) {
+		t.Fatal("Read back differently")
+	}
+	if sent := h.server.Downloaded(); sent > blockSize {
+		t.Fatal("Downloaded", sent, "bytes for a 100 byte read")
+	}
+}
+
+func TestReadAtOffset(t *testing.T) {
+	data := largeData(10 * blockSize)
+	h := mount(t, func(s *fakedropbox.Server) {
+		s.WriteFile("/big.iso", data)
+	})
+	off := int64(7*blockSize + 50)
+	if got := h.readAt(off, 100, "big.iso"); !bytes.Equal(got, data[off:off+100]) {
+		t.Fatal("Read back differently")
+	}
+	if sent := h.server.Downloaded(); sent > blockSize {
+		t.Fatal("Downloaded", sent, "bytes for a 100 byte read")
+	}
+	// Cached blocks are reused
+	if got := h.readAt(off+1000, 10, "big.iso"); !bytes.Equal(got, data[off+1000:off+1010]) {
+		t.Fatal("Read back differently")
+	}
+	if calls := h.server.Calls("files/download"); calls != 1 {
+		t.Fatal("Expected cached blocks to be reused, got", calls, "downloads")
+	}
+}
+
+func TestSequentialReadAhead(t *testing.T) {
+	data := largeData(10 * blockSize)
+	h := mount(t, func(s *fakedropbox.Server) {
+		s.WriteFile("/movie.mkv", data)
+	})
+	h.readAt(0, 100, "movie.mkv")
+	h.readAt(blockSize, 100, "movie.mkv")
+	// The block after the one asked for arrives without being read
+	h.eventually("read ahead", func() bool {
+		return h.server.Downloaded() >= 3*blockSize
+	})
+	if got := h.read("movie.mkv"); !bytes.Equal(got, data) {
+		t.Fatal("Read back differently")
+	}
+}
+
+func TestUploadSession(t *testing.T) {
+	h := mount(t, nil)
+	data := largeData(5*blockSize + 123)
+	h.write(data, "backup.tar")
+	h.waitRemote("/backup.tar", data)
+	for route, want := range map[string]int{
+		"files/upload_session/start":     1,
+		"files/upload_session/append_v2": 1,
+		"files/upload_session/finish":    1,
+	} {
+		if calls := h.server.Calls(route); calls != want {
+			t.Error("Expected", want, "calls to", route, "got", calls)
+		}
+	}
+}
+
+func TestUploadSessionResumes(t *testing.T) {
+	h := mount(t, nil)
+	data := largeData(5*blockSize + 123)
+	// The part arrives but the answer doesn't, so the retry is told the
+	// offset to carry on from
+	h.server.LoseNextResponse("files/upload_session/append_v2", 1)
+	h.write(data, "backup.tar")
+	h.waitRemote("/backup.tar", data)
+	if calls := h.server.Calls("files/upload_session/start"); calls != 1 {
+		t.Fatal("Expected the session to be resumed, got", calls, "sessions")
+	}
+}
+
+func TestUploadQueuedAcrossRestart(t *testing.T) {
+	h := mount(t, nil)
+	h.write([]byte("first\n"), "queued.txt")
+	h.waitRemote("/queued.txt", []byte("first\n"))
+	h.server.SetToken("revoked")
+	h.write(testData, "queued.txt")
+	h.eventually("failed upload", func() bool {
+		pending := h.pending()
+		return len(pending) == 1 && pending[0].Attempts > 0
+	})
+	h.unmount()
+
+	pending := h.pending()
+	if len(pending) != 1 || pending[0].Path != "/queued.txt" || pending[0].Size != int64(len(testData)) {
+		t.Fatalf("Unexpected queue %+v", pending)
+	}
+	h.server.SetToken(fakedropbox.Token)
+	h.server.FailNext("files/upload", 2, http.StatusInternalServerError, "internal_error")
+	h.start()
+	if data := h.read("queued.txt"); !bytes.Equal(data, testData) {
+		t.Fatalf("Read back %q", data)
+	}
+	h.waitRemote("/queued.txt", testData)
+	h.waitUploaded()
+}
+
+func TestRenameWhileUploadPending(t *testing.T) {
+	h := mount(t, nil)
+	h.write([]byte("first\n"), "draft.txt")
+	h.waitRemote("/draft.txt", []byte("first\n"))
+	h.server.FailNext("files/upload", 3, http.StatusInternalServerError, "internal_error")
+	h.write(testData, "draft.txt")
+	if err := os.Rename(h.path("draft.txt"), h.path("final.txt")); err != nil {
+		t.Fatal(err)
+	}
+	h.waitRemote("/final.txt", testData)
+	h.waitUploaded()
+	h.waitRemoteGone("/draft.txt")
+}
+
+func TestRemoveWhileUploadPending(t *testing.T) {
+	h := mount(t, nil)
+	h.write([]byte("first\n"), "scratch.txt")
+	h.waitRemote("/scratch.txt", []byte("first\n"))
+	h.server.FailNext("files/upload", 3, http.StatusInternalServerError, "internal_error")
+	h.write(testData, "scratch.txt")
+	if err := os.Remove(h.path("scratch.txt")); err != nil {
+		t.Fatal(err)
+	}
+	h.waitUploaded()
+	// Let an attempt already under way finish
+	time.Sleep(500 * time.Millisecond)
+	uploads := h.server.Calls("files/upload")
+	time.Sleep(2 * time.Second)
+	if calls := h.server.Calls("files/upload"); calls != uploads {
+		t.Fatal("Uploaded a removed file", calls-uploads, "more times")
+	}
+	if _, found := h.server.Stat("/scratch.txt"); found {
+		t.Fatal("Removed file came back")
+	}
+}
+
+// writeAndSync writes data to name and fsyncs it, returning what fsync said.
+func (h *harness) writeAndSync(data []byte, elem ...string) error {
+	h.t.Helper()
+	f, err := openFile(h.path(elem...), os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		h.t.Fatal(err)
+	}
+	return f.Sync()
+}
+
+func TestFsyncWaitsForUpload(t *testing.T) {
+	h := mount(t, nil)
+	if err := h.writeAndSync(testData, "synced.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if remote, _ := h.server.ReadFile("/synced.txt"); !bytes.Equal(remote, testData) {
+		t.Fatalf("Dropbox has %q after fsync", remote)
+	}
+}
+
+func TestFsyncRetriesServerErrors(t *testing.T) {
+	h := mount(t, nil)
+	h.write([]byte("first\n"), "retried.txt")
+	h.waitRemote("/retried.txt", []byte("first\n"))
+	h.server.FailNext("files/upload", 2, http.StatusInternalServerError, "internal_error")
+	if err := h.writeAndSync(testData, "retried.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if remote, _ := h.server.ReadFile("/retried.txt"); !bytes.Equal(remote, testData) {
+		t.Fatalf("Dropbox has %q after fsync", remote)
+	}
+}
+
+func TestFsyncReportsFailedUpload(t *testing.T) {
+	h := mount(t, nil)
+	h.write([]byte("first\n"), "full.txt")
+	h.waitRemote("/full.txt", []byte("first\n"))
+	h.server.FailNext("files/upload", 1, http.StatusConflict, "path/insufficient_space/")
+	if err := h.writeAndSync(testData, "full.txt"); !errors.Is(err, syscall.EIO) {
+		t.Fatal("Expected EIO, got", err)
+	}
+	// Still queued, goes up once there is room
+	h.waitRemote("/full.txt", testData)
+	h.waitUploaded()
+}
+
+func TestCloseWaitsForUpload(t *testing.T) {
+	h := mount(t, nil)
+	h.db.SetSyncPolicy(fuse.SyncClose)
+	h.write(testData, "closed.txt")
+	if remote, _ := h.server.ReadFile("/closed.txt"); !bytes.Equal(remote, testData) {
+		t.Fatalf("Dropbox has %q after close", remote)
+	}
+	h.server.FailNext("files/upload", 1, http.StatusConflict, "path/insufficient_space/")
+	if err := writeFile(h.path("closed.txt"), []byte("second\n")); !errors.Is(err, syscall.EIO) {
+		t.Fatal("Expected EIO, got", err)
+	}
+}
+
+func TestAsyncFsyncReturnsAtOnce(t *testing.T) {
+	h := mount(t, nil)
+	h.db.SetSyncPolicy(fuse.SyncAsync)
+	h.write([]byte("first\n"), "async.txt")
+	h.waitRemote("/async.txt", []byte("first\n"))
+	h.server.SetToken("revoked")
+	if err := h.writeAndSync(testData, "async.txt"); err != nil {
+		t.Fatal(err)
+	}
+	h.server.SetToken(fakedropbox.Token)
+	h.waitRemote("/async.txt", testData)
+}
+
+func TestConflictKeepsBoth(t *testing.T) {
+	h := mount(t, nil)
+	h.write([]byte("first\n"), "notes.txt")
+	h.waitRemote("/notes.txt", []byte("first\n"))
+	f, err := openFile(h.path("notes.txt"), os.O_WRONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("ours!\n")); err != nil {
+		t.Fatal(err)
+	}
+	// A colleague saves the same file elsewhere before we close it
+	h.server.WriteFile("/notes.txt", []byte("theirs\n"))
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	h.waitUploaded()
+
+	if remote, _ := h.server.ReadFile("/notes.txt"); string(remote) != "theirs\n" {
+		t.Fatalf("Dropbox has %q, their change was overwritten", remote)
+	}
+	conflicts, err := fuse.Conflicts(h.cache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conflicts) != 1 || conflicts[0].Path != "/notes.txt" || !strings.Contains(conflicts[0].Copy, "conflicted copy") {
+		t.Fatalf("Unexpected conflicts %+v", conflicts)
+	}
+	if remote, _ := h.server.ReadFile(conflicts[0].Copy); string(remote) != "ours!\n" {
+		t.Fatalf("Conflicted copy has %q", remote)
+	}
+	h.eventually("their change", func() bool {
+		return string(h.read("notes.txt")) == "theirs\n"
+	})
+}
+
+func TestModificationTimes(t *testing.T) {
+	h := mount(t, func(s *fakedropbox.Server) {
+		s.WriteFile("/dated.txt", testData)
+	})
+	m, _ := h.server.Stat("/dated.txt")
+	info, err := os.Stat(h.path("dated.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := m.(*files.FileMetadata).ClientModified; !info.ModTime().Equal(want) {
+		t.Fatal("Modified at", info.ModTime(), "rather than", want)
+	}
+
+	touched := time.Date(2015, 10, 21, 16, 29, 0, 0, time.UTC)
+	if err := os.Chtimes(h.path("dated.txt"), touched, touched); err != nil {
+		t.Fatal(err)
+	}
+	h.eventually("upload of new time", func() bool {
+		m, _ := h.server.Stat("/dated.txt")
+		return m.(*files.FileMetadata).ClientModified.Equal(touched)
+	})
+	if data, _ := h.server.ReadFile("/dated.txt"); !bytes.Equal(data, testData) {
+		t.Fatalf("Dropbox has %q after touch", data)
+	}
+	if info, err = os.Stat(h.path("dated.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if !info.ModTime().Equal(touched) {
+		t.Fatal("Modified at", info.ModTime(), "rather than", touched)
+	}
+}
+
+func TestSetattrSameModificationTime(t *testing.T) {
+	server, root := nodes(t, func(s *fakedropbox.Server) {
+		s.WriteFile("/dated.txt", testData)
+	})
+	ctx := context.Background()
+	node, err := root.Lookup(ctx, "dated.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := node.(*fuse.File)
+	var attr bazil.Attr
+	if err := f.Attr(ctx, &attr); err != nil {
+		t.Fatal(err)
+	}
+	// As rsync -t sets it, with the nanoseconds Dropbox doesn't keep
+	req := &bazil.SetattrRequest{Valid: bazil.SetattrMtime, Mtime: attr.Mtime.Add(500 * time.Millisecond)}
+	if err := f.Setattr(ctx, req, &bazil.SetattrResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	if f.NeedsUpload {
+		t.Error("Queued for upload without changes")
+	}
+	for _, route := range []string{"files/download", "files/upload"} {
+		if calls := server.Calls(route); calls != 0 {
+			t.Error("Unexpected calls to", route, calls)
+		}
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	h := mount(t, func(s *fakedropbox.Server) {
+		s.WriteFile("/long.txt", []byte("a longer line\n"))
+		s.WriteFile("/cut.txt", []byte("cut me short\n"))
+	})
+	if err := os.Truncate(h.path("cut.txt"), 6); err != nil {
+		t.Fatal(err)
+	}
+	h.waitRemote("/cut.txt", []byte("cut me"))
+	if data := h.read("cut.txt"); string(data) != "cut me" {
+		t.Fatalf("Read back %q", data)
+	}
+	// Rewriting with O_TRUNC must not leave the old tail behind
+	h.write([]byte("short\n"), "long.txt")
+	h.waitRemote("/long.txt", []byte("short\n"))
+}
+
+func TestChmod(t *testing.T) {
+	h := mount(t, func(s *fakedropbox.Server) {
+		s.WriteFile("/Scripts/run.sh", testData)
+	})
+	if err := os.Chmod(h.path("Scripts", "run.sh"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(h.path("Scripts"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if groups := h.server.Properties("/Scripts/run.sh"); len(groups) != 1 {
+		t.Fatalf("Unexpected properties %+v", groups)
+	}
+	// Changing the contents keeps the mode
+	h.write([]byte("#!/bin/sh\n"), "Scripts", "run.sh")
+	h.waitRemote("/Scripts/run.sh", []byte("#!/bin/sh\n"))
+	h.waitUploaded()
+	for name, want := range map[string]os.FileMode{"Scripts": os.ModeDir | 0755, "Scripts/run.sh": 0750} {
+		info, err := os.Stat(h.path(name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode() != want {
+			t.Fatal(name, "has mode", info.Mode(), "rather than", want)
+		}
+	}
+	if err := os.Chown(h.path("Scripts", "run.sh"), os.Getuid()+1, -1); !errors.Is(err, syscall.EPERM) {
+		t.Fatal("Expected EPERM changing the owner, got", err)
+	}
+}
+
+func TestChmodAfterTemplateLookupFailed(t *testing.T) {
+	server, root := nodes(t, func(s *fakedropbox.Server) {
+		s.WriteFile("/run.sh", testData)
+		// Offline while mounting
+		s.FailNext("file_properties/templates/list_for_user", 1, 500, "internal_error/")
+	})
+	ctx := context.Background()
+	node, err := root.Lookup(ctx, "run.sh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := node.(*fuse.File)
+	req := &bazil.SetattrRequest{Valid: bazil.SetattrMode, Mode: 0750}
+	if err := f.Setattr(ctx, req, &bazil.SetattrResponse{}); err != nil {
+		t.Fatal("chmod failed once Dropbox answered again:", err)
+	}
+	if groups := server.Properties("/run.sh"); len(groups) != 1 {
+		t.Fatalf("Unexpected properties %+v", groups)
+	}
+	var attr bazil.Attr
+	if err := f.Attr(ctx, &attr); err != nil {
+		t.Fatal(err)
+	}
+	if attr.Mode != 0750 {
+		t.Fatal("Has mode", attr.Mode)
+	}
+}
+
+func TestUmask(t *testing.T) {
+	h := mount(t, func(s *fakedropbox.Server) {
+		s.WriteFile("/Shared/notes.txt", testData)
+		s.WriteFile("/Shared/run.sh", testData)
+	}, withUmask(027))
+	if err := os.Chmod(h.path("Shared", "run.sh"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]os.FileMode{"Shared": os.ModeDir | 0750, "Shared/notes.txt": 0750, "Shared/run.sh": 0750} {
+		info, err := os.Stat(h.path(name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode() != want {
+			t.Error(name, "has mode", info.Mode(), "rather than", want)
+		}
+	}
+}
+
+// inode returns the inode number stat reports for name.
+func (h *harness) inode(elem ...string) uint64 {
+	h.t.Helper()
+	info, err := os.Stat(h.path(elem...))
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	return info.Sys().(*syscall.Stat_t).Ino
+}
+
+func TestStableInodes(t *testing.T) {
+	h := mount(t, func(s *fakedropbox.Server) {
+		for i := 0; i < 50; i++ {
+			s.WriteFile(fmt.Sprintf("/Many/%02d.txt", i), testData)
+		}
+	})
+	seen := map[uint64]string{h.inode(): "/"}
+	for _, name := range h.ls("Many") {
+		ino := h.inode("Many", name)
+		if other, found := seen[ino]; found {
+			t.Fatal(name, "has the same inode as", other)
+		}
+		seen[ino] = name
+	}
+	before := h.inode("Many", "07.txt")
+	if err := os.Rename(h.path("Many", "07.txt"), h.path("Many", "seven.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if ino := h.inode("Many", "seven.txt"); ino != before {
+		t.Fatal("Inode changed from", before, "to", ino, "on rename")
+	}
+	h.unmount()
+	h.start()
+	if ino := h.inode("Many", "seven.txt"); ino != before {
+		t.Fatal("Inode changed from", before, "to", ino, "on restart")
+	}
+}
+
+func TestStatfsReportsQuota(t *testing.T) {
+	h := mount(t, func(s *fakedropbox.Server) {
+		s.SetQuota(64 * 1024 * 1024)
+		s.WriteFile("/used.bin", largeData(16*1024*1024))
+	})
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(h.mnt, &st); err != nil {
+		t.Fatal(err)
+	}
+	total, free := st.Blocks*uint64(st.Bsize), st.Bavail*uint64(st.Bsize)
+	if total != 64*1024*1024 || free != 48*1024*1024 {
+		t.Fatal("Reported", free, "free of", total)
+	}
+	// Answered from the cache for a while
+	calls := h.server.Calls("users/get_space_usage")
+	if err := syscall.Statfs(h.mnt, &st); err != nil {
+		t.Fatal(err)
+	}
+	if h.server.Calls("users/get_space_usage") != calls {
+		t.Fatal("Asked Dropbox again right away")
+	}
+}
+
+func TestXattrsExposeMetadata(t *testing.T) {
+	var m *files.FileMetadata
+	h := mount(t, func(s *fakedropbox.Server) {
+		m = s.WriteFile("/Docs/report.txt", testData)
+	})
+	want := map[string]string{
+		"user.dropbox.id":              m.Id,
+		"user.dropbox.rev":             m.Rev,
+		"user.dropbox.content_hash":    fakedropbox.ContentHash(testData),
+		"user.dropbox.server_modified": m.ServerModified.UTC().Format(time.RFC3339),
+	}
+	for name, value := range want {
+		if got, err := h.xattr(name, "Docs", "report.txt"); err != nil || got != value {
+			t.Fatalf("%s is %q, want %q: %v", name, got, value, err)
+		}
+	}
+	buf := make([]byte, 1024)
+	n, err := syscall.Listxattr(h.path("Docs", "report.txt"), buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listed := map[string]bool{}
+	for _, name := range strings.Split(string(buf[:n]), "\x00") {
+		listed[name] = true
+	}
+	for name := range want {
+		if !listed[name] {
+			t.Fatal(name, "not listed")
+		}
+	}
+	folder, _ := h.server.Stat("/Docs")
+	if got, err := h.xattr("user.dropbox.id", "Docs"); err != nil || got != folder.(*files.FolderMetadata).Id {
+		t.Fatal("Folder id is", got, err)
+	}
+	if _, err := h.xattr("user.dropbox.nonsense", "Docs", "report.txt"); !errors.Is(err, syscall.ENODATA) {
+		t.Fatal("Unknown attribute gave", err)
+	}
+	// Local changes no longer match the hash on Dropbox
+	f, err := os.OpenFile(h.path("Docs", "report.txt"), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Write(testData); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.xattr("user.dropbox.content_hash", "Docs", "report.txt"); !errors.Is(err, syscall.ENODATA) {
+		t.Fatal("Content hash of unsaved changes gave", err)
+	}
+}
+
+func TestUserXattrsKeptInProperties(t *testing.T) {
+	h := mount(t, func(s *fakedropbox.Server) {
+		s.WriteFile("/Docs/report.txt", testData)
+	})
+	file := h.path("Docs", "report.txt")
+	if err := syscall.Setxattr(file, "user.project", []byte("foo"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Setxattr(h.path("Docs"), "user.project", []byte("bar"), 0); err != nil {
+		t.Fatal(err)
+	}
+	saved := func(p string) string {
+		for _, g := range h.server.Properties(p) {
+			for _, f := range g.Fields {
+				if f.Name == "project" {
+					return f.Value
+				}
+			}
+		}
+		return ""
+	}
+	if saved("/Docs/report.txt") != "foo" || saved("/Docs") != "bar" {
+		t.Fatal("Attributes not kept on Dropbox", h.server.Properties("/Docs/report.txt"))
+	}
+	if err := syscall.Setxattr(file, "user.project", []byte("baz"), 0x1); !errors.Is(err, syscall.EEXIST) {
+		t.Fatal("Creating an existing attribute gave", err)
+	}
+	if err := syscall.Setxattr(file, "user.dropbox.rev", []byte("1"), 0); !errors.Is(err, syscall.EPERM) {
+		t.Fatal("Setting Dropbox metadata gave", err)
+	}
+	h.unmount()
+	h.start()
+	if value, err := h.xattr("user.project", "Docs", "report.txt"); err != nil || value != "foo" {
+		t.Fatalf("Read back %q after remount: %v", value, err)
+	}
+	if err := syscall.Removexattr(file, "user.project"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.xattr("user.project", "Docs", "report.txt"); !errors.Is(err, syscall.ENODATA) {
+		t.Fatal("Removed attribute gave", err)
+	}
+	if saved("/Docs/report.txt") != "" {
+		t.Fatal("Attribute still on Dropbox")
+	}
+}
+
+func TestReadOnlyRefusesChanges(t *testing.T) {
+	h := mount(t, func(s *fakedropbox.Server) {
+		s.WriteFile("/Docs/report.txt", testData)
+	})
+	h.unmount()
+	h.readOnly = true
+	h.start()
+	if data := h.read("Docs", "report.txt"); !bytes.Equal(data, testData) {
+		t.Fatalf("Read back %q", data)
+	}
+	changes := map[string]func() error{
+		"create": func() error { return writeFile(h.path("Docs", "new.txt"), testData) },
+		"write": func() error {
+			f, err := os.OpenFile(h.path("Docs", "report.txt"), os.O_WRONLY, 0)
+			if err == nil {
+				f.Close()
+			}
+			return err
+		},
+		"mkdir":    func() error { return os.Mkdir(h.path("Docs", "Sub"), 0700) },
+		"rename":   func() error { return os.Rename(h.path("Docs", "report.txt"), h.path("Docs", "moved.txt")) },
+		"remove":   func() error { return os.Remove(h.path("Docs", "report.txt")) },
+		"chmod":    func() error { return os.Chmod(h.path("Docs", "report.txt"), 0600) },
+		"setxattr": func() error { return syscall.Setxattr(h.path("Docs"), "user.project", []byte("foo"), 0) },
+	}
+	for name, change := range changes {
+		if err := change(); !errors.Is(err, syscall.EROFS) {
+			t.Error(name, "gave", err)
+		}
+	}
+	if names := h.server.List("/Docs"); !equal(names, "/Docs/report.txt") {
+		t.Fatal("Dropbox changed", names)
+	}
+	if data, _ := h.server.ReadFile("/Docs/report.txt"); !bytes.Equal(data, testData) {
+		t.Fatalf("Dropbox has %q", data)
+	}
+}
+
+func TestMountSubfolder(t *testing.T) {
+	h := mountFolder(t, "/Team/Projects/foo", func(s *fakedropbox.Server) {
+		s.WriteFile("/Team/Projects/foo/readme.md", testData)
+		s.WriteFile("/Team/Projects/foo/src/main.go", testData)
+		s.WriteFile("/Team/other.txt", testData)
+	})
+	if names := h.ls(); !equal(names, "readme.md", "src") {
+		t.Fatal("Unexpected root listing", names)
+	}
+	if data := h.read("src", "main.go"); !bytes.Equal(data, testData) {
+		t.Fatalf("Read back %q", data)
+	}
+	h.write(testData, "notes.txt")
+	h.waitRemote("/Team/Projects/foo/notes.txt", testData)
+	h.mkdir("docs")
+	if err := os.Rename(h.path("readme.md"), h.path("docs", "readme.md")); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := h.server.Stat("/Team/Projects/foo/docs/readme.md"); !found {
+		t.Fatal("Rename did not happen below the folder")
+	}
+
+	h.waitPolling()
+	listings := h.server.Calls("files/list_folder/continue")
+	h.server.WriteFile("/Team/elsewhere.txt", testData)
+	time.Sleep(500 * time.Millisecond)
+	if calls := h.server.Calls("files/list_folder/continue"); calls != listings {
+		t.Fatal("Changes outside the folder were fetched")
+	}
+	h.server.WriteFile("/Team/Projects/foo/remote.txt", testData)
+	h.eventually("remote change", func() bool {
+		return equal(h.ls(), "docs", "notes.txt", "remote.txt", "src")
+	})
+}
+
+func TestAuthRefreshesToken(t *testing.T) {
+	server := fakedropbox.New()
+	defer server.Close()
+	server.SetToken("") // Only tokens from the flow are accepted
+	server.SetTokenLifetime(time.Second)
+	server.WriteFile("/a.txt", testData)
+
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	flow, err := oauth.NewFlow("app", server.OAuthEndpoint(), oauth.LocalRedirect(l))
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan *oauth.Token, 1)
+	go func() {
+		token, err := flow.Receive(context.Background(), l)
+		if err != nil {
+			t.Error("Unable to receive code:", err)
+		}
+		received <- token
+	}()
+	// Stands in for the browser, following the redirect back to the listener
+	resp, err := http.Get(flow.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	token := <-received
+	if token == nil || token.RefreshToken == "" {
+		t.Fatal("No refresh token from authorization", token)
+	}
+
+	var saved *oauth.Token
+	config := server.Config()
+	config.Client = oauth.Client(token, server.OAuthEndpoint(), func(refreshed *oauth.Token) { saved = refreshed })
+	backend := fuse.NewSDKBackend(config)
+	for i := 0; i < 2; i++ {
+		if _, err := backend.GetMetadata("/a.txt"); err != nil {
+			t.Fatal("Request with refreshed token failed:", err)
+		}
+		time.Sleep(time.Second)
+	}
+	if calls := server.Calls("oauth2/token"); calls < 3 {
+		t.Error("Expected a refresh for each request after the exchange, got", calls, "token requests")
+	}
+	if saved == nil || saved.AccessToken == token.AccessToken || saved.RefreshToken != token.RefreshToken {
+		t.Error("Unexpected saved token", saved)
+	}
+}
+
+func TestAuthPasteCode(t *testing.T) {
+	server := fakedropbox.New()
+	defer server.Close()
+
+	flow, err := oauth.NewFlow("app", server.OAuthEndpoint(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Get(flow.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := flow.Exchange(context.Background(), strings.TrimSpace(string(code)))
+	if err != nil {
+		t.Fatal("Unable to exchange pasted code:", err)
+	}
+	if token.RefreshToken == "" || token.AccessToken == "" {
+		t.Error("Unexpected token", token)
+	}
+	// Codes are good for one exchange only
+	if _, err := flow.Exchange(context.Background(), strings.TrimSpace(string(code))); err == nil {
+		t.Error("Exchanged the same code twice")
+	}
+}
+
+func TestTokenStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dropboxfs-tokens")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dropboxfs", "tokens")
+
+	store, err := oauth.OpenStore(path, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	work := &oauth.Token{AppKey: "app", RefreshToken: "refresh-work"}
+	if err := store.Put("work", work); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put("home", &oauth.Token{AppKey: "app", RefreshToken: "refresh-home"}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("refresh-work")) {
+		t.Error("Token store holds tokens in plaintext")
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Error("Token store readable by others", info.Mode(), err)
+	}
+
+	if _, err := oauth.OpenStore(path, []byte("wrong")); err == nil {
+		t.Error("Opened token store with the wrong passphrase")
+	}
+	store, err = oauth.OpenStore(path, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names, err := store.Accounts(); err != nil || !equal(names, "home", "work") {
+		t.Error("Unexpected accounts", names, err)
+	}
+	if got, err := store.Get("work"); err != nil || *got != *work {
+		t.Error("Unexpected token of work", got, err)
+	}
+	if err := store.Put("work", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get("work"); err != oauth.ErrNoAccount {
+		t.Error("Removed account still has a token", err)
+	}
+}
@@ -1,16 +1,16 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
-	"flag"
-	"io/ioutil"
+	"context"
+	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
 	"runtime"
+	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	_ "expvar"
 	_ "net/http/pprof"
@@ -20,18 +20,69 @@ import (
 	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox"
 	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox/files"
 	"github.com/melinysh/dropboxfs/fuse"
+	"github.com/melinysh/dropboxfs/oauth"
 
 	log "github.com/sirupsen/logrus"
 )
 
-func main() {
+// commands are the subcommands, by name.
+var commands = map[string]func(args []string){
+	"mount":   runMount,
+	"unmount": runUnmount,
+	"status":  runStatus,
+	"auth":    runAuth,
+	"cache":   runCache,
+	"pin":     runPin,
+}
 
-	verbosePtr := flag.Bool("v", false, "Enable verbose output")
-	mountpointPtr := flag.String("m", "", "Path to FUSE mountpoint")
-	tokenFilePtr := flag.String("t", "", "Path to file that contains Dropbox access token")
-	stats := flag.Bool("e", false, "Expvar stats on 8080")
+const usage = `Usage: dropboxfs <command> [flags] [mount]
 
-	flag.Parse()
+Commands:
+  mount    Mount Dropbox
+  unmount  Unmount a mount
+  status   List changes waiting to be uploaded and conflicted copies
+  auth     Authorize dropboxfs with a Dropbox account
+  cache    Show or clear the cache of a mount
+  pin      Keep files cached, or list the pinned ones
+
+Mounts are named by mountpoint, or by name when described in the config file.
+Run dropboxfs <command> -h for the flags of a command.
+`
+
+func main() {
+	log.SetFormatter(&log.TextFormatter{
+		FullTimestamp: true,
+	})
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if run, found := commands[os.Args[1]]; found {
+		run(os.Args[2:])
+		return
+	}
+	if strings.HasPrefix(os.Args[1], "-") && os.Args[1] != "-h" && os.Args[1] != "-help" {
+		// Flags alone mount, as before there were commands
+		runMount(os.Args[1:])
+		return
+	}
+	if isHelperCall(os.Args[1:]) {
+		runHelper(os.Args[1:])
+		return
+	}
+	fmt.Fprint(os.Stderr, usage)
+	os.Exit(2)
+}
+
+// runMount mounts Dropbox and serves it until unmounted.
+func runMount(args []string) {
+	flags := newMountFlags("mount")
+	flags.addSettings()
+	verbosePtr := flags.Bool("v", false, "Enable verbose output")
+	stats := flags.Bool("e", false, "Expvar stats on 8080")
+	drainTimeoutPtr := flags.Duration("drain-timeout", time.Minute, "How long to wait for queued uploads when stopped by a signal before unmounting, the rest go up next time")
+	flags.Parse(args)
+	parent := reportToParent()
 
 	if *stats {
 		runtime.SetMutexProfileFraction(5)
@@ -45,47 +96,78 @@ func main() {
 		log.SetLevel(log.DebugLevel)
 	}
 
-	log.SetFormatter(&log.TextFormatter{
-		FullTimestamp: true,
-	})
-
-	// demand mountpoint
-	if *mountpointPtr == "" {
-		log.Infoln("You must provide a mountpoint with -m")
-		flag.PrintDefaults()
+	m, err := flags.mount(flags.Arg(0))
+	if err != nil {
+		log.Infoln(err)
+		flags.PrintDefaults()
 		os.Exit(1)
 	}
-
-	// if no token file provided, ask for one and write it to disk
-	if *tokenFilePtr == "" {
-		reader := bufio.NewReader(os.Stdin)
-		log.Print("Enter Dropbox access token: ")
-		t, err := reader.ReadString('\n')
-		if err != nil {
-			log.Infoln("Unable to read input", err)
-			os.Exit(1)
-		}
-		token := strings.TrimSpace(t)
-		*tokenFilePtr = "./dropbox_token"
-		if err = ioutil.WriteFile(*tokenFilePtr, []byte(token), 0600); err != nil {
-			log.Infoln("Unable to write dropbox token into", *tokenFilePtr, err)
-			os.Exit(1)
+	syncPolicy, err := fuse.ParseSyncPolicy(m.Sync)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	var umask uint64
+	if m.Umask != "" {
+		if umask, err = strconv.ParseUint(m.Umask, 8, 32); err != nil {
+			log.Fatalln("Invalid umask", m.Umask)
 		}
-		log.Printf("Saved your token to %v\ndropboxfs can use this file later by providing the flag `-t %v`\n", *tokenFilePtr, *tokenFilePtr)
 	}
 
-	tokenData, err := ioutil.ReadFile(*tokenFilePtr)
+	cacheDir := m.cacheDir()
+	if err := os.MkdirAll(cacheDir, 0700); err != nil {
+		log.Fatalln("Unable to create cache directory", cacheDir, err)
+	}
+	token, save, err := loadToken(m.Account)
 	if err != nil {
-		log.Fatalln("Unable to open token file", *tokenFilePtr, err)
+		log.Fatalln(err)
+	}
+	if m.Background && !isDaemon() {
+		background(m.logFile())
+	}
+	pidFile := m.pidFile()
+	if err := writePidFile(pidFile); err != nil {
+		log.Fatalln(err)
 	}
+	defer os.Remove(pidFile)
+	log.RegisterExitHandler(func() {
+		os.Remove(pidFile)
+	})
 
-	// Files properly end in \n, trim this off to avoid auth issues.
-	token := string(bytes.TrimSpace(tokenData))
+	config := dropbox.Config{
+		LogLevel: logLevel,
+	}
+	if token.RefreshToken == "" {
+		log.Warnln("Using a long-lived access token, run `dropboxfs auth` to replace it")
+		config.Token = token.AccessToken
+	} else {
+		config.Client = oauth.Client(token, oauth.Endpoint, save)
+	}
+	backend := fuse.NewSDKBackend(config)
+	if root := strings.Trim(m.Root, "/"); root != "" {
+		// Dropbox paths start with a slash, the subfolder backend adds it too
+		root = "/" + root
+		meta, err := backend.GetMetadata(root)
+		if err != nil {
+			log.Fatalln("Unable to find folder", root, err)
+		}
+		if _, ok := meta.(*files.FolderMetadata); !ok {
+			log.Fatalln(root, "is not a folder")
+		}
+		backend = fuse.NewSubfolderBackend(backend, root)
+	}
 
-	log.Infoln("Will try to mount to mountpoint", *mountpointPtr)
+	log.Infoln("Will try to mount to mountpoint", m.Mountpoint)
 	// Always try to unmount in case there was dirty exit
-	bazil.Unmount(*mountpointPtr)
-	c, err := bazil.Mount(*mountpointPtr)
+	bazil.Unmount(m.Mountpoint)
+	var options []bazil.MountOption
+	if m.ReadOnly {
+		options = append(options, bazil.ReadOnly())
+	}
+	if m.AllowOther {
+		// Or everyone could do anything, whatever the modes say
+		options = append(options, bazil.AllowOther(), bazil.DefaultPermissions())
+	}
+	c, err := bazil.Mount(m.Mountpoint, options...)
 	if err != nil {
 		log.Fatalln("Unable to mount:", err)
 	}
@@ -100,35 +182,85 @@ func main() {
 		log.Fatalf("kernel FUSE support is too old to have invalidations: version %v\n", p)
 	}
 	cleanup := func() {
-		bazil.Unmount(*mountpointPtr)
+		bazil.Unmount(m.Mountpoint)
 	}
-
-	cSignals := make(chan os.Signal)
+	// Handled once there is something to shut down
+	cSignals := make(chan os.Signal, 1)
 	signal.Notify(cSignals, os.Interrupt, syscall.SIGTERM)
-	go func() {
-		<-cSignals
-		cleanup()
-		os.Exit(1)
-	}()
 
 	defer cleanup()
 
-	config := dropbox.Config{
-		Token:    token,
-		LogLevel: logLevel,
-	}
-
-	client := files.New(config)
 	rootDir := &fuse.Directory{
 		Metadata: &files.FolderMetadata{},
 	}
-	db := fuse.NewDropbox(client, rootDir)
+	blocks, err := fuse.OpenBlockCache(cacheDir, m.CacheSize*1024*1024)
+	if err != nil {
+		log.Fatalln("Unable to open file cache in", cacheDir, err)
+	}
+	newDropbox := fuse.NewDropbox
+	if m.ReadOnly {
+		newDropbox = fuse.NewReadOnlyDropbox
+	}
+	// Opened first so it is closed last, after the uploads and saves
+	store, err := fuse.OpenStore(cacheDir)
+	if err != nil {
+		log.Fatalln("Unable to open metadata cache in", cacheDir, err)
+	}
+	defer store.Close()
+	// Before the uploads queued in the cache start going up
+	if err := store.Claim(backend); err != nil {
+		log.Fatalln(err)
+	}
+	db := newDropbox(backend, rootDir, blocks)
+	defer db.Close()
+	db.SetSyncPolicy(syncPolicy)
+	db.SetOwner(uint32(*m.UID), uint32(*m.GID))
+	if m.Umask != "" {
+		db.SetUmask(os.FileMode(umask))
+	}
+
+	if err := db.Restore(store); err != nil {
+		log.Fatalln("Unable to load metadata cache from", cacheDir, err)
+	}
+	db.StartPolling()
+	go shutdownOnSignal(cSignals, db, m.Mountpoint, *drainTimeoutPtr)
 
 	srv := fs.New(c, nil)
 	log.Infoln("Ready to serve FUSE")
+	parent.ready()
 	err = srv.Serve(db)
 	if err != nil {
 		log.Fatalln("Unable to serve filesystem:", err)
 	}
 	log.Infoln("Shutting down gracefully...")
+	if pending, err := fuse.PendingUploads(cacheDir); err == nil && len(pending) > 0 {
+		log.Infoln(len(pending), "changes stay queued for the next mount")
+	}
+}
+
+// shutdownOnSignal unmounts when told to stop, once the changes queued for
+// upload went up or timeout ran out. A second signal stops waiting for them.
+// Unmounting fails while files are open, a signal after that tries again.
+func shutdownOnSignal(signals <-chan os.Signal, db *fuse.Dropbox, mountpoint string, timeout time.Duration) {
+	for range signals {
+		log.Infoln("Uploading queued changes before unmounting, signal again to skip")
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		stopped := make(chan struct{})
+		go func() {
+			select {
+			case <-signals:
+				cancel()
+			case <-stopped:
+			}
+		}()
+		left := db.Drain(ctx)
+		close(stopped)
+		cancel()
+		if left > 0 {
+			log.Warnln(left, "changes not uploaded yet, they go up the next time it is mounted")
+		}
+		if err := bazil.Unmount(mountpoint); err != nil {
+			log.Errorln("Unable to unmount, are files still open?", err)
+		}
+	}
 }
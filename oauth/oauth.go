@@ -0,0 +1,198 @@
+// Package oauth gets dropboxfs access to a Dropbox account through the OAuth2
+// authorization code flow with PKCE, and keeps the short-lived access tokens
+// Dropbox hands out fresh with the refresh token that comes along.
+package oauth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+)
+
+// Endpoint is where Dropbox authorizes apps and hands out tokens. There is
+// no client secret with PKCE, so only the app key goes along.
+var Endpoint = oauth2.Endpoint{
+	AuthURL:   "https://www.dropbox.com/oauth2/authorize",
+	TokenURL:  "https://api.dropboxapi.com/oauth2/token",
+	AuthStyle: oauth2.AuthStyleInParams,
+}
+
+// Access tokens are refreshed this long before they expire, so a request
+// never goes out with one about to run out.
+const refreshMargin = 5 * time.Minute
+
+// Path the localhost listener takes the redirect from Dropbox on.
+const callbackPath = "/callback"
+
+var errNoRefreshToken = errors.New("Dropbox sent no refresh token")
+
+// Token is what an authorization leaves to keep: the refresh token, which
+// lasts until the user revokes it, and the access token last got with it.
+type Token struct {
+	AppKey       string    `json:"app_key"`
+	RefreshToken string    `json:"refresh_token"`
+	AccessToken  string    `json:"access_token,omitempty"`
+	Expiry       time.Time `json:"expiry,omitempty"`
+}
+
+// Flow is one authorization of the app with a given key by a user.
+type Flow struct {
+	config   oauth2.Config
+	verifier string // PKCE code verifier, only its hash goes to the browser
+	state    string
+}
+
+// NewFlow starts an authorization of the app with key appKey at endpoint.
+// Dropbox sends the browser back to redirectURL with the code, or shows the
+// code for the user to paste when it is empty.
+func NewFlow(appKey string, endpoint oauth2.Endpoint, redirectURL string) (*Flow, error) {
+	verifier, err := random(64)
+	if err != nil {
+		return nil, err
+	}
+	state, err := random(16)
+	if err != nil {
+		return nil, err
+	}
+	return &Flow{
+		config: oauth2.Config{
+			ClientID:    appKey,
+			Endpoint:    endpoint,
+			RedirectURL: redirectURL,
+		},
+		verifier: base64.RawURLEncoding.EncodeToString(verifier),
+		state:    hex.EncodeToString(state),
+	}, nil
+}
+
+func random(n int) ([]byte, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	return b, err
+}
+
+// URL is the page the user authorizes the app on.
+func (f *Flow) URL() string {
+	challenge := sha256.Sum256([]byte(f.verifier))
+	return f.config.AuthCodeURL(f.state,
+		oauth2.SetAuthURLParam("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:])),
+		oauth2.SetAuthURLParam("code_challenge_method", "S256"),
+		// Asks for a refresh token
+		oauth2.SetAuthURLParam("token_access_type", "offline"))
+}
+
+// Exchange trades the code Dropbox handed out for tokens.
+func (f *Flow) Exchange(ctx context.Context, code string) (*Token, error) {
+	t, err := f.config.Exchange(ctx, code, oauth2.SetAuthURLParam("code_verifier", f.verifier))
+	if err != nil {
+		return nil, err
+	}
+	if t.RefreshToken == "" {
+		return nil, errNoRefreshToken
+	}
+	return &Token{
+		AppKey:       f.config.ClientID,
+		RefreshToken: t.RefreshToken,
+		AccessToken:  t.AccessToken,
+		Expiry:       t.Expiry,
+	}, nil
+}
+
+// LocalRedirect returns the redirect URL for a listener on l, to register
+// with the app and pass to NewFlow.
+func LocalRedirect(l net.Listener) string {
+	return fmt.Sprintf("http://localhost:%d%s", l.Addr().(*net.TCPAddr).Port, callbackPath)
+}
+
+// Receive serves the redirect from Dropbox on l until it brings a code, and
+// exchanges it. l is closed when it returns.
+func (f *Flow) Receive(ctx context.Context, l net.Listener) (*Token, error) {
+	codes := make(chan string, 1)
+	errs := make(chan error, 1)
+	mux := http.NewServeMux()
+	mux.HandleFunc(callbackPath, func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		switch {
+		case q.Get("state") != f.state:
+			// Not the browser we sent, keep waiting
+			http.Error(w, "Unexpected state", http.StatusBadRequest)
+			return
+		case q.Get("error") != "":
+			fmt.Fprintln(w, "dropboxfs was not authorized:", q.Get("error_description"))
+			errs <- fmt.Errorf("authorization failed: %s %s", q.Get("error"), q.Get("error_description"))
+		default:
+			fmt.Fprintln(w, "dropboxfs is authorized, you can close this page.")
+			codes <- q.Get("code")
+		}
+	})
+	srv := &http.Server{Handler: mux}
+	go srv.Serve(l)
+	defer srv.Close()
+	select {
+	case code := <-codes:
+		return f.Exchange(ctx, code)
+	case err := <-errs:
+		return nil, err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// refresher hands out the access token of a Token, getting a new one with
+// the refresh token when it is about to expire.
+type refresher struct {
+	config oauth2.Config
+	save   func(*Token)
+	token  *Token
+	sync.Mutex
+}
+
+func (r *refresher) Token() (*oauth2.Token, error) {
+	r.Lock()
+	defer r.Unlock()
+	if r.token.AccessToken == "" || time.Until(r.token.Expiry) < refreshMargin {
+		t, err := r.config.TokenSource(context.Background(), &oauth2.Token{RefreshToken: r.token.RefreshToken}).Token()
+		if err != nil {
+			log.Errorln("Unable to refresh Dropbox access token", err)
+			return nil, err
+		}
+		refreshed := *r.token
+		refreshed.AccessToken, refreshed.Expiry = t.AccessToken, t.Expiry
+		if t.RefreshToken != "" {
+			refreshed.RefreshToken = t.RefreshToken
+		}
+		r.token = &refreshed
+		log.Debugln("Refreshed Dropbox access token, valid until", t.Expiry)
+		if r.save != nil {
+			r.save(&refreshed)
+		}
+	}
+	return &oauth2.Token{AccessToken: r.token.AccessToken, TokenType: "Bearer", Expiry: r.token.Expiry}, nil
+}
+
+// Client returns an HTTP client for dropbox.Config that authorizes requests
+// with t. A new access token is got with the refresh token shortly before
+// the current one expires, and handed to save so it outlives the process.
+// Tokens without a refresh token are used as they are.
+func Client(t *Token, endpoint oauth2.Endpoint, save func(*Token)) *http.Client {
+	var src oauth2.TokenSource = oauth2.StaticTokenSource(&oauth2.Token{AccessToken: t.AccessToken, TokenType: "Bearer"})
+	if t.RefreshToken != "" {
+		src = &refresher{
+			config: oauth2.Config{ClientID: t.AppKey, Endpoint: endpoint},
+			save:   save,
+			token:  t,
+		}
+	}
+	return &http.Client{Transport: &oauth2.Transport{Source: src}}
+}
@@ -0,0 +1,210 @@
+package oauth
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// scrypt cost parameters for new stores, as recommended for interactive
+// logins. Stores keep the ones they were made with.
+const (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+// ErrNoAccount is returned for accounts that have no token in the store.
+var ErrNoAccount = errors.New("no token for this account")
+
+var errWrongPassphrase = errors.New("wrong passphrase, or the token store is damaged")
+
+// storeFile is how a Store is kept on disk. Accounts holds the tokens,
+// keyed by account name, as JSON sealed with AES-256-GCM under a key derived
+// from the passphrase with scrypt.
+type storeFile struct {
+	N        int    `json:"n"`
+	R        int    `json:"r"`
+	P        int    `json:"p"`
+	Salt     []byte `json:"salt"`
+	Nonce    []byte `json:"nonce"`
+	Accounts []byte `json:"accounts"`
+}
+
+// Store keeps the tokens of any number of accounts in one file, encrypted
+// with a passphrase.
+type Store struct {
+	path   string
+	header storeFile // KDF parameters and salt the key was derived with
+	aead   cipher.AEAD
+	sync.Mutex
+}
+
+// DefaultStorePath is where the token store is kept unless told otherwise,
+// under the user config directory ($XDG_CONFIG_HOME on Linux).
+func DefaultStorePath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "dropboxfs", "tokens"), nil
+}
+
+// StoreExists reports whether there is a token store at path, so callers
+// know whether to ask for a new passphrase or an existing one.
+func StoreExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// OpenStore opens the token store at path with passphrase. A store that
+// doesn't exist yet is made on the first Put.
+func OpenStore(path string, passphrase []byte) (*Store, error) {
+	s := &Store{path: path}
+	f, err := s.read()
+	switch {
+	case os.IsNotExist(err):
+		salt, err := random(32)
+		if err != nil {
+			return nil, err
+		}
+		f = &storeFile{N: scryptN, R: scryptR, P: scryptP, Salt: salt}
+	case err != nil:
+		return nil, err
+	}
+	key, err := scrypt.Key(passphrase, f.Salt, f.N, f.R, f.P, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if s.aead, err = cipher.NewGCM(block); err != nil {
+		return nil, err
+	}
+	s.header = storeFile{N: f.N, R: f.R, P: f.P, Salt: f.Salt}
+	// Checks the passphrase before anyone relies on it
+	if _, err := s.accounts(f); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Store) read() (*storeFile, error) {
+	data, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return nil, err
+	}
+	f := &storeFile{}
+	if err := json.Unmarshal(data, f); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// accounts decrypts the tokens in f. f is nil when there is no file yet.
+func (s *Store) accounts(f *storeFile) (map[string]*Token, error) {
+	tokens := map[string]*Token{}
+	if f == nil || f.Accounts == nil {
+		return tokens, nil
+	}
+	if len(f.Nonce) != s.aead.NonceSize() {
+		return nil, errWrongPassphrase
+	}
+	data, err := s.aead.Open(nil, f.Nonce, f.Accounts, nil)
+	if err != nil {
+		return nil, errWrongPassphrase
+	}
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// load reads and decrypts the tokens currently in the file.
+// lock assumed
+func (s *Store) load() (map[string]*Token, error) {
+	f, err := s.read()
+	if os.IsNotExist(err) {
+		return map[string]*Token{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if f.N != s.header.N || f.R != s.header.R || f.P != s.header.P || string(f.Salt) != string(s.header.Salt) {
+		// Made again with another passphrase since it was opened
+		return nil, errWrongPassphrase
+	}
+	return s.accounts(f)
+}
+
+// Get returns the token of account.
+func (s *Store) Get(account string) (*Token, error) {
+	s.Lock()
+	defer s.Unlock()
+	tokens, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	t, found := tokens[account]
+	if !found {
+		return nil, ErrNoAccount
+	}
+	return t, nil
+}
+
+// Accounts lists the accounts with a token in the store, sorted.
+func (s *Store) Accounts() ([]string, error) {
+	s.Lock()
+	defer s.Unlock()
+	tokens, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for name := range tokens {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Put saves t as the token of account, replacing any it had. A nil t
+// removes the account.
+func (s *Store) Put(account string, t *Token) error {
+	s.Lock()
+	defer s.Unlock()
+	tokens, err := s.load()
+	if err != nil {
+		return err
+	}
+	if t == nil {
+		delete(tokens, account)
+	} else {
+		tokens[account] = t
+	}
+	data, err := json.Marshal(tokens)
+	if err != nil {
+		return err
+	}
+	f := s.header
+	if f.Nonce, err = random(s.aead.NonceSize()); err != nil {
+		return err
+	}
+	f.Accounts = s.aead.Seal(nil, f.Nonce, data, nil)
+	if data, err = json.MarshalIndent(&f, "", "  "); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return err
+	}
+	return writeFile(s.path, data)
+}